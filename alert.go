@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/safing/portmaster/plugin/shared/proto"
+)
+
+const (
+	// defaultAlertFailureRate is the default failure rate in percent above
+	// which the user is notified.
+	defaultAlertFailureRate = 20
+
+	// defaultAlertWindow is the default time in minutes the failure rate
+	// is calculated for.
+	defaultAlertWindow = 5
+
+	// alertMinExchanges is the number of exchanges required in the window
+	// before the failure rate is checked, so a few failed queries after a
+	// period of inactivity do not raise an alert.
+	alertMinExchanges = 20
+)
+
+// alertBucket counts the exchanges with upstream servers during one minute.
+type alertBucket struct {
+	minute   int64
+	answered int64
+	failed   int64
+	servers  map[string]int64
+}
+
+var (
+	alertLock sync.Mutex
+
+	// alertRate is the failure rate in percent above which the user is
+	// notified. Alerting is disabled if it's zero.
+	alertRate int64
+
+	// alertWindow is the number of minutes the failure rate is calculated
+	// for.
+	alertWindow int64 = defaultAlertWindow
+
+	// alertBuckets holds the buckets of the last alertWindow minutes,
+	// oldest first.
+	alertBuckets []*alertBucket
+
+	// alerting is set while the failure rate is above alertRate so the
+	// user is only notified once.
+	alerting bool
+)
+
+func setAlertFailureRate(percent int64) {
+	alertLock.Lock()
+	defer alertLock.Unlock()
+
+	alertRate = min(max(percent, 0), 100)
+	if alertRate == 0 {
+		alertBuckets, alerting = nil, false
+	}
+}
+
+func setAlertWindow(minutes int64) {
+	alertLock.Lock()
+	defer alertLock.Unlock()
+
+	alertWindow = max(minutes, 1)
+}
+
+// recordAlertExchange adds the result of an exchange with the server name
+// and notifies the user if the failure rate exceeds the threshold.
+func recordAlertExchange(name string, ok bool) {
+	alertLock.Lock()
+	defer alertLock.Unlock()
+
+	if alertRate == 0 {
+		return
+	}
+
+	now := time.Now()
+	bucket := currentAlertBucketLocked(now)
+
+	if ok {
+		bucket.answered++
+	} else {
+		bucket.failed++
+		bucket.servers[name]++
+	}
+
+	var answered, failed int64
+	servers := make(map[string]int64)
+	for _, b := range alertBuckets {
+		answered += b.answered
+		failed += b.failed
+
+		for server, count := range b.servers {
+			servers[server] += count
+		}
+	}
+
+	total := answered + failed
+	if total < alertMinExchanges {
+		return
+	}
+
+	rate := percentOf(failed, total)
+
+	switch {
+	case rate > float64(alertRate) && !alerting:
+		alerting = true
+
+		hclog.L().Warn("upstream failure rate exceeds threshold", "rate", rate, "threshold", alertRate, "window", alertWindow)
+
+		notify(&proto.Notification{
+			EventId: "dnscrypt-failure-rate-" + now.Format(time.RFC3339),
+			Title:   "DNSCrypt: High failure rate",
+			Message: alertMessage(rate, total, servers),
+		})
+
+	case rate <= float64(alertRate) && alerting:
+		alerting = false
+
+		hclog.L().Info("upstream failure rate is back below threshold", "rate", rate, "threshold", alertRate)
+	}
+}
+
+// currentAlertBucketLocked returns the bucket for now, dropping buckets
+// that are outside of the window. It must be called with alertLock held.
+func currentAlertBucketLocked(now time.Time) *alertBucket {
+	minute := now.Unix() / 60
+
+	keep := alertBuckets[:0]
+	for _, b := range alertBuckets {
+		if b.minute > minute-alertWindow {
+			keep = append(keep, b)
+		}
+	}
+	alertBuckets = keep
+
+	if n := len(alertBuckets); n > 0 && alertBuckets[n-1].minute == minute {
+		return alertBuckets[n-1]
+	}
+
+	bucket := &alertBucket{
+		minute:  minute,
+		servers: make(map[string]int64),
+	}
+	alertBuckets = append(alertBuckets, bucket)
+
+	return bucket
+}
+
+// alertMessage describes the failure rate and the servers that failed the
+// most.
+func alertMessage(rate float64, total int64, servers map[string]int64) string {
+	names := make([]string, 0, len(servers))
+	for name := range servers {
+		names = append(names, name)
+	}
+
+	sort.Slice(names, func(i, j int) bool {
+		if servers[names[i]] != servers[names[j]] {
+			return servers[names[i]] > servers[names[j]]
+		}
+
+		return names[i] < names[j]
+	})
+
+	failing := make([]string, 0, len(names))
+	for _, name := range names {
+		failing = append(failing, fmt.Sprintf("%s (%d)", name, servers[name]))
+	}
+
+	return fmt.Sprintf("%.1f%% of the %d queries sent to the configured servers in the last %d minutes failed. Failures by server: %s.",
+		rate, total, alertWindow, strings.Join(failing, ", "))
+}
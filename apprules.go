@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/safing/portmaster/plugin/shared/proto"
+)
+
+// errNoApplicationServer is returned if a query matches an application
+// rule but none of the servers of the rule is available.
+var errNoApplicationServer = errors.New("no server available for application rule")
+
+// applicationRule selects the servers used for queries of a process.
+type applicationRule struct {
+	process string
+	servers []string
+}
+
+var (
+	applicationLock  sync.RWMutex
+	applicationRules []applicationRule
+)
+
+// setApplicationRules configures the servers that queries of specific
+// processes are sent to. Each entry has the format
+// "<process> <server> [<server>...]".
+func setApplicationRules(values []string) {
+	var rules []applicationRule
+
+	for _, value := range values {
+		fields := strings.Fields(value)
+		if len(fields) < 2 {
+			hclog.L().Error("ignoring invalid application rule", "rule", value)
+
+			continue
+		}
+
+		rules = append(rules, applicationRule{
+			process: fields[0],
+			servers: fields[1:],
+		})
+	}
+
+	applicationLock.Lock()
+	applicationRules = rules
+	applicationLock.Unlock()
+}
+
+// matches reports whether the rule applies to process. Rules that contain
+// a path separator are matched against the full binary path, all others
+// against the process name and the file name of the binary.
+func (rule applicationRule) matches(process *proto.ProcessContext) bool {
+	if strings.ContainsAny(rule.process, `/\`) {
+		return strings.EqualFold(rule.process, process.GetBinaryPath())
+	}
+
+	path := process.GetBinaryPath()
+	binary := path[strings.LastIndexAny(path, `/\`)+1:]
+
+	return strings.EqualFold(rule.process, binary) ||
+		strings.EqualFold(rule.process, process.GetName())
+}
+
+// applicationServers returns the servers from list that queries of the
+// process that initiated conn are sent to. The first matching rule wins.
+// The second return value is false if no rule matches.
+func applicationServers(list []*server, conn *proto.Connection) ([]*server, bool) {
+	applicationLock.RLock()
+	defer applicationLock.RUnlock()
+
+	idx, ok := applicationRuleLocked(conn)
+	if !ok {
+		return nil, false
+	}
+
+	return serversByName(list, applicationRules[idx].servers), true
+}
+
+// matchApplicationRule returns the index of the rule matching the process that
+// initiated conn. The second return value is false if no rule matches.
+func matchApplicationRule(conn *proto.Connection) (int, bool) {
+	applicationLock.RLock()
+	defer applicationLock.RUnlock()
+
+	return applicationRuleLocked(conn)
+}
+
+// applicationRuleLocked must be called with applicationLock held.
+func applicationRuleLocked(conn *proto.Connection) (int, bool) {
+	process := conn.GetProcess()
+	if process == nil {
+		return 0, false
+	}
+
+	for idx, rule := range applicationRules {
+		if rule.matches(process) {
+			return idx, true
+		}
+	}
+
+	return 0, false
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ameshkov/dnsstamps"
+	"github.com/miekg/dns"
+	"github.com/spf13/cobra"
+)
+
+// benchmarkResult holds the measurements of a single server.
+type benchmarkResult struct {
+	name     string
+	protocol string
+
+	// dial is the time needed to connect to the server. For servers using
+	// TLS it's the time of the first query, including the handshake.
+	dial time.Duration
+
+	// cert is the time needed to fetch and validate the certificate of a
+	// DNSCrypt server.
+	cert time.Duration
+
+	latencies []time.Duration
+	errors    int
+	err       error
+}
+
+// percentile returns the p-th percentile of the sorted query latencies.
+func (r *benchmarkResult) percentile(p float64) time.Duration {
+	if len(r.latencies) == 0 {
+		return 0
+	}
+
+	idx := int(float64(len(r.latencies)-1) * p)
+
+	return r.latencies[idx]
+}
+
+// benchmarkCommand returns the command that measures the latency of
+// servers without the Portmaster.
+func benchmarkCommand() *cobra.Command {
+	var (
+		source      string
+		domain      string
+		queries     int
+		concurrency int
+	)
+
+	cmd := &cobra.Command{
+		Use:   "benchmark [<stamp>...]",
+		Short: "Measure dial, certificate and query latency of servers",
+		Long:  "Measure dial, certificate and query latency of the given server stamps or, if none are given, of all servers of a resolver list.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+
+			ctx := cmd.Context()
+
+			stamps := args
+			if len(stamps) == 0 {
+				list, err := resolverListStamps(ctx, source)
+				if err != nil {
+					return err
+				}
+
+				stamps = list
+			}
+
+			results := make([]*benchmarkResult, len(stamps))
+
+			var wg sync.WaitGroup
+			sem := make(chan struct{}, max(concurrency, 1))
+			for idx, stamp := range stamps {
+				wg.Add(1)
+
+				go func(idx int, stamp string) {
+					defer wg.Done()
+
+					sem <- struct{}{}
+					defer func() { <-sem }()
+
+					results[idx] = benchmarkServer(ctx, stamp, dns.Fqdn(domain), queries)
+				}(idx, stamp)
+			}
+			wg.Wait()
+
+			printBenchmark(cmd.OutOrStdout(), results)
+
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&source, "source", defaultSource, "The resolver list to benchmark if no stamps are given, in the format \"<url> <minisign-key>\"")
+	cmd.Flags().StringVar(&domain, "domain", "example.com", "The domain to resolve")
+	cmd.Flags().IntVar(&queries, "queries", 10, "The number of queries sent to each server")
+	cmd.Flags().IntVar(&concurrency, "concurrency", 10, "The number of servers benchmarked at the same time")
+
+	return cmd
+}
+
+// resolverListStamps downloads the resolver list described by value and
+// returns one stamp for each server matching the server requirements.
+func resolverListStamps(ctx context.Context, value string) ([]string, error) {
+	entries, err := fetchSources(ctx, []string{value})
+	if err != nil {
+		return nil, err
+	}
+
+	var stamps []string
+	for _, name := range sortedKeys(entries) {
+		if stamp, ok := getFilter().selectStamp(entries[name]); ok {
+			stamps = append(stamps, stamp)
+		}
+	}
+
+	return stamps, nil
+}
+
+// benchmarkServer dials the server described by stamp and sends queries
+// for domain to it.
+func benchmarkServer(ctx context.Context, stamp, domain string, queries int) *benchmarkResult {
+	cfg := serverConfig{
+		name:  stampName(stamp),
+		stamp: stamp,
+	}
+
+	result := &benchmarkResult{
+		name:     cfg.name,
+		protocol: protocolName(stamp),
+	}
+
+	var isDNSCrypt bool
+	if parsed, err := dnsstamps.NewServerStampFromString(stamp); err == nil {
+		if parsed.Proto == dnsstamps.StampProtoTypeDNSCrypt {
+			isDNSCrypt = true
+
+			// DNSCrypt servers are queried over UDP, so the time to
+			// establish a TCP connection is measured instead.
+			started := time.Now()
+			conn, err := net.DialTimeout("tcp", parsed.ServerAddrStr, defaultTimeout)
+			if err == nil {
+				result.dial = time.Since(started)
+				conn.Close()
+			}
+		}
+	}
+
+	started := time.Now()
+	srv, err := dialServer(cfg)
+	if err != nil {
+		result.err = err
+
+		return result
+	}
+
+	if isDNSCrypt {
+		result.cert = time.Since(started)
+	}
+
+	for i := 0; i < queries; i++ {
+		queryCtx, cancel := context.WithTimeout(ctx, defaultTimeout)
+
+		req := new(dns.Msg)
+		req.SetQuestion(domain, dns.TypeA)
+
+		started := time.Now()
+		_, err := srv.exchange(queryCtx, req)
+		rtt := time.Since(started)
+
+		cancel()
+
+		switch {
+		case err != nil:
+			result.errors++
+			result.err = err
+		case i == 0 && !isDNSCrypt:
+			// the first query sets up the connection and is therefore
+			// not taken into account for the query latency.
+			result.dial = rtt
+		default:
+			result.latencies = append(result.latencies, rtt)
+		}
+	}
+
+	slices.Sort(result.latencies)
+
+	return result
+}
+
+// printBenchmark prints results as a table sorted by median latency.
+// Servers that did not answer any query are listed last.
+func printBenchmark(out io.Writer, results []*benchmarkResult) {
+	sort.SliceStable(results, func(i, j int) bool {
+		a, b := results[i], results[j]
+		if (len(a.latencies) == 0) != (len(b.latencies) == 0) {
+			return len(a.latencies) > 0
+		}
+
+		return a.percentile(0.5) < b.percentile(0.5)
+	})
+
+	ms := func(d time.Duration) string {
+		if d == 0 {
+			return "-"
+		}
+
+		return fmt.Sprintf("%.1fms", float64(d)/float64(time.Millisecond))
+	}
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	defer w.Flush()
+
+	fmt.Fprintln(w, "SERVER\tPROTOCOL\tDIAL\tCERT\tMEDIAN\tP95\tERRORS")
+	for _, r := range results {
+		if len(r.latencies) == 0 && r.err != nil {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t-\t-\t%s\n", r.name, r.protocol, ms(r.dial), ms(r.cert), r.err)
+
+			continue
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%d\n", r.name, r.protocol, ms(r.dial), ms(r.cert), ms(r.percentile(0.5)), ms(r.percentile(0.95)), r.errors)
+	}
+}
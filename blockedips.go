@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/netip"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/miekg/dns"
+	"github.com/safing/portmaster/plugin/shared/proto"
+)
+
+var (
+	blockedIPsLock  sync.RWMutex
+	blockedNetworks []netip.Prefix
+)
+
+// parseIPRange parses an IP address or a network in CIDR notation. Single
+// addresses are returned as prefix of their full length.
+func parseIPRange(value string) (netip.Prefix, error) {
+	value = strings.TrimSpace(value)
+
+	if addr, err := netip.ParseAddr(value); err == nil {
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+
+	prefix, err := netip.ParsePrefix(value)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+
+	return prefix.Masked(), nil
+}
+
+// setBlockedIPs configures the addresses and networks that must not be
+// contained in answers.
+func setBlockedIPs(values []string) {
+	var list []netip.Prefix
+
+	for _, value := range values {
+		prefix, err := parseIPRange(value)
+		if err != nil {
+			hclog.L().Error("ignoring invalid blocked IP", "value", value, "error", err)
+
+			continue
+		}
+
+		list = append(list, prefix)
+	}
+
+	blockedIPsLock.Lock()
+	blockedNetworks = list
+	blockedIPsLock.Unlock()
+}
+
+// blockedAnswer reports whether one of the A or AAAA records of res
+// contains a blocked address.
+func blockedAnswer(res *proto.DNSResponse) bool {
+	blockedIPsLock.RLock()
+	defer blockedIPsLock.RUnlock()
+
+	if len(blockedNetworks) == 0 {
+		return false
+	}
+
+	for _, rr := range res.GetRrs() {
+		if t := uint16(rr.GetType()); t != dns.TypeA && t != dns.TypeAAAA {
+			continue
+		}
+
+		addr, ok := netip.AddrFromSlice(rr.GetData())
+		if !ok {
+			continue
+		}
+
+		addr = addr.Unmap()
+		for _, prefix := range blockedNetworks {
+			if prefix.Contains(addr) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
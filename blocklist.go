@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/miekg/dns"
+)
+
+// blocklistServer is logged as the server of blocked queries.
+const blocklistServer = "blocklist"
+
+// hostsNames are names found in hosts files that must not be blocked when
+// using a hosts file as blocklist.
+var hostsNames = []string{
+	"localhost.",
+	"localhost.localdomain.",
+	"local.",
+	"broadcasthost.",
+	"ip6-localhost.",
+	"ip6-loopback.",
+}
+
+var (
+	blocklistLock  sync.RWMutex
+	blocklistFiles []string
+
+	// remoteBlocklists are downloaded by watchBlocklists and stored in
+	// blocklistCacheDir.
+	remoteBlocklists  []remoteBlocklist
+	blocklistCacheDir string
+
+	blockedDomains map[string]struct{}
+
+	// scheduledDomains are only blocked while one of their schedules is
+	// active.
+	scheduledDomains map[string][]string
+
+	// allowedDomains are never blocked, even if they are listed in a
+	// blocklist.
+	allowedDomains map[string]struct{}
+)
+
+// setAllowlist configures the domains that are never blocked.
+func setAllowlist(values []string) {
+	domains := make(map[string]struct{})
+	for _, value := range values {
+		if value = strings.TrimSpace(value); value != "" {
+			domains[dns.CanonicalName(strings.TrimPrefix(value, "*."))] = struct{}{}
+		}
+	}
+
+	blocklistLock.Lock()
+	allowedDomains = domains
+	blocklistLock.Unlock()
+}
+
+// setBlocklistFiles configures the blocklist files and loads them.
+func setBlocklistFiles(paths []string) {
+	files := make([]string, 0, len(paths))
+	for _, path := range paths {
+		if path = strings.TrimSpace(path); path != "" {
+			files = append(files, path)
+		}
+	}
+
+	blocklistLock.Lock()
+	blocklistFiles = files
+	blocklistLock.Unlock()
+
+	loadBlocklists()
+}
+
+// loadBlocklists reads the configured blocklist files and the downloaded
+// copies of the remote blocklists. Lists that cannot be read are skipped.
+func loadBlocklists() {
+	blocklistLock.RLock()
+	files := slices.Clone(blocklistFiles)
+	dir := blocklistCacheDir
+	remote := slices.Clone(remoteBlocklists)
+	blocklistLock.RUnlock()
+
+	if dir == "" {
+		// remote blocklists are only used by the running plugin
+		remote = nil
+	}
+
+	domains := make(map[string]struct{})
+	scheduled := make(map[string][]string)
+	for _, path := range files {
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dataDirectory(), path)
+		}
+
+		count, err := readBlocklist(path, domains, scheduled)
+		if err != nil {
+			hclog.L().Error("failed to read blocklist", "path", path, "error", err)
+
+			continue
+		}
+
+		hclog.L().Info("loaded blocklist", "path", path, "domains", count)
+	}
+
+	for _, list := range remote {
+		count, err := readRemoteBlocklist(dir, list, domains, scheduled)
+		if errors.Is(err, fs.ErrNotExist) {
+			// not downloaded yet
+			continue
+		}
+		if err != nil {
+			hclog.L().Error("failed to read blocklist", "url", list.url, "error", err)
+
+			continue
+		}
+
+		hclog.L().Info("loaded blocklist", "url", list.url, "domains", count)
+	}
+
+	blocklistLock.Lock()
+	blockedDomains = domains
+	scheduledDomains = scheduled
+	blocklistLock.Unlock()
+}
+
+// readBlocklist adds the domains listed in the file at path to domains, or
+// to scheduled if they are only blocked on a schedule, and returns the
+// number of domains read.
+func readBlocklist(path string, domains map[string]struct{}, scheduled map[string][]string) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	return parseBlocklist(file, domains, scheduled)
+}
+
+// parseBlocklist adds the domains listed in r to domains and returns the
+// number of domains read. Each line contains one domain, and lines of hosts
+// files are accepted as well. Comments start with "#". Lines ending with
+// "@<schedule>" are only blocked while the schedule is active and are added
+// to scheduled instead, mapped to the names of their schedules.
+func parseBlocklist(r io.Reader, domains map[string]struct{}, scheduled map[string][]string) (int, error) {
+	count := 0
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+
+		fields := strings.Fields(line)
+
+		var schedule string
+		if n := len(fields); n > 1 && strings.HasPrefix(fields[n-1], "@") {
+			schedule = strings.ToLower(strings.TrimPrefix(fields[n-1], "@"))
+			fields = fields[:n-1]
+		}
+
+		if len(fields) == 0 {
+			continue
+		}
+
+		// hosts files list any number of names after the address
+		names := fields[:1]
+		if net.ParseIP(fields[0]) != nil {
+			names = fields[1:]
+		}
+
+		for _, name := range names {
+			name = dns.CanonicalName(strings.TrimPrefix(name, "*."))
+			if _, ok := dns.IsDomainName(name); !ok || slices.Contains(hostsNames, name) {
+				continue
+			}
+
+			if schedule == "" {
+				domains[name] = struct{}{}
+			} else if !slices.Contains(scheduled[name], schedule) {
+				scheduled[name] = append(scheduled[name], schedule)
+			}
+			count++
+		}
+	}
+
+	return count, scanner.Err()
+}
+
+// blocked reports whether name or one of its parent domains is listed in
+// a blocklist, without a schedule or with one that is active right now.
+// Domains on the allowlist are never blocked.
+func blocked(name string) bool {
+	blocklistLock.RLock()
+	defer blocklistLock.RUnlock()
+
+	if len(blockedDomains) == 0 && len(scheduledDomains) == 0 {
+		return false
+	}
+
+	name = dns.CanonicalName(name)
+
+	if matchDomain(allowedDomains, name) {
+		return false
+	}
+
+	if matchDomain(blockedDomains, name) {
+		return true
+	}
+
+	now := time.Now()
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		for _, schedule := range scheduledDomains[name[off:]] {
+			if scheduleActive(schedule, now) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// allowed reports whether name or one of its parent domains is on the
+// allowlist.
+func allowed(name string) bool {
+	blocklistLock.RLock()
+	defer blocklistLock.RUnlock()
+
+	return matchDomain(allowedDomains, dns.CanonicalName(name))
+}
+
+// matchDomain reports whether the canonical name or one of its parent
+// domains is in domains.
+func matchDomain(domains map[string]struct{}, name string) bool {
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if _, ok := domains[name[off:]]; ok {
+			return true
+		}
+	}
+
+	return false
+}
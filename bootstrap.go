@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+var (
+	bootstrapLock    sync.RWMutex
+	bootstrapServers []string
+	bootstrapNext    uint32
+
+	bootstrapResolver = &net.Resolver{
+		PreferGo: true,
+		Dial:     dialBootstrap,
+	}
+)
+
+// setBootstrapResolvers configures the plain DNS servers used to resolve
+// the hostnames of upstream servers. Each entry must be in the format
+// "ip[:port]".
+func setBootstrapResolvers(values []string) {
+	var list []string
+	for _, value := range values {
+		addr := value
+		if _, _, err := net.SplitHostPort(value); err != nil {
+			addr = net.JoinHostPort(value, "53")
+		}
+
+		host, _, _ := net.SplitHostPort(addr)
+		if net.ParseIP(host) == nil {
+			hclog.L().Error("ignoring bootstrap resolver, an IP address is required", "resolver", value)
+
+			continue
+		}
+
+		list = append(list, addr)
+	}
+
+	bootstrapLock.Lock()
+	bootstrapServers = list
+	bootstrapLock.Unlock()
+
+	reloadServers()
+}
+
+// dialBootstrap is used by bootstrapResolver to connect to one of the
+// configured bootstrap resolvers. Each call uses the next one.
+func dialBootstrap(ctx context.Context, network, _ string) (net.Conn, error) {
+	bootstrapLock.RLock()
+	list := bootstrapServers
+	bootstrapLock.RUnlock()
+
+	if len(list) == 0 {
+		return nil, fmt.Errorf("no bootstrap resolvers configured")
+	}
+
+	addr := list[int(atomic.AddUint32(&bootstrapNext, 1))%len(list)]
+
+	var dialer net.Dialer
+
+	return dialer.DialContext(ctx, network, addr)
+}
+
+// resolveUpstreamAddr resolves the host part of addr using the configured
+// bootstrap resolvers. If none are configured, or addr already contains
+// an IP address, addr is returned unchanged and resolution is left to
+// the operating system.
+func resolveUpstreamAddr(ctx context.Context, addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+
+	if net.ParseIP(host) != nil {
+		return addr, nil
+	}
+
+	bootstrapLock.RLock()
+	enabled := len(bootstrapServers) > 0
+	bootstrapLock.RUnlock()
+
+	if !enabled {
+		return addr, nil
+	}
+
+	ips, err := bootstrapResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return "", err
+	}
+
+	if len(ips) == 0 {
+		return "", fmt.Errorf("failed to resolve %s: no addresses", host)
+	}
+
+	filter := getFilter()
+	ips = slices.DeleteFunc(ips, func(ip net.IPAddr) bool {
+		return !filter.allowsIP(ip.IP)
+	})
+
+	if len(ips) == 0 {
+		return "", fmt.Errorf("failed to resolve %s: no addresses of an enabled IP version", host)
+	}
+
+	ip := pickIP(ips, filter.prefer)
+
+	return net.JoinHostPort(ip.IP.String(), port), nil
+}
+
+// dialUpstream dials addr after resolving its hostname using the
+// bootstrap resolvers. If a proxy is configured, resolving the hostname
+// is left to the proxy.
+func dialUpstream(ctx context.Context, network, addr string) (net.Conn, error) {
+	if proxyEnabled() {
+		return dialNetwork(ctx, network, addr)
+	}
+
+	resolved, err := resolveUpstreamAddr(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// hostnames resolved by the operating system must not be dialed
+	// using a disabled IP version either
+	return dialNetwork(ctx, getFilter().restrictNetwork(network), resolved)
+}
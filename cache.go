@@ -0,0 +1,397 @@
+package main
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// cacheCleanupInterval defines how often expired entries are removed
+	// from the cache.
+	cacheCleanupInterval = time.Minute
+
+	// defaultCacheMaxTTL is the default upper limit for TTLs in seconds.
+	defaultCacheMaxTTL = 86400
+
+	// staleTTL is the TTL of records in stale responses as recommended by
+	// RFC 8767.
+	staleTTL = 30
+
+	// prefetchMinHits is the number of cache hits after which an entry is
+	// considered popular and refreshed before it expires.
+	prefetchMinHits = 3
+
+	// prefetchThreshold is the fraction of the original TTL that must be
+	// left when a popular entry is refreshed.
+	prefetchThreshold = 0.1
+
+	// defaultCacheSize is the default maximum number of cached responses.
+	defaultCacheSize = 10000
+)
+
+// cacheKey identifies a cached response.
+type cacheKey struct {
+	name  string
+	qtype uint16
+	class uint16
+
+	// routing is the routing key of the query, see routingKey, so
+	// responses of the servers of one process are not returned to others.
+	routing string
+}
+
+func newCacheKey(q dns.Question, routing string) cacheKey {
+	return cacheKey{
+		name:    strings.ToLower(q.Name),
+		qtype:   q.Qtype,
+		class:   q.Qclass,
+		routing: routing,
+	}
+}
+
+// cacheEntry is a cached response.
+type cacheEntry struct {
+	msg     *dns.Msg
+	stored  time.Time
+	expires time.Time
+
+	hits        atomic.Int64
+	prefetching atomic.Bool
+
+	// key and elem are used to evict the least recently used entry and
+	// are guarded by cacheLock.
+	key  cacheKey
+	elem *list.Element
+}
+
+var (
+	cacheEnabled  atomic.Bool
+	cachePrefetch atomic.Bool
+
+	// cacheMinTTL and cacheMaxTTL hold the limits TTLs are clamped to in
+	// seconds. Zero disables the respective limit.
+	cacheMinTTL atomic.Int64
+	cacheMaxTTL atomic.Int64
+
+	// cacheStaleTime holds the number of seconds expired entries may
+	// still be served if no server is reachable. Serve-stale is disabled
+	// if it's zero.
+	cacheStaleTime atomic.Int64
+
+	// cacheSize holds the maximum number of cached responses. The size of
+	// the cache is not limited if it's zero.
+	cacheSize atomic.Int64
+
+	// cacheBypass holds the domains whose responses are never cached.
+	cacheBypassLock sync.RWMutex
+	cacheBypass     map[string]struct{}
+
+	// cacheHits and cacheMisses count the lookups answered and not
+	// answered from the cache.
+	cacheHits   atomic.Int64
+	cacheMisses atomic.Int64
+
+	cacheLock    sync.Mutex
+	cacheEntries = make(map[cacheKey]*cacheEntry)
+	cacheLRU     = list.New()
+	cacheCleaned time.Time
+)
+
+func setCacheEnabled(enabled bool) {
+	cacheEnabled.Store(enabled)
+
+	if !enabled {
+		flushCache()
+	}
+}
+
+func setCacheMinTTL(seconds int64) {
+	cacheMinTTL.Store(max(seconds, 0))
+}
+
+func setCacheMaxTTL(seconds int64) {
+	cacheMaxTTL.Store(max(seconds, 0))
+}
+
+func setCacheStaleTime(seconds int64) {
+	cacheStaleTime.Store(max(seconds, 0))
+}
+
+func setCacheSize(size int64) {
+	cacheSize.Store(max(size, 0))
+
+	cacheLock.Lock()
+	defer cacheLock.Unlock()
+
+	evictCache()
+}
+
+// setCacheBypass configures the domains whose responses, including
+// those for subdomains, are never cached. Already cached responses for the
+// domains are removed.
+func setCacheBypass(domains []string) {
+	m := make(map[string]struct{}, len(domains))
+	for _, domain := range domains {
+		m[dns.CanonicalName(domain)] = struct{}{}
+	}
+
+	cacheBypassLock.Lock()
+	cacheBypass = m
+	cacheBypassLock.Unlock()
+
+	cacheLock.Lock()
+	defer cacheLock.Unlock()
+
+	for key, entry := range cacheEntries {
+		if bypassCache(key.name) {
+			removeCache(entry)
+		}
+	}
+}
+
+// bypassCache returns true if responses for name must not be cached.
+func bypassCache(name string) bool {
+	cacheBypassLock.RLock()
+	defer cacheBypassLock.RUnlock()
+
+	if len(cacheBypass) == 0 {
+		return false
+	}
+
+	name = dns.CanonicalName(name)
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if _, ok := cacheBypass[name[off:]]; ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// clampTTL limits ttl to the configured minimum and maximum TTL.
+func clampTTL(ttl uint32) uint32 {
+	if limit := cacheMinTTL.Load(); limit > 0 && int64(ttl) < limit {
+		ttl = uint32(min(limit, int64(^uint32(0))))
+	}
+
+	if limit := cacheMaxTTL.Load(); limit > 0 && int64(ttl) > limit {
+		ttl = uint32(limit)
+	}
+
+	return ttl
+}
+
+// clampTTLs limits the TTLs of all answers in res to the configured minimum
+// and maximum TTL.
+func clampTTLs(res *dns.Msg) {
+	for _, rr := range res.Answer {
+		rr.Header().Ttl = clampTTL(rr.Header().Ttl)
+	}
+}
+
+// flushCache removes all entries from the cache.
+func flushCache() {
+	cacheLock.Lock()
+	defer cacheLock.Unlock()
+
+	cacheEntries = make(map[cacheKey]*cacheEntry)
+	cacheLRU.Init()
+}
+
+// insertCache adds entry to the cache and evicts the least recently used
+// entries if the cache is full. It must be called with cacheLock held.
+func insertCache(key cacheKey, entry *cacheEntry) {
+	if old, ok := cacheEntries[key]; ok {
+		removeCache(old)
+	}
+
+	entry.key = key
+	entry.elem = cacheLRU.PushFront(entry)
+	cacheEntries[key] = entry
+
+	evictCache()
+}
+
+// removeCache removes entry from the cache. It must be called with
+// cacheLock held.
+func removeCache(entry *cacheEntry) {
+	cacheLRU.Remove(entry.elem)
+	delete(cacheEntries, entry.key)
+}
+
+// evictCache removes the least recently used entries until the cache does
+// not exceed the configured size. It must be called with cacheLock held.
+func evictCache() {
+	limit := cacheSize.Load()
+	if limit == 0 {
+		return
+	}
+
+	for int64(cacheLRU.Len()) > limit {
+		removeCache(cacheLRU.Back().Value.(*cacheEntry))
+	}
+}
+
+// getCache returns the cached entry for key and marks it as recently used.
+func getCache(key cacheKey) (*cacheEntry, bool) {
+	cacheLock.Lock()
+	defer cacheLock.Unlock()
+
+	entry, ok := cacheEntries[key]
+	if ok {
+		cacheLRU.MoveToFront(entry.elem)
+	}
+
+	return entry, ok
+}
+
+// cacheLookup returns a copy of the cached response for q, resolved using
+// routing, with TTLs
+// reduced by the time the response has been cached for. The second return
+// value is true if the entry is popular and should be refreshed now.
+func cacheLookup(q dns.Question, routing string) (*dns.Msg, bool, bool) {
+	if !cacheEnabled.Load() {
+		return nil, false, false
+	}
+
+	entry, ok := getCache(newCacheKey(q, routing))
+
+	now := time.Now()
+	if !ok || !now.Before(entry.expires) {
+		cacheMisses.Add(1)
+
+		return nil, false, false
+	}
+
+	cacheHits.Add(1)
+
+	hits := entry.hits.Add(1)
+
+	prefetch := false
+	if cachePrefetch.Load() && hits >= prefetchMinHits {
+		remaining := entry.expires.Sub(now)
+		ttl := entry.expires.Sub(entry.stored)
+
+		if float64(remaining) < float64(ttl)*prefetchThreshold {
+			// only refresh once
+			prefetch = entry.prefetching.CompareAndSwap(false, true)
+		}
+	}
+
+	return entry.copyAt(now), prefetch, true
+}
+
+// cacheLookupStale returns a copy of the cached response for q even if it
+// expired less than the configured stale time ago. Records of expired
+// responses are returned with a TTL of staleTTL.
+func cacheLookupStale(q dns.Question, routing string) (*dns.Msg, bool) {
+	if !cacheEnabled.Load() || cacheStaleTime.Load() == 0 {
+		return nil, false
+	}
+
+	entry, ok := getCache(newCacheKey(q, routing))
+
+	now := time.Now()
+	if !ok || now.After(entry.staleUntil()) {
+		return nil, false
+	}
+
+	if now.Before(entry.expires) {
+		return entry.copyAt(now), true
+	}
+
+	msg := entry.msg.Copy()
+	for _, rr := range msg.Answer {
+		rr.Header().Ttl = staleTTL
+	}
+
+	return msg, true
+}
+
+// staleUntil returns the time until which the entry may be served stale.
+func (entry *cacheEntry) staleUntil() time.Time {
+	return entry.expires.Add(time.Duration(cacheStaleTime.Load()) * time.Second)
+}
+
+// copyAt returns a copy of the cached response with TTLs reduced by the
+// time the response has been cached for at now.
+func (entry *cacheEntry) copyAt(now time.Time) *dns.Msg {
+	msg := entry.msg.Copy()
+
+	elapsed := uint32(now.Sub(entry.stored) / time.Second)
+	for _, rr := range msg.Answer {
+		if rr.Header().Ttl > elapsed {
+			rr.Header().Ttl -= elapsed
+		} else {
+			rr.Header().Ttl = 0
+		}
+	}
+
+	return msg
+}
+
+// cacheStore caches res as the response for q resolved using routing. Only successful responses
+// and negative responses with an SOA record are cached.
+func cacheStore(q dns.Question, routing string, res *dns.Msg) {
+	if !cacheEnabled.Load() || bypassCache(q.Name) {
+		return
+	}
+
+	ttl, ok := cacheTTL(res)
+	if !ok || ttl == 0 {
+		return
+	}
+
+	now := time.Now()
+
+	cacheLock.Lock()
+	defer cacheLock.Unlock()
+
+	if now.Sub(cacheCleaned) > cacheCleanupInterval {
+		for _, entry := range cacheEntries {
+			if now.After(entry.staleUntil()) {
+				removeCache(entry)
+			}
+		}
+
+		cacheCleaned = now
+	}
+
+	insertCache(newCacheKey(q, routing), &cacheEntry{
+		msg:     res.Copy(),
+		stored:  now,
+		expires: now.Add(time.Duration(ttl) * time.Second),
+	})
+}
+
+// cacheTTL returns how long res may be cached. That's the lowest TTL of
+// all answers or, for negative responses, the TTL of the SOA record as
+// defined in RFC 2308. The second return value is false if res must not
+// be cached.
+func cacheTTL(res *dns.Msg) (uint32, bool) {
+	if res.Rcode != dns.RcodeSuccess && res.Rcode != dns.RcodeNameError {
+		return 0, false
+	}
+
+	if len(res.Answer) > 0 && res.Rcode == dns.RcodeSuccess {
+		ttl := res.Answer[0].Header().Ttl
+		for _, rr := range res.Answer[1:] {
+			ttl = min(ttl, rr.Header().Ttl)
+		}
+
+		return ttl, true
+	}
+
+	for _, rr := range res.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return clampTTL(min(soa.Hdr.Ttl, soa.Minttl)), true
+		}
+	}
+
+	return 0, false
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"path"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/spf13/cobra"
+)
+
+const (
+	// cacheDumpFile is the name of the file in the plugin data directory
+	// that requests a dump of the cache.
+	cacheDumpFile = "dump-cache"
+
+	// cacheDumpResponseFile is the name of the file the running plugin
+	// dumps its cache to.
+	cacheDumpResponseFile = "cache-dump.json"
+)
+
+// cacheCommand returns the command that inspects the cache of the running
+// plugin.
+func cacheCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "cache",
+		Short: "Inspect the DNS cache of the running plugin",
+	}
+
+	cmd.AddCommand(cacheStatsCommand(), cacheDumpCommand())
+
+	return cmd
+}
+
+func cacheStatsCommand() *cobra.Command {
+	var (
+		flags   installFlags
+		timeout time.Duration
+	)
+
+	cmd := &cobra.Command{
+		Use:   "stats",
+		Short: "Print the statistics of the cache",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+
+			var status pluginStatus
+			if err := requestControlResponse(flags.dataDirectory(), statusFile, statusResponseFile, timeout, &status); err != nil {
+				return err
+			}
+
+			printCacheStats(cmd.OutOrStdout(), status.Cache)
+
+			return nil
+		},
+	}
+
+	flags.register(cmd)
+	cmd.Flags().DurationVar(&timeout, "timeout", 3*controlInterval, "Time to wait for the running plugin to answer")
+
+	return cmd
+}
+
+func cacheDumpCommand() *cobra.Command {
+	var (
+		flags   installFlags
+		timeout time.Duration
+	)
+
+	cmd := &cobra.Command{
+		Use:   "dump [pattern]",
+		Short: "Print the cached responses, optionally only those for names matching pattern",
+		Long:  "Print the cached responses of the running plugin sorted by name. If pattern is given, only responses for names matching the shell pattern (for example \"*.example.com\") are printed.",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+
+			pattern := "*"
+			if len(args) > 0 {
+				pattern = strings.ToLower(strings.TrimSuffix(args[0], "."))
+			}
+
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+			}
+
+			var entries []persistedEntry
+			if err := requestControlResponse(flags.dataDirectory(), cacheDumpFile, cacheDumpResponseFile, timeout, &entries); err != nil {
+				return err
+			}
+
+			entries = slices.DeleteFunc(entries, func(e persistedEntry) bool {
+				ok, _ := path.Match(pattern, strings.TrimSuffix(e.Name, "."))
+
+				return !ok
+			})
+
+			printCacheDump(cmd.OutOrStdout(), entries)
+
+			return nil
+		},
+	}
+
+	flags.register(cmd)
+	cmd.Flags().DurationVar(&timeout, "timeout", 3*controlInterval, "Time to wait for the running plugin to answer")
+
+	return cmd
+}
+
+// printCacheStats prints the statistics of the cache.
+func printCacheStats(out io.Writer, c cacheStatus) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	defer w.Flush()
+
+	if !c.Enabled {
+		fmt.Fprintln(w, "Enabled:\tno")
+
+		return
+	}
+
+	fmt.Fprintln(w, "Enabled:\tyes")
+	fmt.Fprintf(w, "Entries:\t%d (%s)\n", c.Entries, c.limit())
+	fmt.Fprintf(w, "Hits:\t%d\n", c.Hits)
+	fmt.Fprintf(w, "Misses:\t%d\n", c.Misses)
+	fmt.Fprintf(w, "Hit Rate:\t%.1f%%\n", c.hitRate())
+}
+
+// printCacheDump prints the cached responses in entries as a table sorted
+// by name and type.
+func printCacheDump(out io.Writer, entries []persistedEntry) {
+	if len(entries) == 0 {
+		fmt.Fprintln(out, "No cached responses.")
+
+		return
+	}
+
+	slices.SortFunc(entries, func(a, b persistedEntry) int {
+		return cmp.Or(cmp.Compare(a.Name, b.Name), cmp.Compare(a.Type, b.Type))
+	})
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	defer w.Flush()
+
+	now := time.Now()
+
+	fmt.Fprintln(w, "NAME\tTYPE\tRCODE\tTTL\tHITS\tCACHED\tANSWER")
+	for _, e := range entries {
+		msg := new(dns.Msg)
+		if err := msg.Unpack(e.Msg); err != nil {
+			continue
+		}
+
+		ttl := "stale"
+		if now.Before(e.Expires) {
+			ttl = e.Expires.Sub(now).Round(time.Second).String()
+		}
+
+		var answers []string
+		for _, rr := range msg.Answer {
+			answers = append(answers, strings.TrimPrefix(rr.String(), rr.Header().String()))
+		}
+
+		answer := "-"
+		if len(answers) > 0 {
+			answer = strings.Join(answers, ", ")
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s ago\t%s\n", e.Name, dns.Type(e.Type), dns.RcodeToString[msg.Rcode], ttl, e.Hits, now.Sub(e.Stored).Round(time.Second), answer)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/miekg/dns"
+)
+
+// cachePersist enables persisting the cache across restarts.
+var cachePersist atomic.Bool
+
+// persistedEntry is a cache entry written to disk.
+type persistedEntry struct {
+	Name    string    `json:"name"`
+	Type    uint16    `json:"type"`
+	Class   uint16    `json:"class"`
+	Routing string    `json:"routing,omitempty"`
+	Msg     []byte    `json:"msg"`
+	Stored  time.Time `json:"stored"`
+	Expires time.Time `json:"expires"`
+	Hits    int64     `json:"hits,omitempty"`
+}
+
+// saveCache writes all entries of the cache that may still be served to
+// path, starting with the least recently used one.
+func saveCache(path string) error {
+	if !cachePersist.Load() || !cacheEnabled.Load() {
+		return nil
+	}
+
+	blob, err := json.Marshal(snapshotCache())
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, blob, 0600)
+}
+
+// snapshotCache returns all entries of the cache that may still be served,
+// starting with the least recently used one.
+func snapshotCache() []persistedEntry {
+	now := time.Now()
+
+	cacheLock.Lock()
+	defer cacheLock.Unlock()
+
+	var entries []persistedEntry
+	for elem := cacheLRU.Back(); elem != nil; elem = elem.Prev() {
+		entry := elem.Value.(*cacheEntry)
+		if now.After(entry.staleUntil()) {
+			continue
+		}
+
+		msg, err := entry.msg.Pack()
+		if err != nil {
+			continue
+		}
+
+		entries = append(entries, persistedEntry{
+			Name:    entry.key.name,
+			Type:    entry.key.qtype,
+			Class:   entry.key.class,
+			Routing: entry.key.routing,
+			Msg:     msg,
+			Stored:  entry.stored,
+			Expires: entry.expires,
+			Hits:    entry.hits.Load(),
+		})
+	}
+
+	return entries
+}
+
+// loadCache adds the entries persisted at path to the cache. Entries that
+// can no longer be served are skipped.
+func loadCache(path string) {
+	if !cachePersist.Load() || !cacheEnabled.Load() {
+		return
+	}
+
+	blob, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			hclog.L().Warn("failed to read cache file", "error", err)
+		}
+
+		return
+	}
+
+	var entries []persistedEntry
+	if err := json.Unmarshal(blob, &entries); err != nil {
+		hclog.L().Warn("failed to parse cache file", "error", err)
+
+		return
+	}
+
+	now := time.Now()
+
+	cacheLock.Lock()
+	defer cacheLock.Unlock()
+
+	loaded := 0
+	for _, e := range entries {
+		msg := new(dns.Msg)
+		if err := msg.Unpack(e.Msg); err != nil {
+			continue
+		}
+
+		entry := &cacheEntry{
+			msg:     msg,
+			stored:  e.Stored,
+			expires: e.Expires,
+		}
+		entry.hits.Store(e.Hits)
+		if now.After(entry.staleUntil()) {
+			continue
+		}
+
+		key := cacheKey{
+			name:    e.Name,
+			qtype:   e.Type,
+			class:   e.Class,
+			routing: e.Routing,
+		}
+		if _, ok := cacheEntries[key]; !ok {
+			insertCache(key, entry)
+			loaded++
+		}
+	}
+
+	hclog.L().Info("loaded persisted cache", "entries", loaded)
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+)
+
+// cacheFlushFile is the name of the file in the plugin data directory that
+// requests a cache flush.
+const cacheFlushFile = "flush-cache"
+
+// flushCacheCommand returns the command that flushes the cache of the
+// plugin. The running plugin picks the request up within a few seconds.
+func flushCacheCommand() *cobra.Command {
+	var flags installFlags
+
+	cmd := &cobra.Command{
+		Use:   "flush-cache",
+		Short: "Flush the DNS cache of the running plugin",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			dir := flags.dataDirectory()
+
+			if err := os.Remove(filepath.Join(dir, "cache.json")); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+
+			return writeControlRequest(dir, cacheFlushFile)
+		},
+	}
+
+	flags.register(cmd)
+
+	return cmd
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/miekg/dns"
+	"github.com/safing/portmaster/plugin/shared/proto"
+	"golang.org/x/net/publicsuffix"
+)
+
+const (
+	// defaultCaptivePortalProbe is the URL used to detect captive portals
+	// by default. It answers with "success" unless a portal intercepts
+	// the request.
+	defaultCaptivePortalProbe = "http://detectportal.firefox.com/success.txt"
+
+	// captiveCheckInterval defines how often the probe URL is requested
+	// while a captive portal is active, and how often failing queries may
+	// trigger a check at most.
+	captiveCheckInterval = 10 * time.Second
+
+	// captiveProbeTimeout limits the time to request the probe URL.
+	captiveProbeTimeout = 5 * time.Second
+)
+
+var (
+	// captiveDetection enables detecting captive portals when none of the
+	// servers can be reached.
+	captiveDetection atomic.Bool
+
+	// captiveActive is set while a captive portal blocks access to the
+	// servers.
+	captiveActive atomic.Bool
+
+	captiveLock     sync.RWMutex
+	captiveProbeURL *url.URL
+
+	// portalDomains are the domains of the active captive portal, which
+	// are left to the Portmaster's resolvers.
+	portalDomains map[string]struct{}
+
+	// captiveCheck is used to trigger a check for a captive portal.
+	captiveCheck = make(chan struct{}, 1)
+)
+
+// parseCaptivePortalProbe parses the URL used to detect captive portals.
+func parseCaptivePortalProbe(value string) (*url.URL, error) {
+	u, err := url.Parse(strings.TrimSpace(value))
+	if err != nil {
+		return nil, err
+	}
+
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid probe URL %q", value)
+	}
+
+	return u, nil
+}
+
+func setCaptivePortalProbe(value string) {
+	u, err := parseCaptivePortalProbe(value)
+	if err != nil {
+		hclog.L().Error("invalid captive portal probe URL, using the default", "error", err)
+
+		u, _ = url.Parse(defaultCaptivePortalProbe)
+	}
+
+	captiveLock.Lock()
+	captiveProbeURL = u
+	captiveLock.Unlock()
+}
+
+func setCaptivePortalDetection(enabled bool) {
+	captiveDetection.Store(enabled)
+
+	if !enabled {
+		leaveCaptivePortal()
+	}
+}
+
+// checkCaptivePortal triggers a check for a captive portal.
+func checkCaptivePortal() {
+	if !captiveDetection.Load() {
+		return
+	}
+
+	select {
+	case captiveCheck <- struct{}{}:
+	default:
+	}
+}
+
+// captivePortalName reports whether name must be resolved by the
+// Portmaster's resolvers, the ones of the local network, because it
+// belongs to the active captive portal. The host of the probe URL is
+// always left to the Portmaster so the probe never depends on the servers.
+func captivePortalName(name string) bool {
+	if !captiveDetection.Load() {
+		return false
+	}
+
+	name = dns.CanonicalName(name)
+
+	captiveLock.RLock()
+	defer captiveLock.RUnlock()
+
+	if captiveProbeURL != nil && dns.CanonicalName(captiveProbeURL.Hostname()) == name {
+		return true
+	}
+
+	return captiveActive.Load() && matchDomain(portalDomains, name)
+}
+
+// watchCaptivePortal checks for a captive portal whenever queries fail
+// because no server can be reached, and keeps checking while a portal is
+// active to notice when it has been passed.
+func watchCaptivePortal(ctx context.Context) {
+	ticker := time.NewTicker(captiveCheckInterval)
+	defer ticker.Stop()
+
+	var lastCheck time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-captiveCheck:
+			if time.Since(lastCheck) < captiveCheckInterval {
+				continue
+			}
+		case <-ticker.C:
+			if !captiveActive.Load() {
+				continue
+			}
+		}
+
+		if !captiveDetection.Load() {
+			continue
+		}
+
+		lastCheck = time.Now()
+
+		captiveLock.RLock()
+		probe := captiveProbeURL
+		captiveLock.RUnlock()
+
+		if probe == nil {
+			continue
+		}
+
+		detected, location, err := probeCaptivePortal(ctx, probe.String())
+		if err != nil {
+			// without network access there's no portal to log in to
+			hclog.L().Debug("failed to check for a captive portal", "error", err)
+
+			continue
+		}
+
+		if detected {
+			enterCaptivePortal(probe, location)
+		} else {
+			leaveCaptivePortal()
+		}
+	}
+}
+
+// probeCaptivePortal requests probe and reports whether the response has
+// been intercepted by a captive portal. The probe must answer with status
+// 204 or a body starting with "success". The URL a portal redirected to is
+// returned as well, if any. The request is never sent through the
+// configured proxy.
+func probeCaptivePortal(ctx context.Context, probe string) (bool, string, error) {
+	client := &http.Client{
+		Timeout: captiveProbeTimeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				resolved, err := resolveUpstreamAddr(ctx, addr)
+				if err != nil {
+					return nil, err
+				}
+
+				var dialer net.Dialer
+
+				return dialer.DialContext(ctx, network, resolved)
+			},
+			DisableKeepAlives: true,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, probe, nil)
+	if err != nil {
+		return false, "", err
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return false, "", err
+	}
+	defer res.Body.Close()
+
+	switch {
+	case res.StatusCode == http.StatusNoContent:
+		return false, "", nil
+
+	case res.StatusCode == http.StatusOK:
+		body, err := io.ReadAll(io.LimitReader(res.Body, 1024))
+		if err != nil {
+			return false, "", err
+		}
+
+		return !strings.HasPrefix(strings.TrimSpace(string(body)), "success"), "", nil
+
+	default:
+		return true, res.Header.Get("Location"), nil
+	}
+}
+
+// enterCaptivePortal leaves the domains of the captive portal, the host of
+// probe and of the location the portal redirected to, to the Portmaster's
+// resolvers until the portal has been passed.
+func enterCaptivePortal(probe *url.URL, location string) {
+	domains := map[string]struct{}{
+		dns.CanonicalName(probe.Hostname()): {},
+	}
+
+	var portal string
+	if u, err := url.Parse(location); err == nil && u.Hostname() != "" && net.ParseIP(u.Hostname()) == nil {
+		portal = u.Hostname()
+		domains[dns.CanonicalName(portal)] = struct{}{}
+
+		// the login page usually loads resources from other hosts of
+		// the portal's domain
+		if domain, err := publicsuffix.EffectiveTLDPlusOne(portal); err == nil {
+			domains[dns.CanonicalName(domain)] = struct{}{}
+		}
+	}
+
+	captiveLock.Lock()
+	portalDomains = domains
+	captiveLock.Unlock()
+
+	if captiveActive.Swap(true) {
+		return
+	}
+
+	hclog.L().Warn("captive portal detected", "portal", portal)
+
+	message := "The network requires you to log in before the DNSCrypt servers can be reached. The names of the login page are resolved by Portmaster's resolvers"
+	if portal != "" {
+		message += fmt.Sprintf(", open http://%s to log in", portal)
+	}
+
+	notify(&proto.Notification{
+		EventId: "dnscrypt-captive-portal",
+		Title:   "DNSCrypt: Captive portal detected",
+		Message: message + ". All other queries keep using the encrypted servers.",
+	})
+}
+
+// leaveCaptivePortal returns to resolving all names using the encrypted
+// servers.
+func leaveCaptivePortal() {
+	if !captiveActive.Swap(false) {
+		return
+	}
+
+	captiveLock.Lock()
+	portalDomains = nil
+	captiveLock.Unlock()
+
+	hclog.L().Info("captive portal passed")
+
+	notify(&proto.Notification{
+		EventId: "dnscrypt-captive-portal",
+		Title:   "DNSCrypt: Captive portal passed",
+		Message: "The network no longer requires you to log in. All queries are resolved using the encrypted servers again.",
+	})
+}
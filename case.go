@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"strings"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+)
+
+// errCaseMismatch is returned if the question of a response does not
+// match the randomized case of the query.
+var errCaseMismatch = errors.New("response question does not match the query case")
+
+// randomizeCase enables DNS 0x20 query name randomization.
+var randomizeCase atomic.Bool
+
+// randomCase returns name with the case of each letter chosen randomly.
+func randomCase(name string) string {
+	b := []byte(name)
+	for i, c := range b {
+		if rand.Intn(2) == 0 {
+			continue
+		}
+
+		switch {
+		case c >= 'a' && c <= 'z':
+			b[i] = c - 'a' + 'A'
+		case c >= 'A' && c <= 'Z':
+			b[i] = c - 'A' + 'a'
+		}
+	}
+
+	return string(b)
+}
+
+// verifyCase checks that res echoes the question of req using exactly the
+// same case and restores the original case of name in all records owned
+// by it.
+func verifyCase(req, res *dns.Msg, name string) error {
+	if len(res.Question) != 1 || res.Question[0].Name != req.Question[0].Name {
+		return errCaseMismatch
+	}
+
+	res.Question[0].Name = name
+
+	for _, rr := range res.Answer {
+		if strings.EqualFold(rr.Header().Name, name) {
+			rr.Header().Name = name
+		}
+	}
+
+	return nil
+}
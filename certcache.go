@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/ameshkov/dnscrypt/v2"
+	"github.com/ameshkov/dnsstamps"
+	"github.com/hashicorp/go-hclog"
+)
+
+// cachedCert is a DNSCrypt certificate persisted to disk so the plugin
+// can answer queries right after a restart.
+type cachedCert struct {
+	Cert  []byte `json:"cert"`
+	Relay string `json:"relay,omitempty"`
+}
+
+var (
+	certCacheLock sync.Mutex
+	certCacheFile string
+)
+
+// setCertCacheFile configures the file used to persist DNSCrypt
+// certificates. Certificates are not persisted if path is empty.
+func setCertCacheFile(path string) {
+	certCacheLock.Lock()
+	defer certCacheLock.Unlock()
+
+	certCacheFile = path
+}
+
+// readCertCache must be called with certCacheLock held.
+func readCertCache() map[string]cachedCert {
+	certs := make(map[string]cachedCert)
+
+	blob, err := os.ReadFile(certCacheFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			hclog.L().Warn("failed to read certificate cache", "error", err)
+		}
+
+		return certs
+	}
+
+	if err := json.Unmarshal(blob, &certs); err != nil {
+		hclog.L().Warn("failed to parse certificate cache", "error", err)
+	}
+
+	return certs
+}
+
+// storeCachedCert persists cert as the current certificate of the server
+// described by stamp.
+func storeCachedCert(stamp dnsstamps.ServerStamp, cert *dnscrypt.Cert, relay *relay) {
+	certCacheLock.Lock()
+	defer certCacheLock.Unlock()
+
+	if certCacheFile == "" {
+		return
+	}
+
+	blob, err := cert.Serialize()
+	if err != nil {
+		hclog.L().Error("failed to serialize certificate", "error", err)
+
+		return
+	}
+
+	entry := cachedCert{
+		Cert: blob,
+	}
+	if relay != nil {
+		entry.Relay = relay.addr
+	}
+
+	certs := readCertCache()
+	certs[stamp.String()] = entry
+
+	blob, err = json.Marshal(certs)
+	if err != nil {
+		hclog.L().Error("failed to marshal certificate cache", "error", err)
+
+		return
+	}
+
+	if err := os.MkdirAll(filepath.Dir(certCacheFile), 0755); err != nil {
+		hclog.L().Error("failed to create cache directory", "error", err)
+
+		return
+	}
+
+	if err := os.WriteFile(certCacheFile, blob, 0600); err != nil {
+		hclog.L().Error("failed to write certificate cache", "error", err)
+	}
+}
+
+// loadCachedCert returns the persisted certificate of the server described
+// by stamp together with the address of the relay it has been fetched
+// through. Certificates that are expired, expire soon or do not carry a
+// valid signature are ignored.
+func loadCachedCert(stamp dnsstamps.ServerStamp) (*dnscrypt.Cert, string, bool) {
+	certCacheLock.Lock()
+	defer certCacheLock.Unlock()
+
+	if certCacheFile == "" {
+		return nil, "", false
+	}
+
+	entry, ok := readCertCache()[stamp.String()]
+	if !ok {
+		return nil, "", false
+	}
+
+	cert := new(dnscrypt.Cert)
+	if err := cert.Deserialize(entry.Cert); err != nil {
+		return nil, "", false
+	}
+
+	if !cert.VerifyDate() || !cert.VerifySignature(stamp.ServerPk) || certExpiresWithin(cert, certRefreshMargin) {
+		return nil, "", false
+	}
+
+	return cert, entry.Relay, true
+}
+
+// transportFromCache creates a DNSCrypt transport using a persisted
+// certificate and revalidates the certificate in the background. It returns
+// nil if no usable certificate has been persisted or if it has been fetched
+// through a relay that is not configured for the server anymore.
+func transportFromCache(name string, stamp dnsstamps.ServerStamp, relays []*relay) *dnscryptTransport {
+	cert, relayAddr, ok := loadCachedCert(stamp)
+	if !ok {
+		return nil
+	}
+
+	var r *relay
+	if relayAddr != "" || len(relays) > 0 {
+		for _, candidate := range relays {
+			if candidate.addr == relayAddr {
+				r = candidate
+
+				break
+			}
+		}
+
+		if r == nil {
+			return nil
+		}
+	}
+
+	info, err := newResolverInfo(stamp, cert)
+	if err != nil {
+		return nil
+	}
+
+	t := newDNSCryptTransport(name, stamp, r, info)
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+		defer cancel()
+
+		if err := t.refresh(ctx); err != nil {
+			hclog.L().Warn("failed to revalidate cached DNSCrypt certificate", "server", name, "error", err)
+		}
+	}()
+
+	return t
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// installFlags holds the flags used by commands that operate on the
+// Portmaster installation the plugin is installed in.
+type installFlags struct {
+	installDir string
+	pluginName string
+}
+
+func (f *installFlags) register(cmd *cobra.Command) {
+	flags := cmd.Flags()
+	flags.StringVarP(&f.installDir, "data", "d", "/opt/safing/portmaster", "Path to the Portmaster installation directory")
+	flags.StringVar(&f.pluginName, "name", "portmaster-plugin-dnscrypt", "Name of the plugin in plugins.json")
+}
+
+// dataDirectory returns the data directory of the plugin.
+func (f *installFlags) dataDirectory() string {
+	return filepath.Join(f.installDir, "plugins", "data", f.pluginName)
+}
+
+// configFile returns the path of the Portmaster configuration file.
+func (f *installFlags) configFile() string {
+	return filepath.Join(f.installDir, "config.json")
+}
+
+// applyConfig applies the configuration of the plugin, read from the
+// Portmaster configuration file and environment variables, so commands use
+// the same servers as the running plugin. The configured resolver lists are
+// downloaded if servers are selected by name.
+func (f *installFlags) applyConfig(ctx context.Context) error {
+	config, err := readPortmasterConfig(f.configFile())
+	if err != nil {
+		return err
+	}
+
+	values := effectiveValues(pluginSection(config, f.pluginName, false))
+	for _, opt := range configOptions {
+		if val, ok := envOverride(opt); ok {
+			values[opt.Key] = val
+		}
+
+		opt.apply(values[opt.Key])
+	}
+
+	configLock.Lock()
+	names := configuredNames
+	configLock.Unlock()
+
+	if len(names) == 0 {
+		return nil
+	}
+
+	entries, err := fetchSources(ctx, values["sources"].StringArray)
+	if err != nil {
+		return err
+	}
+
+	sourcesLock.Lock()
+	sourceEntries = entries
+	sourcesLock.Unlock()
+
+	return nil
+}
+
+// selectServers returns the servers described by values. Each value is
+// either a server stamp or URL, or the name of a configured server, in
+// which case the configuration is applied to look it up.
+func (f *installFlags) selectServers(ctx context.Context, values []string) ([]serverConfig, error) {
+	var (
+		configs    []serverConfig
+		configured []serverConfig
+		applied    bool
+	)
+	for _, value := range values {
+		if strings.Contains(value, "://") {
+			configs = append(configs, serverConfig{
+				name:  stampName(value),
+				stamp: value,
+			})
+
+			continue
+		}
+
+		if !applied {
+			if err := f.applyConfig(ctx); err != nil {
+				return nil, err
+			}
+
+			configured = configuredServers()
+			applied = true
+		}
+
+		idx := slices.IndexFunc(configured, func(cfg serverConfig) bool {
+			return cfg.name == value
+		})
+		if idx < 0 {
+			return nil, fmt.Errorf("unknown server %q, expected a stamp or the name of a configured server", value)
+		}
+
+		configs = append(configs, configured[idx])
+	}
+
+	return configs, nil
+}
+
+// completeServerNames completes the names of the configured servers. Only
+// the configuration file is read so completion does not need to download
+// the resolver lists.
+func (f *installFlags) completeServerNames(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	config, err := readPortmasterConfig(f.configFile())
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+
+	values := effectiveValues(pluginSection(config, f.pluginName, false))
+	for _, opt := range configOptions {
+		if val, ok := envOverride(opt); ok {
+			values[opt.Key] = val
+		}
+	}
+
+	var names []string
+	for _, entry := range values["serverStamps"].StringArray {
+		if cfg, ok := parseStampEntry(entry); ok {
+			names = append(names, cfg.name)
+		}
+	}
+	names = append(names, values["serverNames"].StringArray...)
+
+	var matches []string
+	for _, name := range names {
+		if strings.HasPrefix(name, toComplete) && !slices.Contains(matches, name) && !slices.Contains(args, name) {
+			matches = append(matches, name)
+		}
+	}
+
+	return matches, cobra.ShellCompDirectiveNoFileComp
+}
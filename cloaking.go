@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/miekg/dns"
+	"github.com/safing/portmaster/plugin/shared/proto"
+)
+
+const (
+	// cloakingServer is logged as the server of cloaked queries.
+	cloakingServer = "cloaking"
+
+	// cloakTTL is the TTL in seconds of the records of cloaked names.
+	cloakTTL = 600
+)
+
+// cloakTarget holds the records returned for a cloaked name. Either
+// addresses or cname is set. server is logged as the server of the
+// answers, which have a TTL of ttl seconds.
+type cloakTarget struct {
+	addresses []net.IP
+	cname     string
+	server    string
+	ttl       uint32
+}
+
+var (
+	cloakingLock sync.RWMutex
+
+	// cloakingRules maps names, or "*." followed by a domain for rules
+	// matching its subdomains, to their targets.
+	cloakingRules map[string]*cloakTarget
+
+	// hostsEntries holds the entries of the hosts file in the same way.
+	hostsEntries map[string]*cloakTarget
+)
+
+// parseCloakingRule parses a "<name> <address|name> [<address>...]" entry
+// of the cloakingRules option.
+func parseCloakingRule(value string) (string, *cloakTarget, error) {
+	fields := strings.Fields(value)
+	if len(fields) < 2 {
+		return "", nil, errors.New("expected \"<name> <address|name> [<address>...]\"")
+	}
+
+	name := fields[0]
+	if _, ok := dns.IsDomainName(strings.TrimPrefix(name, "*.")); !ok {
+		return "", nil, fmt.Errorf("invalid name %q", name)
+	}
+
+	target := &cloakTarget{
+		server: cloakingServer,
+		ttl:    cloakTTL,
+	}
+	for _, field := range fields[1:] {
+		if ip := net.ParseIP(field); ip != nil {
+			target.addresses = append(target.addresses, ip)
+
+			continue
+		}
+
+		if _, ok := dns.IsDomainName(field); !ok {
+			return "", nil, fmt.Errorf("invalid address or name %q", field)
+		}
+
+		if len(fields) > 2 {
+			return "", nil, fmt.Errorf("the name %q cannot be combined with other targets", field)
+		}
+
+		target.cname = dns.Fqdn(field)
+	}
+
+	return dns.CanonicalName(name), target, nil
+}
+
+// setCloakingRules configures the names answered with fixed records.
+func setCloakingRules(values []string) {
+	m := make(map[string]*cloakTarget)
+
+	for _, value := range values {
+		name, target, err := parseCloakingRule(value)
+		if err != nil {
+			hclog.L().Error("ignoring invalid cloaking rule", "rule", value, "error", err)
+
+			continue
+		}
+
+		if existing, ok := m[name]; ok && existing.cname == "" && target.cname == "" {
+			existing.addresses = append(existing.addresses, target.addresses...)
+
+			continue
+		}
+
+		m[name] = target
+	}
+
+	cloakingLock.Lock()
+	cloakingRules = m
+	cloakingLock.Unlock()
+}
+
+// cloakLookup returns the target of the cloaking rule or, if there is
+// none, the hosts file entry matching name.
+func cloakLookup(name string) (*cloakTarget, bool) {
+	name = dns.CanonicalName(name)
+
+	cloakingLock.RLock()
+	defer cloakingLock.RUnlock()
+
+	if target, ok := matchTarget(cloakingRules, name); ok {
+		return target, true
+	}
+
+	return matchTarget(hostsEntries, name)
+}
+
+// matchTarget returns the target of the rule in rules matching the
+// canonical name. Rules for the name itself take precedence over wildcard
+// rules, and wildcard rules for longer domains over those for shorter
+// ones.
+func matchTarget(rules map[string]*cloakTarget, name string) (*cloakTarget, bool) {
+	if len(rules) == 0 {
+		return nil, false
+	}
+
+	if target, ok := rules[name]; ok {
+		return target, true
+	}
+
+	for off, end := dns.NextLabel(name, 0); !end; off, end = dns.NextLabel(name, off) {
+		if target, ok := rules["*."+name[off:]]; ok {
+			return target, true
+		}
+	}
+
+	return nil, false
+}
+
+// cloak answers question using target. Addresses are only returned for A
+// and AAAA queries of the matching family. Names are returned as CNAME
+// record together with the answer for the name.
+func cloak(ctx context.Context, question *proto.DNSQuestion, conn *proto.Connection, target *cloakTarget) (*proto.DNSResponse, queryOutcome, error) {
+	hdr := dns.RR_Header{
+		Name:   question.GetName(),
+		Class:  dns.ClassINET,
+		Ttl:    target.ttl,
+		Rrtype: uint16(question.GetType()),
+	}
+	outcome := queryOutcome{server: target.server}
+
+	if target.cname == "" {
+		var records []dns.RR
+		for _, ip := range target.addresses {
+			switch ip4 := ip.To4(); {
+			case hdr.Rrtype == dns.TypeA && ip4 != nil:
+				records = append(records, &dns.A{Hdr: hdr, A: ip4})
+			case hdr.Rrtype == dns.TypeAAAA && ip4 == nil:
+				records = append(records, &dns.AAAA{Hdr: hdr, AAAA: ip})
+			}
+		}
+
+		return &proto.DNSResponse{
+			Rcode: dns.RcodeSuccess,
+			Rrs:   convertRRs(records),
+		}, outcome, nil
+	}
+
+	hdr.Rrtype = dns.TypeCNAME
+	cname := convertRRs([]dns.RR{&dns.CNAME{Hdr: hdr, Target: target.cname}})
+
+	if question.GetType() == uint32(dns.TypeCNAME) {
+		return &proto.DNSResponse{
+			Rcode: dns.RcodeSuccess,
+			Rrs:   cname,
+		}, outcome, nil
+	}
+
+	// the target is not cloaked again so rules cannot loop
+	res, targetOutcome, err := lookup(ctx, &proto.DNSQuestion{
+		Name:  target.cname,
+		Type:  question.GetType(),
+		Class: question.GetClass(),
+	}, conn)
+	if err != nil {
+		return nil, targetOutcome, err
+	}
+
+	outcome.cache = targetOutcome.cache
+
+	if res == nil {
+		return &proto.DNSResponse{
+			Rcode: dns.RcodeSuccess,
+			Rrs:   cname,
+		}, outcome, nil
+	}
+
+	return &proto.DNSResponse{
+		Rcode: res.GetRcode(),
+		Rrs:   append(cname, res.GetRrs()...),
+	}, outcome, nil
+}
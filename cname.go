@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/miekg/dns"
+)
+
+// maxCNAMEDepth limits the number of CNAMEs followed when flattening.
+const maxCNAMEDepth = 8
+
+// flattenCNAME enables CNAME chain flattening.
+var flattenCNAME atomic.Bool
+
+// flattenCNAMEs replaces a CNAME chain in the answer of res with the
+// address records it ends in, owned by the queried name and using the
+// lowest TTL of the chain. CNAMEs the server did not resolve are followed
+// by querying srv. res is left unchanged if the chain does not end in an
+// address record.
+func flattenCNAMEs(ctx context.Context, srv *server, res *dns.Msg, question dns.Question) {
+	if question.Qtype != dns.TypeA && question.Qtype != dns.TypeAAAA {
+		return
+	}
+
+	if res.Rcode != dns.RcodeSuccess {
+		return
+	}
+
+	records := res.Answer
+	name := question.Name
+	ttl := ^uint32(0)
+
+	for depth := 0; depth <= maxCNAMEDepth; depth++ {
+		var (
+			target    string
+			addresses []dns.RR
+		)
+
+		for _, rr := range records {
+			if !strings.EqualFold(rr.Header().Name, name) {
+				continue
+			}
+
+			switch v := rr.(type) {
+			case *dns.CNAME:
+				target = v.Target
+				ttl = min(ttl, v.Hdr.Ttl)
+			default:
+				if rr.Header().Rrtype == question.Qtype {
+					addresses = append(addresses, rr)
+				}
+			}
+		}
+
+		if len(addresses) > 0 {
+			if depth == 0 {
+				// no CNAME involved
+				return
+			}
+
+			res.Answer = make([]dns.RR, 0, len(addresses))
+			for _, rr := range addresses {
+				rr = dns.Copy(rr)
+				rr.Header().Name = question.Name
+				rr.Header().Ttl = min(ttl, rr.Header().Ttl)
+
+				res.Answer = append(res.Answer, rr)
+			}
+
+			return
+		}
+
+		if target == "" {
+			return
+		}
+
+		name = target
+
+		if !hasRecordsFor(records, name) {
+			followed, err := srv.exchange(ctx, newRequest(dns.Question{
+				Name:   name,
+				Qtype:  question.Qtype,
+				Qclass: question.Qclass,
+			}))
+			if err != nil {
+				hclog.L().Warn("failed to follow CNAME", "server", srv.name, "target", name, "error", err)
+
+				return
+			}
+
+			records = append(records, followed.Answer...)
+		}
+	}
+}
+
+// hasRecordsFor reports whether records contains a record owned by name.
+func hasRecordsFor(records []dns.RR, name string) bool {
+	for _, rr := range records {
+		if strings.EqualFold(rr.Header().Name, name) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,1168 @@
+package main
+
+import (
+	"context"
+	"math"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/miekg/dns"
+	"github.com/safing/portmaster/plugin/framework"
+	"github.com/safing/portmaster/plugin/shared/proto"
+	protobuf "google.golang.org/protobuf/proto"
+)
+
+// configOption is a configuration option registered by the plugin
+// together with the function that applies the value of the option.
+type configOption struct {
+	*proto.Option
+
+	apply func(*proto.Value)
+
+	// validate, if set, checks a new value before it is applied.
+	validate func(*proto.Value) error
+}
+
+var (
+	valuesLock   sync.Mutex
+	configValues = make(map[string]*proto.Value)
+
+	// configLoaded is set as soon as the initial configuration has been
+	// applied. Until then, servers are not dialed on each change.
+	configLoaded atomic.Bool
+)
+
+var configOptions = []configOption{
+	{
+		Option: &proto.Option{
+			Name:        "Enabled",
+			Description: "Resolve queries using the configured servers. If disabled, all queries are passed on to the resolvers configured in the Portmaster.",
+			Key:         "enabled",
+			OptionType:  proto.OptionType_OPTION_TYPE_BOOL,
+			Default: &proto.Value{
+				Bool: true,
+			},
+		},
+		apply: func(v *proto.Value) {
+			pluginEnabled.Store(v.Bool)
+		},
+	},
+	{
+		Option: &proto.Option{
+			Name:        "DNSCrypt Servers",
+			Description: "Stamps of the DNSCrypt, DNS-over-HTTPS, DNS-over-TLS or DNS-over-QUIC servers to use, one per entry in the format \"[<name>] <stamp>\". DNS-over-TLS and DNS-over-QUIC servers may also be specified as \"tls://host[:port][?spki=<pin>]\" or \"quic://host[:port][?spki=<pin>]\". The optional name can be used to refer to the server in other settings instead of its provider name. Each entry is validated on its own so an invalid entry does not affect the others. If a server fails to answer a query the next one is tried.",
+			Key:         "serverStamps",
+			OptionType:  proto.OptionType_OPTION_TYPE_STRING_ARRAY,
+			Default: &proto.Value{
+				StringArray: []string{},
+			},
+		},
+		apply: func(v *proto.Value) {
+			setStampList(v.StringArray)
+		},
+		validate: validateEach(validateStampEntry),
+	},
+	{
+		Option: &proto.Option{
+			Name:        "DNSCrypt Server Names",
+			Description: "Names of DNSCrypt servers from the downloaded resolver lists that should be used in addition to the configured server stamps.",
+			Key:         "serverNames",
+			OptionType:  proto.OptionType_OPTION_TYPE_STRING_ARRAY,
+			Default: &proto.Value{
+				StringArray: []string{},
+			},
+		},
+		apply: func(v *proto.Value) {
+			setServerNames(v.StringArray)
+		},
+	},
+	{
+		Option: &proto.Option{
+			Name:        "Resolver Lists",
+			Description: "Resolver lists to download in the format \"<url> <minisign-key>\". The signature of each list is downloaded from \"<url>.minisig\" and verified using the minisign key.",
+			Key:         "sources",
+			OptionType:  proto.OptionType_OPTION_TYPE_STRING_ARRAY,
+			Default: &proto.Value{
+				StringArray: []string{defaultSource, defaultRelaySource},
+			},
+		},
+		apply: func(v *proto.Value) {
+			setSources(v.StringArray)
+		},
+		validate: validateEach(validateSource),
+	},
+	{
+		Option: &proto.Option{
+			Name:        "Require DNSSEC",
+			Description: "Only use servers from the resolver lists that perform DNSSEC validation.",
+			Key:         "requireDNSSEC",
+			OptionType:  proto.OptionType_OPTION_TYPE_BOOL,
+			Default: &proto.Value{
+				Bool: false,
+			},
+		},
+		apply: func(v *proto.Value) {
+			updateFilter(func(f *serverFilter) { f.requireDNSSEC = v.Bool })
+		},
+	},
+	{
+		Option: &proto.Option{
+			Name:        "Require No-Log",
+			Description: "Only use servers from the resolver lists that claim to not log queries.",
+			Key:         "requireNoLog",
+			OptionType:  proto.OptionType_OPTION_TYPE_BOOL,
+			Default: &proto.Value{
+				Bool: false,
+			},
+		},
+		apply: func(v *proto.Value) {
+			updateFilter(func(f *serverFilter) { f.requireNoLog = v.Bool })
+		},
+	},
+	{
+		Option: &proto.Option{
+			Name:        "Require No-Filter",
+			Description: "Only use servers from the resolver lists that do not intentionally block domains.",
+			Key:         "requireNoFilter",
+			OptionType:  proto.OptionType_OPTION_TYPE_BOOL,
+			Default: &proto.Value{
+				Bool: false,
+			},
+		},
+		apply: func(v *proto.Value) {
+			updateFilter(func(f *serverFilter) { f.requireNoFilter = v.Bool })
+		},
+	},
+	{
+		Option: &proto.Option{
+			Name:        "Use IPv4 Servers",
+			Description: "Use servers that are reachable using IPv4. Applies to the servers from the resolver lists, to servers configured by stamp and to the addresses hostnames of servers resolve to.",
+			Key:         "ipv4Servers",
+			OptionType:  proto.OptionType_OPTION_TYPE_BOOL,
+			Default: &proto.Value{
+				Bool: true,
+			},
+		},
+		apply: func(v *proto.Value) {
+			updateFilter(func(f *serverFilter) { f.ipv4 = v.Bool })
+		},
+	},
+	{
+		Option: &proto.Option{
+			Name:        "Use IPv6 Servers",
+			Description: "Use servers that are reachable using IPv6. Applies to the servers from the resolver lists, to servers configured by stamp and to the addresses hostnames of servers resolve to.",
+			Key:         "ipv6Servers",
+			OptionType:  proto.OptionType_OPTION_TYPE_BOOL,
+			Default: &proto.Value{
+				Bool: false,
+			},
+		},
+		apply: func(v *proto.Value) {
+			updateFilter(func(f *serverFilter) { f.ipv6 = v.Bool })
+		},
+	},
+	{
+		Option: &proto.Option{
+			Name:        "Relay Routes",
+			Description: "Anonymized DNSCrypt routes in the format \"<server> <relay> [<relay>...]\". Server is the name of a server from the resolver lists, the name or provider name of a configured stamp or \"*\" for all servers without a dedicated route. Relays are specified by name, stamp or as \"ip:port\".",
+			Key:         "relayRoutes",
+			OptionType:  proto.OptionType_OPTION_TYPE_STRING_ARRAY,
+			Default: &proto.Value{
+				StringArray: []string{},
+			},
+		},
+		apply: func(v *proto.Value) {
+			setRelayRoutes(v.StringArray)
+		},
+		validate: validateEach(validateMinFields(2, "<server> <relay> [<relay>...]")),
+	},
+	{
+		Option: &proto.Option{
+			Name:        "Bootstrap Resolvers",
+			Description: "Plain DNS servers in the format \"ip[:port]\" that are used to resolve the hostnames of DNS-over-HTTPS, DNS-over-TLS and DNS-over-QUIC servers. If empty, the resolver of the operating system is used.",
+			Key:         "bootstrapResolvers",
+			OptionType:  proto.OptionType_OPTION_TYPE_STRING_ARRAY,
+			Default: &proto.Value{
+				StringArray: []string{},
+			},
+		},
+		apply: func(v *proto.Value) {
+			setBootstrapResolvers(v.StringArray)
+		},
+		validate: validateEach(validateBootstrapResolver),
+	},
+	{
+		Option: &proto.Option{
+			Name:        "Load Balancing Strategy",
+			Description: "Defines which of the configured DNSCrypt servers is asked first. Possible values are \"first-available\", \"random\", \"power-of-two\", \"fastest\" and \"weighted\".",
+			Key:         "lbStrategy",
+			OptionType:  proto.OptionType_OPTION_TYPE_STRING,
+			Default: &proto.Value{
+				String_: string(strategyFirstAvailable),
+			},
+		},
+		apply: func(v *proto.Value) {
+			setStrategy(v.String_)
+		},
+		validate: validateOneOf(strategyFirstAvailable, strategyRandom, strategyPowerOfTwo, strategyFastest, strategyWeighted),
+	},
+	{
+		Option: &proto.Option{
+			Name:        "Latency Probe Interval",
+			Description: "Interval in minutes at which a lightweight test query is sent to each server to measure its response time. Set to 0 to disable probing.",
+			Key:         "probeInterval",
+			OptionType:  proto.OptionType_OPTION_TYPE_INT,
+			Default: &proto.Value{
+				Int: defaultProbeInterval,
+			},
+		},
+		apply: func(v *proto.Value) {
+			setProbeInterval(v.Int)
+		},
+		validate: validateRange(0, math.MaxInt32, false),
+	},
+	{
+		Option: &proto.Option{
+			Name:        "Forwarding Rules",
+			Description: "Forward queries for a domain and all its subdomains to specific servers. Each rule has the format \"<domain> <server> [<server>...]\" where server is the name of a server from the resolver lists, the name or provider name of a configured stamp or the address of a plain DNS server, e.g. \"10.0.0.53\" or \"10.0.0.53:5353\", for internal zones. Queries not matching any rule are sent to all configured servers.",
+			Key:         "forwardingRules",
+			OptionType:  proto.OptionType_OPTION_TYPE_STRING_ARRAY,
+			Default: &proto.Value{
+				StringArray: []string{},
+			},
+		},
+		apply: func(v *proto.Value) {
+			setForwardingRules(v.StringArray)
+		},
+		validate: validateEach(validateForwardingRule),
+	},
+	{
+		Option: &proto.Option{
+			Name:        "Application Rules",
+			Description: "Send queries of specific applications to specific servers. Each rule has the format \"<process> <server> [<server>...]\" where process is the name of the executable (e.g. firefox.exe) or its full path. Forwarding rules take precedence over application rules.",
+			Key:         "applicationRules",
+			OptionType:  proto.OptionType_OPTION_TYPE_STRING_ARRAY,
+			Default: &proto.Value{
+				StringArray: []string{},
+			},
+		},
+		apply: func(v *proto.Value) {
+			setApplicationRules(v.StringArray)
+		},
+		validate: validateEach(validateMinFields(2, "<process> <server> [<server>...]")),
+	},
+	{
+		Option: &proto.Option{
+			Name:        "Proxy",
+			Description: "SOCKS5 proxy all upstream traffic is sent through, in the format \"socks5://[user:password@]host:port\". DNSCrypt queries use TCP and DNS-over-QUIC servers are queried using DNS-over-TLS while a proxy is configured. Leave empty to connect directly.",
+			Key:         "proxy",
+			OptionType:  proto.OptionType_OPTION_TYPE_STRING,
+			Default: &proto.Value{
+				String_: "",
+			},
+		},
+		apply: func(v *proto.Value) {
+			setProxy(v.String_)
+		},
+		validate: validateProxy,
+	},
+	{
+		Option: &proto.Option{
+			Name:        "Route via Tor",
+			Description: "Send all upstream traffic through Tor using the SOCKS port of a local Tor daemon (127.0.0.1:9050 unless a different proxy is configured). Each server uses a separate Tor circuit so queries sent to different servers cannot be correlated.",
+			Key:         "torMode",
+			OptionType:  proto.OptionType_OPTION_TYPE_BOOL,
+			Default: &proto.Value{
+				Bool: false,
+			},
+		},
+		apply: func(v *proto.Value) {
+			setTorMode(v.Bool)
+		},
+	},
+	{
+		Option: &proto.Option{
+			Name:        "Server Weights",
+			Description: "Weights used by the \"weighted\" load balancing strategy in the format \"<server> <weight>\" where server is the name or provider name of a server. Servers without a weight have a weight of 1, servers with a weight of 0 are only used for failover.",
+			Key:         "serverWeights",
+			OptionType:  proto.OptionType_OPTION_TYPE_STRING_ARRAY,
+			Default: &proto.Value{
+				StringArray: []string{},
+			},
+		},
+		apply: func(v *proto.Value) {
+			setServerWeights(v.StringArray)
+		},
+		validate: validateEach(validateServerWeight),
+	},
+	{
+		Option: &proto.Option{
+			Name:        "Sticky Servers per Process",
+			Description: "Send all queries of a process to the same server for as long as the process is running and the server is available. This limits the number of servers that see the queries of an application.",
+			Key:         "stickyProcesses",
+			OptionType:  proto.OptionType_OPTION_TYPE_BOOL,
+			Default: &proto.Value{
+				Bool: false,
+			},
+		},
+		apply: func(v *proto.Value) {
+			setStickyProcesses(v.Bool)
+		},
+	},
+	{
+		Option: &proto.Option{
+			Name:        "Fallback Mode",
+			Description: "Defines what happens to queries that cannot be answered by any of the configured servers. \"portmaster\" lets Portmaster resolve them using its own resolvers while \"fail-closed\" answers them with SERVFAIL so no query is ever sent unencrypted.",
+			Key:         "fallbackMode",
+			OptionType:  proto.OptionType_OPTION_TYPE_STRING,
+			Default: &proto.Value{
+				String_: string(fallbackPortmaster),
+			},
+		},
+		apply: func(v *proto.Value) {
+			setFallbackMode(v.String_)
+		},
+		validate: validateOneOf(fallbackPortmaster, fallbackFailClosed),
+	},
+	{
+		Option: &proto.Option{
+			Name:        "Captive Portal Detection",
+			Description: "Check for a captive portal, like the login page of a hotel or airport network, if none of the servers can be reached. While a portal is detected its names are resolved by Portmaster's resolvers, i.e. the ones of the network, so you can log in, even in fail-closed mode. Detection stops once the portal has been passed.",
+			Key:         "captivePortalDetection",
+			OptionType:  proto.OptionType_OPTION_TYPE_BOOL,
+			Default: &proto.Value{
+				Bool: true,
+			},
+		},
+		apply: func(v *proto.Value) {
+			setCaptivePortalDetection(v.Bool)
+		},
+	},
+	{
+		Option: &proto.Option{
+			Name:        "Captive Portal Probe",
+			Description: "URL requested to detect captive portals. It must answer with status 204 or a body starting with \"success\" if no portal intercepts the request. Its host is always resolved by Portmaster's resolvers while captive portal detection is enabled.",
+			Key:         "captivePortalProbe",
+			OptionType:  proto.OptionType_OPTION_TYPE_STRING,
+			Default: &proto.Value{
+				String_: defaultCaptivePortalProbe,
+			},
+		},
+		apply: func(v *proto.Value) {
+			setCaptivePortalProbe(v.String_)
+		},
+		validate: validateCaptivePortalProbe,
+	},
+	{
+		Option: &proto.Option{
+			Name:        "Preferred IP Version",
+			Description: "Defines which address family is used if a server is reachable using both, IPv4 and IPv6. Possible values are \"any\", \"ipv4\" and \"ipv6\". Use the \"ipv4Servers\" and \"ipv6Servers\" settings to require an address family.",
+			Key:         "ipPreference",
+			OptionType:  proto.OptionType_OPTION_TYPE_STRING,
+			Default: &proto.Value{
+				String_: string(preferAny),
+			},
+		},
+		apply: func(v *proto.Value) {
+			pref := parseIPPreference(v.String_)
+
+			updateFilter(func(f *serverFilter) { f.prefer = pref })
+		},
+		validate: validateOneOf(preferAny, preferIPv4, preferIPv6),
+	},
+	{
+		Option: &proto.Option{
+			Name:        "EDNS Buffer Size",
+			Description: "UDP buffer size in bytes advertised to upstream servers using EDNS0. Larger values avoid truncated responses but may cause IP fragmentation. Set to 0 to disable EDNS0.",
+			Key:         "ednsBufferSize",
+			OptionType:  proto.OptionType_OPTION_TYPE_INT,
+			Default: &proto.Value{
+				Int: defaultEDNSBufferSize,
+			},
+		},
+		apply: func(v *proto.Value) {
+			setEDNSBufferSize(v.Int)
+		},
+		validate: validateRange(dns.MinMsgSize, dns.MaxMsgSize, true),
+	},
+	{
+		Option: &proto.Option{
+			Name:        "EDNS Client Subnet",
+			Description: "Subnet in CIDR notation (e.g. \"203.0.113.0/24\") that is sent to upstream servers using EDNS Client Subnet so CDNs can return nearby addresses without learning your full address. Use \"0.0.0.0/0\" to ask servers not to use your address at all. Leave empty to not send any subnet. Requires EDNS0.",
+			Key:         "clientSubnet",
+			OptionType:  proto.OptionType_OPTION_TYPE_STRING,
+			Default: &proto.Value{
+				String_: "",
+			},
+		},
+		apply: func(v *proto.Value) {
+			setClientSubnet(v.String_)
+		},
+		validate: validateClientSubnet,
+	},
+	{
+		Option: &proto.Option{
+			Name:        "DNSSEC",
+			Description: "Defines whether DNSSEC is requested from upstream servers. \"on\" sets the DO bit so validating servers authenticate answers, \"strict\" additionally rejects all answers that have not been authenticated by the server (domains without DNSSEC fail to resolve) and \"off\" disables DNSSEC. Requires EDNS0.",
+			Key:         "dnssec",
+			OptionType:  proto.OptionType_OPTION_TYPE_STRING,
+			Default: &proto.Value{
+				String_: string(dnssecOn),
+			},
+		},
+		apply: func(v *proto.Value) {
+			setDNSSECMode(v.String_)
+		},
+		validate: validateOneOf(dnssecOff, dnssecOn, dnssecStrict),
+	},
+	{
+		Option: &proto.Option{
+			Name:        "Randomize Query Case",
+			Description: "Randomize the case of the letters in query names (DNS 0x20) and discard responses that do not echo the exact same case. This makes spoofing responses harder but fails with servers that do not preserve the case of the query.",
+			Key:         "randomizeCase",
+			OptionType:  proto.OptionType_OPTION_TYPE_BOOL,
+			Default: &proto.Value{
+				Bool: false,
+			},
+		},
+		apply: func(v *proto.Value) {
+			randomizeCase.Store(v.Bool)
+		},
+	},
+	{
+		Option: &proto.Option{
+			Name:        "Query Padding Block Size",
+			Description: "Queries are padded using EDNS0 so their length is a multiple of this number of bytes, which makes it harder to guess queried domains from the size of encrypted packets. Set to 0 to disable padding. Requires EDNS0.",
+			Key:         "paddingBlockSize",
+			OptionType:  proto.OptionType_OPTION_TYPE_INT,
+			Default: &proto.Value{
+				Int: defaultPaddingBlockSize,
+			},
+		},
+		apply: func(v *proto.Value) {
+			setPaddingBlockSize(v.Int)
+		},
+		validate: validateRange(0, dns.MaxMsgSize, false),
+	},
+	{
+		Option: &proto.Option{
+			Name:        "Flatten CNAMEs",
+			Description: "Follow CNAME chains of A and AAAA queries and only return the final addresses as records of the queried name, using the lowest TTL of the chain.",
+			Key:         "flattenCNAME",
+			OptionType:  proto.OptionType_OPTION_TYPE_BOOL,
+			Default: &proto.Value{
+				Bool: false,
+			},
+		},
+		apply: func(v *proto.Value) {
+			flattenCNAME.Store(v.Bool)
+		},
+	},
+	{
+		Option: &proto.Option{
+			Name:        "Resolve Private Reverse Lookups Locally",
+			Description: "Do not send reverse lookups (PTR queries) for private, loopback and link-local addresses to upstream servers but let Portmaster resolve them using its own resolvers.",
+			Key:         "localReverse",
+			OptionType:  proto.OptionType_OPTION_TYPE_BOOL,
+			Default: &proto.Value{
+				Bool: true,
+			},
+		},
+		apply: func(v *proto.Value) {
+			localReverse.Store(v.Bool)
+		},
+	},
+	{
+		Option: &proto.Option{
+			Name:        "DNS Cookies",
+			Description: "Send DNS cookies (RFC 7873) to upstream servers and discard responses that do not echo the cookie, as an additional protection against spoofed responses.",
+			Key:         "dnsCookies",
+			OptionType:  proto.OptionType_OPTION_TYPE_BOOL,
+			Default: &proto.Value{
+				Bool: false,
+			},
+		},
+		apply: func(v *proto.Value) {
+			dnsCookies.Store(v.Bool)
+		},
+	},
+	{
+		Option: &proto.Option{
+			Name:        "Enable Cache",
+			Description: "Cache responses for as long as their TTL allows so repeated queries are answered without asking upstream servers again.",
+			Key:         "cacheEnabled",
+			OptionType:  proto.OptionType_OPTION_TYPE_BOOL,
+			Default: &proto.Value{
+				Bool: true,
+			},
+		},
+		apply: func(v *proto.Value) {
+			setCacheEnabled(v.Bool)
+		},
+	},
+	{
+		Option: &proto.Option{
+			Name:        "Minimum TTL",
+			Description: "Minimum TTL in seconds for cached and returned records. Records with a lower TTL are cached for this long instead. Set to 0 to keep the TTLs of the server.",
+			Key:         "cacheMinTTL",
+			OptionType:  proto.OptionType_OPTION_TYPE_INT,
+			Default: &proto.Value{
+				Int: 0,
+			},
+		},
+		apply: func(v *proto.Value) {
+			setCacheMinTTL(v.Int)
+		},
+		validate: validateRange(0, math.MaxUint32, false),
+	},
+	{
+		Option: &proto.Option{
+			Name:        "Maximum TTL",
+			Description: "Maximum TTL in seconds for cached and returned records. Set to 0 to keep the TTLs of the server.",
+			Key:         "cacheMaxTTL",
+			OptionType:  proto.OptionType_OPTION_TYPE_INT,
+			Default: &proto.Value{
+				Int: defaultCacheMaxTTL,
+			},
+		},
+		apply: func(v *proto.Value) {
+			setCacheMaxTTL(v.Int)
+		},
+		validate: validateRange(0, math.MaxUint32, false),
+	},
+	{
+		Option: &proto.Option{
+			Name:        "Serve Stale",
+			Description: "Number of seconds expired cache entries may still be served if none of the servers is reachable (RFC 8767). Set to 0 to never serve expired entries.",
+			Key:         "cacheServeStale",
+			OptionType:  proto.OptionType_OPTION_TYPE_INT,
+			Default: &proto.Value{
+				Int: 0,
+			},
+		},
+		apply: func(v *proto.Value) {
+			setCacheStaleTime(v.Int)
+		},
+		validate: validateRange(0, math.MaxUint32, false),
+	},
+	{
+		Option: &proto.Option{
+			Name:        "Prefetch Popular Entries",
+			Description: "Refresh frequently requested cache entries shortly before they expire so they are always answered from the cache.",
+			Key:         "cachePrefetch",
+			OptionType:  proto.OptionType_OPTION_TYPE_BOOL,
+			Default: &proto.Value{
+				Bool: true,
+			},
+		},
+		apply: func(v *proto.Value) {
+			cachePrefetch.Store(v.Bool)
+		},
+	},
+	{
+		Option: &proto.Option{
+			Name:        "Persist Cache",
+			Description: "Write the cache to the plugin data directory when the plugin is stopped and load it again on start, so restarts do not cause a burst of slow lookups.",
+			Key:         "cachePersist",
+			OptionType:  proto.OptionType_OPTION_TYPE_BOOL,
+			Default: &proto.Value{
+				Bool: true,
+			},
+		},
+		apply: func(v *proto.Value) {
+			cachePersist.Store(v.Bool)
+		},
+	},
+	{
+		Option: &proto.Option{
+			Name:        "Cache Size",
+			Description: "The maximum number of responses to cache. The least recently used responses are removed once the cache is full. Set to 0 to not limit the size of the cache.",
+			Key:         "cacheSize",
+			OptionType:  proto.OptionType_OPTION_TYPE_INT,
+			Default: &proto.Value{
+				Int: defaultCacheSize,
+			},
+		},
+		apply: func(v *proto.Value) {
+			setCacheSize(v.Int)
+		},
+		validate: validateRange(0, math.MaxInt32, false),
+	},
+	{
+		Option: &proto.Option{
+			Name:        "Cache Bypass",
+			Description: "Domains whose responses are never cached. Each entry matches the domain and all its subdomains.",
+			Key:         "cacheBypass",
+			OptionType:  proto.OptionType_OPTION_TYPE_STRING_ARRAY,
+			Default: &proto.Value{
+				StringArray: []string{},
+			},
+		},
+		apply: func(v *proto.Value) {
+			setCacheBypass(v.StringArray)
+		},
+		validate: validateEach(validateDomain),
+	},
+	{
+		Option: &proto.Option{
+			Name:        "Query Timeout",
+			Description: "Time in milliseconds, at most 60000, a server may take to answer a query before the next server is tried. Set to 0 to only limit queries by the time Portmaster waits for an answer.",
+			Key:         "queryTimeout",
+			OptionType:  proto.OptionType_OPTION_TYPE_INT,
+			Default: &proto.Value{
+				Int: defaultQueryTimeout,
+			},
+		},
+		apply: func(v *proto.Value) {
+			setQueryTimeout(v.Int)
+		},
+		validate: validateRange(0, 60000, false),
+	},
+	{
+		Option: &proto.Option{
+			Name:        "Server Protocols",
+			Description: "Network used to query specific DNSCrypt servers in the format \"<server> <udp|tcp>\" where server is the name or provider name of a server. Servers without an entry are queried over UDP and fall back to TCP for large responses.",
+			Key:         "serverProtocols",
+			OptionType:  proto.OptionType_OPTION_TYPE_STRING_ARRAY,
+			Default: &proto.Value{
+				StringArray: []string{},
+			},
+		},
+		apply: func(v *proto.Value) {
+			setServerNetworks(v.StringArray)
+		},
+		validate: validateEach(validateServerNetwork),
+	},
+	{
+		Option: &proto.Option{
+			Name:        "Maximum Retries",
+			Description: "Number of times a failed query is retried before it is given up, at most 10. Each retry uses the next configured server and every server is tried once before a query is given up, so retries only send queries to a server again if there are fewer servers than attempts.",
+			Key:         "maxRetries",
+			OptionType:  proto.OptionType_OPTION_TYPE_INT,
+			Default: &proto.Value{
+				Int: defaultMaxRetries,
+			},
+		},
+		apply: func(v *proto.Value) {
+			setMaxRetries(v.Int)
+		},
+		validate: validateRange(0, retryLimit, false),
+	},
+	{
+		Option: &proto.Option{
+			Name:        "Network Rules",
+			Description: "Use specific servers while the host is connected to a network. Each rule has the format \"<network> <server> [<server>...]\" where network is in CIDR notation and matched against the local address of the default route. Servers referenced by network rules are only used on their networks. Forwarding and application rules take precedence over network rules.",
+			Key:         "networkRules",
+			OptionType:  proto.OptionType_OPTION_TYPE_STRING_ARRAY,
+			Default: &proto.Value{
+				StringArray: []string{},
+			},
+		},
+		apply: func(v *proto.Value) {
+			setNetworkRules(v.StringArray)
+		},
+		validate: validateEach(validateNetworkRule),
+	},
+	{
+		Option: &proto.Option{
+			Name:        "Query Log File",
+			Description: "Path of a file every query answered by the plugin is appended to, including the name, type, response code, the server used, the latency, whether the cache has been used and the requesting application. Relative paths are resolved in the plugin data directory. Leave empty to disable the query log.",
+			Key:         "queryLogFile",
+			OptionType:  proto.OptionType_OPTION_TYPE_STRING,
+			Default: &proto.Value{
+				String_: "",
+			},
+		},
+		apply: func(v *proto.Value) {
+			setQueryLogFile(v.String_)
+		},
+	},
+	{
+		Option: &proto.Option{
+			Name:        "Query Log Format",
+			Description: "Format of the query log, the NXDOMAIN log and the connection log. \"text\" writes one tab separated line per query, \"json\" one JSON object per line (ndjson) for machine processing.",
+			Key:         "queryLogFormat",
+			OptionType:  proto.OptionType_OPTION_TYPE_STRING,
+			Default: &proto.Value{
+				String_: string(logFormatText),
+			},
+		},
+		apply: func(v *proto.Value) {
+			setQueryLogFormat(v.String_)
+		},
+		validate: validateOneOf(logFormatText, logFormatJSON),
+	},
+	{
+		Option: &proto.Option{
+			Name:        "NXDOMAIN Log File",
+			Description: "Path of a file queries that failed with NXDOMAIN or look suspicious, i.e. contain very long or randomly looking labels, are appended to. Helps to spot typos and malware using domain generation algorithms. Relative paths are resolved in the plugin data directory. Leave empty to disable the NXDOMAIN log.",
+			Key:         "nxLogFile",
+			OptionType:  proto.OptionType_OPTION_TYPE_STRING,
+			Default: &proto.Value{
+				String_: "",
+			},
+		},
+		apply: func(v *proto.Value) {
+			setNXLogFile(v.String_)
+		},
+	},
+	{
+		Option: &proto.Option{
+			Name:        "Connection Log File",
+			Description: "Path of a file connections to domains resolved by the plugin are appended to, including the domain, the address and port connected to, the verdict of the Portmaster, the server that resolved the domain and the application. Uses the format of the query log. Relative paths are resolved in the plugin data directory. Leave empty to disable the connection log.",
+			Key:         "connectionLogFile",
+			OptionType:  proto.OptionType_OPTION_TYPE_STRING,
+			Default: &proto.Value{
+				String_: "",
+			},
+		},
+		apply: func(v *proto.Value) {
+			setConnectionLogFile(v.String_)
+		},
+	},
+	{
+		Option: &proto.Option{
+			Name:        "Log Level",
+			Description: "Minimum level of the log messages of the plugin itself. Possible values are \"trace\", \"debug\", \"info\", \"warn\" and \"error\".",
+			Key:         "logLevel",
+			OptionType:  proto.OptionType_OPTION_TYPE_STRING,
+			Default: &proto.Value{
+				String_: "info",
+			},
+		},
+		apply: func(v *proto.Value) {
+			setLogLevel(v.String_)
+		},
+		validate: validateOneOf(logLevels...),
+	},
+	{
+		Option: &proto.Option{
+			Name:        "Log File",
+			Description: "Path of a file the log messages of the plugin are written to in addition to the Portmaster log. Relative paths are resolved in the plugin data directory. Leave empty to only log to the Portmaster.",
+			Key:         "logFile",
+			OptionType:  proto.OptionType_OPTION_TYPE_STRING,
+			Default: &proto.Value{
+				String_: "",
+			},
+		},
+		apply: func(v *proto.Value) {
+			setLogFile(v.String_)
+		},
+	},
+	{
+		Option: &proto.Option{
+			Name:        "Log Format",
+			Description: "Format of the log messages of the plugin. \"text\" writes human readable lines, \"json\" one structured JSON object per message for log collectors.",
+			Key:         "logFormat",
+			OptionType:  proto.OptionType_OPTION_TYPE_STRING,
+			Default: &proto.Value{
+				String_: string(logFormatText),
+			},
+		},
+		apply: func(v *proto.Value) {
+			setLogFormat(v.String_)
+		},
+		validate: validateOneOf(logFormatText, logFormatJSON),
+	},
+	{
+		Option: &proto.Option{
+			Name:        "Trace Endpoint",
+			Description: "URL of an OpenTelemetry collector traces of the resolve pipeline are exported to using OTLP/HTTP, e.g. \"http://localhost:4318\". Each query is traced with spans for the cache lookup, the rule evaluation, every exchange with an upstream server and the conversion of the records. Leave empty to disable tracing.",
+			Key:         "traceEndpoint",
+			OptionType:  proto.OptionType_OPTION_TYPE_STRING,
+			Default: &proto.Value{
+				String_: "",
+			},
+		},
+		apply: func(v *proto.Value) {
+			setTraceEndpoint(v.String_)
+		},
+		validate: validateTraceEndpoint,
+	},
+	{
+		Option: &proto.Option{
+			Name:        "Weekly Summary",
+			Description: "Show a notification once a week summarizing the number of queries answered by the plugin, the most queried domains, the cache hit rate and the availability of the servers.",
+			Key:         "weeklySummary",
+			OptionType:  proto.OptionType_OPTION_TYPE_BOOL,
+			Default: &proto.Value{
+				Bool: false,
+			},
+		},
+		apply: func(v *proto.Value) {
+			setWeeklySummary(v.Bool)
+		},
+	},
+	{
+		Option: &proto.Option{
+			Name:        "Failure Rate Alert",
+			Description: "Show a notification if more than this percentage of the queries sent to the configured servers failed, either with an error or SERVFAIL, during the alert window. Set to 0 to disable the alert.",
+			Key:         "alertFailureRate",
+			OptionType:  proto.OptionType_OPTION_TYPE_INT,
+			Default: &proto.Value{
+				Int: defaultAlertFailureRate,
+			},
+		},
+		apply: func(v *proto.Value) {
+			setAlertFailureRate(v.Int)
+		},
+		validate: validateRange(0, 100, false),
+	},
+	{
+		Option: &proto.Option{
+			Name:        "Failure Rate Alert Window",
+			Description: "Time in minutes the failure rate of the failure rate alert is calculated for.",
+			Key:         "alertWindow",
+			OptionType:  proto.OptionType_OPTION_TYPE_INT,
+			Default: &proto.Value{
+				Int: defaultAlertWindow,
+			},
+		},
+		apply: func(v *proto.Value) {
+			setAlertWindow(v.Int)
+		},
+		validate: validateRange(1, 24*60, false),
+	},
+	{
+		Option: &proto.Option{
+			Name:        "Schedules",
+			Description: "Time windows that blocklist entries can be restricted to, in the format \"<name> <days> <from>-<to>\", e.g. \"work mon-fri 09:00-17:00\". Days are separated by commas and may be ranges, \"*\" selects all days. Entries with the same name are combined. Blocklist lines ending with \"@<name>\" are only blocked while the schedule is active. Times are in local time.",
+			Key:         "schedules",
+			OptionType:  proto.OptionType_OPTION_TYPE_STRING_ARRAY,
+			Default: &proto.Value{
+				StringArray: []string{},
+			},
+		},
+		apply: func(v *proto.Value) {
+			setSchedules(v.StringArray)
+		},
+		validate: validateEach(validateSchedule),
+	},
+	{
+		Option: &proto.Option{
+			Name:        "Blocklist Files",
+			Description: "Paths of local files with domains to block, one domain per line. Hosts files are supported as well. Queries for a listed domain or any of its subdomains are answered with NXDOMAIN without being sent to a server. Relative paths are resolved in the plugin data directory.",
+			Key:         "blocklistFiles",
+			OptionType:  proto.OptionType_OPTION_TYPE_STRING_ARRAY,
+			Default: &proto.Value{
+				StringArray: []string{},
+			},
+		},
+		apply: func(v *proto.Value) {
+			setBlocklistFiles(v.StringArray)
+		},
+	},
+	{
+		Option: &proto.Option{
+			Name:        "Remote Blocklists",
+			Description: "Blocklists to download in the format \"<url> [<minisign-key> | sha256:<hash>]\". If a minisign key is given the signature is downloaded from \"<url>.minisig\" and verified, if a SHA-256 hash is given the list must match it. Lists without either must be downloaded using HTTPS. Downloaded lists are cached in the plugin data directory and used like blocklist files.",
+			Key:         "blocklistURLs",
+			OptionType:  proto.OptionType_OPTION_TYPE_STRING_ARRAY,
+			Default: &proto.Value{
+				StringArray: []string{},
+			},
+		},
+		apply: func(v *proto.Value) {
+			setRemoteBlocklists(v.StringArray)
+		},
+		validate: validateEach(validateRemoteBlocklist),
+	},
+	{
+		Option: &proto.Option{
+			Name:        "Blocklist Update Interval",
+			Description: "Time in hours after which remote blocklists are downloaded again.",
+			Key:         "blocklistUpdateInterval",
+			OptionType:  proto.OptionType_OPTION_TYPE_INT,
+			Default: &proto.Value{
+				Int: defaultBlocklistUpdateInterval,
+			},
+		},
+		apply: func(v *proto.Value) {
+			setBlocklistUpdateInterval(v.Int)
+		},
+		validate: validateRange(1, 24*30, false),
+	},
+	{
+		Option: &proto.Option{
+			Name:        "Block Connections",
+			Description: "Block connections to domains on the blocklists, even if the domain was resolved from the cache of the Portmaster or by another resolver. Requires the plugin to be registered as decider in plugins.json, which the install command does.",
+			Key:         "blockConnections",
+			OptionType:  proto.OptionType_OPTION_TYPE_BOOL,
+			Default: &proto.Value{
+				Bool: true,
+			},
+		},
+		apply: func(v *proto.Value) {
+			blockConnections.Store(v.Bool)
+		},
+	},
+	{
+		Option: &proto.Option{
+			Name:        "Allowlist",
+			Description: "Domains that are never blocked, even if they or one of their parent domains are listed in a blocklist. Entries also allow all subdomains, e.g. \"cdn.example.com\" allows \"img.cdn.example.com\". Use this to unblock false positives without editing third-party blocklists.",
+			Key:         "allowlist",
+			OptionType:  proto.OptionType_OPTION_TYPE_STRING_ARRAY,
+			Default: &proto.Value{
+				StringArray: []string{},
+			},
+		},
+		apply: func(v *proto.Value) {
+			setAllowlist(v.StringArray)
+		},
+		validate: validateEach(validateDomain),
+	},
+	{
+		Option: &proto.Option{
+			Name:        "Blocked Query Types",
+			Description: "Query types that are refused without asking a server, e.g. \"ANY\", \"NULL\" or \"TXT\" to make data exfiltration over DNS harder. Queries of these types are answered with REFUSED.",
+			Key:         "blockedQueryTypes",
+			OptionType:  proto.OptionType_OPTION_TYPE_STRING_ARRAY,
+			Default: &proto.Value{
+				StringArray: []string{},
+			},
+		},
+		apply: func(v *proto.Value) {
+			setBlockedQueryTypes(v.StringArray)
+		},
+		validate: validateEach(validateQueryType),
+	},
+	{
+		Option: &proto.Option{
+			Name:        "Blocked IPs",
+			Description: "IP addresses and networks in CIDR notation, e.g. \"192.0.2.1\" or \"198.51.100.0/24\", that must not be returned. Queries whose answer contains such an address are answered with NXDOMAIN, which blocks known sinkholes, parking pages or hosters. Domains on the allowlist are never blocked.",
+			Key:         "blockedIPs",
+			OptionType:  proto.OptionType_OPTION_TYPE_STRING_ARRAY,
+			Default: &proto.Value{
+				StringArray: []string{},
+			},
+		},
+		apply: func(v *proto.Value) {
+			setBlockedIPs(v.StringArray)
+		},
+		validate: validateEach(validateIPRange),
+	},
+	{
+		Option: &proto.Option{
+			Name:        "DNS Rebinding Protection",
+			Description: "Answer queries for public domains with NXDOMAIN if the answer contains a private, loopback or link-local address. This protects devices in your local network from DNS rebinding attacks. Names of local zones like \"home.lan\" are not affected.",
+			Key:         "rebindingProtection",
+			OptionType:  proto.OptionType_OPTION_TYPE_BOOL,
+			Default: &proto.Value{
+				Bool: false,
+			},
+		},
+		apply: func(v *proto.Value) {
+			rebindingProtection.Store(v.Bool)
+		},
+	},
+	{
+		Option: &proto.Option{
+			Name:        "DNS Rebinding Allowlist",
+			Description: "Public domains that may resolve to private addresses, e.g. for split-horizon setups. Entries also allow all subdomains.",
+			Key:         "rebindingAllowlist",
+			OptionType:  proto.OptionType_OPTION_TYPE_STRING_ARRAY,
+			Default: &proto.Value{
+				StringArray: []string{},
+			},
+		},
+		apply: func(v *proto.Value) {
+			setRebindingAllowlist(v.StringArray)
+		},
+		validate: validateEach(validateDomain),
+	},
+	{
+		Option: &proto.Option{
+			Name:        "Cloaking Rules",
+			Description: "Answer queries for specific names with fixed records instead of asking a server. Each rule has the format \"<name> <address> [<address>...]\" to return A and AAAA records or \"<name> <target>\" to return a CNAME record for target, which is resolved as usual. A name starting with \"*.\" matches all subdomains, e.g. \"*.lab.example.com 192.168.1.10\".",
+			Key:         "cloakingRules",
+			OptionType:  proto.OptionType_OPTION_TYPE_STRING_ARRAY,
+			Default: &proto.Value{
+				StringArray: []string{},
+			},
+		},
+		apply: func(v *proto.Value) {
+			setCloakingRules(v.StringArray)
+		},
+		validate: validateEach(validateCloakingRule),
+	},
+	{
+		Option: &proto.Option{
+			Name:        "Hosts File",
+			Description: "Path of a file in the hosts format, i.e. an address followed by one or more names per line, whose names are answered by the plugin itself, e.g. for lab machines and services in your local network. Names starting with \"*.\" match all subdomains. The file is reloaded automatically when it changes. Relative paths are resolved in the plugin data directory. Leave empty to disable.",
+			Key:         "hostsFile",
+			OptionType:  proto.OptionType_OPTION_TYPE_STRING,
+			Default: &proto.Value{
+				String_: "",
+			},
+		},
+		apply: func(v *proto.Value) {
+			setHostsFile(v.String_)
+		},
+	},
+	{
+		Option: &proto.Option{
+			Name:        "Hosts File TTL",
+			Description: "TTL in seconds of the records answered from the hosts file.",
+			Key:         "hostsTTL",
+			OptionType:  proto.OptionType_OPTION_TYPE_INT,
+			Default: &proto.Value{
+				Int: cloakTTL,
+			},
+		},
+		apply: func(v *proto.Value) {
+			setHostsTTL(v.Int)
+		},
+		validate: validateRange(1, 24*60*60, false),
+	},
+	{
+		Option: &proto.Option{
+			Name:        "DNS64",
+			Description: "Synthesize AAAA records from the A records of names without IPv6 addresses. Enable this in IPv6-only networks that reach IPv4 hosts through NAT64 if the encrypted servers do not support DNS64 themselves.",
+			Key:         "dns64",
+			OptionType:  proto.OptionType_OPTION_TYPE_BOOL,
+			Default: &proto.Value{
+				Bool: false,
+			},
+		},
+		apply: func(v *proto.Value) {
+			dns64Enabled.Store(v.Bool)
+		},
+	},
+	{
+		Option: &proto.Option{
+			Name:        "DNS64 Prefixes",
+			Description: "NAT64 prefixes used to synthesize AAAA records, e.g. \"64:ff9b::/96\". Supported prefix lengths are 32, 40, 48, 56, 64 and 96. If empty, the prefix is discovered by resolving \"ipv4only.arpa\" using the bootstrap resolvers and the well-known prefix 64:ff9b::/96 is used if that fails.",
+			Key:         "dns64Prefixes",
+			OptionType:  proto.OptionType_OPTION_TYPE_STRING_ARRAY,
+			Default: &proto.Value{
+				StringArray: []string{},
+			},
+		},
+		apply: func(v *proto.Value) {
+			setDNS64Prefixes(v.StringArray)
+		},
+		validate: validateEach(validateDNS64Prefix),
+	},
+}
+
+// applyValue applies the value of the option identified by key. Since the
+// Portmaster sends the values of all watched options whenever some option
+// changes the value is only applied if it actually differs from the last
+// one. Invalid values are rejected and the previous value is kept. If there
+// is no previous value yet, the invalid value is applied anyway so that
+// its valid entries are still used.
+func applyValue(key string, value *proto.Value) {
+	for _, opt := range configOptions {
+		if key != opt.Key && !strings.HasSuffix(key, "/"+opt.Key) {
+			continue
+		}
+
+		valuesLock.Lock()
+		previous, ok := configValues[opt.Key]
+		rejected, wasRejected := rejectedValues[opt.Key]
+		valuesLock.Unlock()
+
+		if ok && protobuf.Equal(previous, value) {
+			return
+		}
+
+		if wasRejected && protobuf.Equal(rejected, value) {
+			return
+		}
+
+		err := validateValue(opt, value)
+		if err != nil {
+			valuesLock.Lock()
+			rejectedValues[opt.Key] = value
+			valuesLock.Unlock()
+
+			if ok {
+				return
+			}
+		}
+
+		valuesLock.Lock()
+		configValues[opt.Key] = value
+		if err == nil {
+			delete(rejectedValues, opt.Key)
+		}
+		valuesLock.Unlock()
+
+		hclog.L().Debug("applying configuration value", "key", opt.Key)
+
+		opt.apply(value)
+
+		return
+	}
+}
+
+func setupAndWatchConfig(ctx context.Context) error {
+	keys := make([]string, len(configOptions))
+	for idx, opt := range configOptions {
+		if err := framework.Config().RegisterOption(ctx, opt.Option); err != nil {
+			return err
+		}
+
+		keys[idx] = opt.Key
+	}
+
+	ch, err := framework.Config().WatchValue(framework.Context(), keys...)
+	if err != nil {
+		return err
+	}
+
+	// options set using environment variables ignore the stored value
+	overridden := make(map[string]bool)
+
+	for idx, key := range keys {
+		if val, ok := envOverride(configOptions[idx]); ok {
+			hclog.L().Info("using value from environment", "key", key, "name", envName(key))
+
+			overridden[key] = true
+			applyValue(key, val)
+
+			continue
+		}
+
+		val, err := framework.Config().GetValue(ctx, key)
+		if err != nil {
+			return err
+		}
+
+		applyValue(key, migratedValue(configOptions[idx], val))
+	}
+
+	configLoaded.Store(true)
+	reloadServers()
+
+	go func() {
+		for msg := range ch {
+			key := msg.Key[strings.LastIndex(msg.Key, "/")+1:]
+			if overridden[key] {
+				hclog.L().Warn("ignoring change of option set using environment variable", "key", key, "name", envName(key))
+
+				continue
+			}
+
+			idx := slices.Index(keys, key)
+			if idx < 0 {
+				continue
+			}
+
+			// the values of all watched options are sent again whenever
+			// any of them changes, so the migrated value is only dropped
+			// once the user actually configured the option
+			opt := configOptions[idx]
+			if !isDefault(opt, msg.Value) {
+				forgetMigratedValue(key)
+			}
+
+			applyValue(msg.Key, migratedValue(opt, msg.Value))
+		}
+	}()
+
+	return nil
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/safing/portmaster/plugin/shared/proto"
+)
+
+const (
+	// resolvedGrace is added to the TTL of answers when remembering which
+	// server resolved a domain. Applications often keep using addresses
+	// after their TTL expired.
+	resolvedGrace = 10 * time.Minute
+
+	// resolvedPruneSize is the number of remembered domains above which
+	// expired entries are removed.
+	resolvedPruneSize = 10000
+
+	// cacheSource is recorded as the source of answers taken from the
+	// cache.
+	cacheSource = "cache"
+)
+
+// resolvedDomain describes where the answer for a domain came from.
+type resolvedDomain struct {
+	server  string
+	expires time.Time
+}
+
+// connectionLogEntry is an entry of the connection log.
+type connectionLogEntry struct {
+	Time     time.Time `json:"time"`
+	ID       string    `json:"id"`
+	Domain   string    `json:"domain"`
+	Server   string    `json:"server"`
+	IP       string    `json:"ip"`
+	Port     int32     `json:"port"`
+	Protocol string    `json:"protocol"`
+	Inbound  bool      `json:"inbound,omitempty"`
+	Verdict  string    `json:"verdict"`
+	App      string    `json:"app,omitempty"`
+	PID      int64     `json:"pid,omitempty"`
+}
+
+var (
+	// connectionLog is the log of connections to domains resolved by the
+	// plugin.
+	connectionLog logFile
+
+	resolvedLock    sync.Mutex
+	resolvedDomains = make(map[string]resolvedDomain)
+)
+
+func setConnectionLogFile(path string) {
+	connectionLog.setPath(strings.TrimSpace(path))
+}
+
+// recordResolved remembers the source of the answer res for question, so
+// connections to the domain can be attributed to it. Only answers with
+// addresses are remembered and only while the connection log is enabled.
+func recordResolved(question *proto.DNSQuestion, res *proto.DNSResponse, outcome queryOutcome) {
+	if res == nil || res.GetRcode() != dns.RcodeSuccess || !connectionLog.enabled() {
+		return
+	}
+
+	var (
+		ttl   uint32
+		found bool
+	)
+	for _, rr := range res.GetRrs() {
+		if t := uint16(rr.GetType()); t == dns.TypeA || t == dns.TypeAAAA {
+			ttl = max(ttl, rr.GetTtl())
+			found = true
+		}
+	}
+
+	if !found {
+		return
+	}
+
+	now := time.Now()
+
+	resolvedLock.Lock()
+	defer resolvedLock.Unlock()
+
+	if len(resolvedDomains) >= resolvedPruneSize {
+		for name, entry := range resolvedDomains {
+			if now.After(entry.expires) {
+				delete(resolvedDomains, name)
+			}
+		}
+	}
+
+	resolvedDomains[dns.CanonicalName(question.GetName())] = resolvedDomain{
+		server:  answerSource(outcome),
+		expires: now.Add(time.Duration(ttl)*time.Second + resolvedGrace),
+	}
+}
+
+// answerSource returns where the answer described by outcome came from:
+// the server that answered it, the blocklist, the cloaking rules, the hosts
+// file or the cache.
+func answerSource(outcome queryOutcome) string {
+	// answers of the cloaking rules may contain records from the cache
+	// but are attributed to the rules
+	if outcome.server == "" && (outcome.cache == cacheUseHit || outcome.cache == cacheUseStale) {
+		return cacheSource
+	}
+
+	return outcome.server
+}
+
+// lookupResolved returns the source of the answer for name, if it has been
+// resolved by the plugin recently.
+func lookupResolved(name string) (string, bool) {
+	resolvedLock.Lock()
+	defer resolvedLock.Unlock()
+
+	name = dns.CanonicalName(name)
+
+	entry, ok := resolvedDomains[name]
+	if !ok {
+		return "", false
+	}
+
+	if time.Now().After(entry.expires) {
+		delete(resolvedDomains, name)
+
+		return "", false
+	}
+
+	return entry.server, true
+}
+
+// reportConnection writes connections to domains resolved by the plugin
+// to the connection log, so every connection can be traced back to the
+// query and the server it was resolved by.
+func reportConnection(ctx context.Context, conn *proto.Connection) error {
+	if !connectionLog.enabled() || conn.GetType() != proto.ConnectionType_CONNECTION_TYPE_IP {
+		return nil
+	}
+
+	entity := conn.GetEntity()
+	if entity.GetDomain() == "" {
+		return nil
+	}
+
+	server, ok := lookupResolved(entity.GetDomain())
+	if !ok {
+		return nil
+	}
+
+	entry := connectionLogEntry{
+		Time:     time.Now(),
+		ID:       conn.GetId(),
+		Domain:   entity.GetDomain(),
+		Server:   server,
+		IP:       entity.GetIp(),
+		Port:     entity.GetPort(),
+		Protocol: ipProtocolName(entity.GetProtocol()),
+		Inbound:  conn.GetInbound(),
+		Verdict:  strings.ToLower(strings.TrimPrefix(conn.GetVerdict().String(), "VERDICT_")),
+	}
+
+	if process := conn.GetProcess(); process != nil {
+		entry.App = process.GetName()
+		entry.PID = process.GetProcessId()
+	}
+
+	connectionLog.write(formatConnectionLogEntry(entry, getQueryLogFormat()))
+
+	return nil
+}
+
+// ipProtocolName returns the name of the IP protocol number p.
+func ipProtocolName(p int32) string {
+	switch p {
+	case 1:
+		return "icmp"
+	case 6:
+		return "tcp"
+	case 17:
+		return "udp"
+	case 58:
+		return "icmpv6"
+	default:
+		return strconv.Itoa(int(p))
+	}
+}
+
+// formatConnectionLogEntry returns entry as a line in format.
+func formatConnectionLogEntry(entry connectionLogEntry, format logFormat) []byte {
+	if format == logFormatJSON {
+		blob, err := json.Marshal(entry)
+		if err != nil {
+			return nil
+		}
+
+		return append(blob, '\n')
+	}
+
+	app := "-"
+	if entry.App != "" {
+		app = fmt.Sprintf("%s(%d)", entry.App, entry.PID)
+	}
+
+	direction := "out"
+	if entry.Inbound {
+		direction = "in"
+	}
+
+	line := fmt.Sprintf("%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s",
+		entry.Time.Format(time.RFC3339),
+		app,
+		entry.Domain,
+		net.JoinHostPort(entry.IP, strconv.Itoa(int(entry.Port))),
+		entry.Protocol,
+		direction,
+		entry.Verdict,
+		entry.Server,
+		entry.ID,
+	)
+
+	return []byte(line + "\n")
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+// controlInterval defines how often the plugin checks for requests created
+// by commands like flush-cache or reload.
+const controlInterval = 5 * time.Second
+
+// controlRequests maps the files that commands create in the plugin data
+// directory to the functions handling them in the running plugin. The
+// functions are passed the data directory to write responses to.
+var controlRequests = map[string]func(dir string){
+	cacheFlushFile: func(string) {
+		flushCache()
+		hclog.L().Info("flushed DNS cache on request")
+	},
+	reloadFile: func(string) {
+		sourcesForced.Store(true)
+		refreshSources()
+		loadBlocklists()
+		blocklistsForced.Store(true)
+		refreshBlocklists()
+		resetDNS64Discovery()
+		reloadHostsFile()
+		hclog.L().Info("reloading resolver lists, servers and blocklists on request")
+	},
+	cacheDumpFile: func(dir string) {
+		writeControlResponse(dir, cacheDumpResponseFile, snapshotCache())
+	},
+	statusFile: func(dir string) {
+		writeControlResponse(dir, statusResponseFile, collectStatus())
+	},
+	pprofStartFile: handlePprofStart,
+	pprofStopFile:  handlePprofStop,
+}
+
+// watchControlRequests handles the requests created in dir until ctx is
+// canceled.
+func watchControlRequests(ctx context.Context, dir string) {
+	ticker := time.NewTicker(controlInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for file, handle := range controlRequests {
+			path := filepath.Join(dir, file)
+			if _, err := os.Stat(path); err != nil {
+				continue
+			}
+
+			if err := os.Remove(path); err != nil {
+				hclog.L().Error("failed to remove request", "file", file, "error", err)
+			}
+
+			handle(dir)
+		}
+	}
+}
+
+// writeControlRequest creates the request file in dir for the running
+// plugin.
+func writeControlRequest(dir, file string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	return os.WriteFile(filepath.Join(dir, file), nil, 0600)
+}
+
+// writeControlResponse writes v encoded as JSON to file in dir.
+func writeControlResponse(dir, file string, v any) {
+	blob, err := json.Marshal(v)
+	if err != nil {
+		hclog.L().Error("failed to encode response", "file", file, "error", err)
+
+		return
+	}
+
+	// write to a temporary file first so commands never read a partial
+	// response
+	tmp := filepath.Join(dir, file+".tmp")
+	if err := os.WriteFile(tmp, blob, 0600); err != nil {
+		hclog.L().Error("failed to write response", "file", file, "error", err)
+
+		return
+	}
+
+	if err := os.Rename(tmp, filepath.Join(dir, file)); err != nil {
+		hclog.L().Error("failed to write response", "file", file, "error", err)
+	}
+}
+
+// requestControlResponse creates the request file in dir and waits until
+// the running plugin wrote the response file, which is decoded into v.
+func requestControlResponse(dir, request, response string, timeout time.Duration, v any) error {
+	path := filepath.Join(dir, response)
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := writeControlRequest(dir, request); err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		blob, err := os.ReadFile(path)
+		if err == nil {
+			return json.Unmarshal(blob, v)
+		}
+
+		if !os.IsNotExist(err) {
+			return err
+		}
+
+		if time.Now().After(deadline) {
+			return errors.New("the plugin did not answer, make sure the Portmaster is running")
+		}
+
+		time.Sleep(250 * time.Millisecond)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+)
+
+// errCookieMismatch is returned if a response does not echo the client
+// cookie of the query.
+var errCookieMismatch = errors.New("response does not contain the client cookie")
+
+// dnsCookies enables DNS cookies (RFC 7873).
+var dnsCookies atomic.Bool
+
+// cookies holds the DNS cookies used with a server.
+type cookies struct {
+	lock   sync.Mutex
+	client []byte
+	server []byte
+}
+
+// cookieOption returns the COOKIE option to add to queries sent to srv.
+// The client cookie is generated on first use.
+func (srv *server) cookieOption() *dns.EDNS0_COOKIE {
+	srv.cookies.lock.Lock()
+	defer srv.cookies.lock.Unlock()
+
+	if srv.cookies.client == nil {
+		srv.cookies.client = make([]byte, 8)
+		if _, err := rand.Read(srv.cookies.client); err != nil {
+			panic(err)
+		}
+	}
+
+	return &dns.EDNS0_COOKIE{
+		Code:   dns.EDNS0COOKIE,
+		Cookie: hex.EncodeToString(srv.cookies.client) + hex.EncodeToString(srv.cookies.server),
+	}
+}
+
+// storeCookie verifies the client cookie echoed in res and remembers the
+// server cookie for future queries. Responses without a COOKIE option are
+// accepted since not all servers support cookies.
+func (srv *server) storeCookie(res *dns.Msg) error {
+	opt := res.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+
+	for _, o := range opt.Option {
+		c, ok := o.(*dns.EDNS0_COOKIE)
+		if !ok {
+			continue
+		}
+
+		value, err := hex.DecodeString(c.Cookie)
+		if err != nil || len(value) < 8 {
+			return errCookieMismatch
+		}
+
+		srv.cookies.lock.Lock()
+		defer srv.cookies.lock.Unlock()
+
+		if !bytes.Equal(value[:8], srv.cookies.client) {
+			return errCookieMismatch
+		}
+
+		srv.cookies.server = value[8:]
+
+		return nil
+	}
+
+	return nil
+}
+
+// exchangeWithCookie sends req to srv with a COOKIE option. If the server
+// rejects the cookie the query is retried once using the new server
+// cookie.
+func (srv *server) exchangeWithCookie(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	for attempt := 0; ; attempt++ {
+		msg := req.Copy()
+
+		opt := msg.IsEdns0()
+		opt.Option = append(opt.Option, srv.cookieOption())
+		repadQuery(msg)
+
+		res, err := srv.transport.exchange(ctx, msg)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := srv.storeCookie(res); err != nil {
+			return nil, err
+		}
+
+		if res.Rcode != dns.RcodeBadCookie || attempt > 0 {
+			return res, nil
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/safing/portmaster/plugin/shared/proto"
+)
+
+// blockConnections enables blocking connections to domains on the
+// blocklists when the plugin is registered as decider.
+var blockConnections atomic.Bool
+
+// decide blocks connections to domains that are on a blocklist, either by
+// name or by one of the CNAMEs the name resolved to. This also covers
+// connections whose domain was resolved before it was blocked, from the
+// Portmaster's cache or by another resolver. All other connections, and
+// all connections while the plugin is disabled, are left to the Portmaster.
+func decide(ctx context.Context, conn *proto.Connection) (proto.Verdict, string, error) {
+	if !pluginEnabled.Load() || !blockConnections.Load() {
+		return proto.Verdict_VERDICT_UNDECIDED, "", nil
+	}
+
+	entity := conn.GetEntity()
+
+	names := append([]string{entity.GetDomain()}, entity.GetCnames()...)
+	for _, name := range names {
+		if name == "" || !blocked(name) {
+			continue
+		}
+
+		hclog.L().Debug("blocking connection", "domain", entity.GetDomain(), "blocked", name, "id", conn.GetId())
+
+		if name == entity.GetDomain() {
+			return proto.Verdict_VERDICT_BLOCK, fmt.Sprintf("%s is on a blocklist", name), nil
+		}
+
+		return proto.Verdict_VERDICT_BLOCK, fmt.Sprintf("%s is an alias of %s, which is on a blocklist", entity.GetDomain(), name), nil
+	}
+
+	return proto.Verdict_VERDICT_UNDECIDED, "", nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/ameshkov/dnscrypt/v2"
+	"github.com/ameshkov/dnsstamps"
+)
+
+// Errors wrapped by dialServer to tell why a server could not be used.
+var (
+	errMalformedStamp = errors.New("malformed stamp")
+	errUnreachable    = errors.New("server unreachable")
+	errCertificate    = errors.New("certificate validation failed")
+)
+
+// malformed marks err as caused by an invalid stamp.
+func malformed(err error) error {
+	return fmt.Errorf("%w: %w", errMalformedStamp, err)
+}
+
+// classifyDialError marks an error returned while dialing a DNSCrypt server
+// as either a certificate validation failure or as the server being
+// unreachable.
+func classifyDialError(err error) error {
+	certErrors := []error{
+		dnscrypt.ErrFailedToFetchCert,
+		dnscrypt.ErrInvalidDate,
+		dnscrypt.ErrInvalidCertSignature,
+		dnscrypt.ErrCertTooShort,
+		dnscrypt.ErrCertMagic,
+		dnscrypt.ErrEsVersion,
+	}
+
+	for _, certErr := range certErrors {
+		if errors.Is(err, certErr) {
+			return fmt.Errorf("%w: %w", errCertificate, err)
+		}
+	}
+
+	return fmt.Errorf("%w: %w", errUnreachable, err)
+}
+
+// dialErrorTitle returns the notification title for an error returned by
+// dialServer.
+func dialErrorTitle(err error) string {
+	switch {
+	case errors.Is(err, errMalformedStamp):
+		return "DNSCrypt: Server Stamp invalid"
+	case errors.Is(err, errCertificate):
+		return "DNSCrypt: Certificate validation failed"
+	case errors.Is(err, errUnreachable):
+		return "DNSCrypt: Server unreachable"
+	default:
+		return "DNSCrypt: Failed to use server"
+	}
+}
+
+// describeStamp returns the decoded fields of stamp for display in a
+// notification. It returns an empty string if stamp cannot be decoded.
+func describeStamp(stamp string) string {
+	var fields [][2]string
+
+	if isDoTURL(stamp) || isDoQURL(stamp) {
+		u, err := url.Parse(stamp)
+		if err != nil {
+			return ""
+		}
+
+		protocol := "DNS-over-TLS"
+		if isDoQURL(stamp) {
+			protocol = "DNS-over-QUIC"
+		}
+
+		fields = append(fields,
+			[2]string{"Protocol", protocol},
+			[2]string{"Address", u.Host},
+		)
+	} else {
+		parsed, err := dnsstamps.NewServerStampFromString(stamp)
+		if err != nil {
+			return ""
+		}
+
+		fields = append(fields,
+			[2]string{"Protocol", parsed.Proto.String()},
+			[2]string{"Address", parsed.ServerAddrStr},
+			[2]string{"Provider", parsed.ProviderName},
+		)
+		if parsed.Path != "" {
+			fields = append(fields, [2]string{"Path", parsed.Path})
+		}
+	}
+
+	var b strings.Builder
+	for _, field := range fields {
+		if field[1] == "" {
+			continue
+		}
+
+		fmt.Fprintf(&b, "\n%s: %s", field[0], field[1])
+	}
+
+	return b.String()
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/miekg/dns"
+	"github.com/safing/portmaster/plugin/shared/proto"
+)
+
+const (
+	// dns64DiscoveryName is resolved to discover the NAT64 prefixes of the
+	// network as defined in RFC 7050.
+	dns64DiscoveryName = "ipv4only.arpa"
+
+	// dns64DiscoveryTimeout limits the time to discover the NAT64 prefixes.
+	dns64DiscoveryTimeout = 2 * time.Second
+)
+
+var (
+	// wellKnownPrefix is the NAT64 prefix defined in RFC 6052. It's used
+	// if no prefix is configured and none can be discovered.
+	wellKnownPrefix = netip.MustParsePrefix("64:ff9b::/96")
+
+	// dns64DiscoveryAddrs are the addresses of dns64DiscoveryName.
+	dns64DiscoveryAddrs = []netip.Addr{
+		netip.MustParseAddr("192.0.0.170"),
+		netip.MustParseAddr("192.0.0.171"),
+	}
+
+	// dns64PrefixLengths are the prefix lengths supported by RFC 6052, most
+	// common first.
+	dns64PrefixLengths = []int{96, 64, 56, 48, 40, 32}
+)
+
+var (
+	// dns64Enabled enables synthesizing AAAA records from A records for
+	// names without AAAA records.
+	dns64Enabled atomic.Bool
+
+	dns64Lock sync.Mutex
+
+	// dns64Configured holds the configured prefixes, dns64Discovered the
+	// ones discovered if none are configured. The latter is nil until
+	// discovery ran.
+	dns64Configured []netip.Prefix
+	dns64Discovered []netip.Prefix
+)
+
+// parseDNS64Prefix parses a NAT64 prefix with one of the lengths supported
+// by RFC 6052.
+func parseDNS64Prefix(value string) (netip.Prefix, error) {
+	prefix, err := netip.ParsePrefix(strings.TrimSpace(value))
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+
+	if !prefix.Addr().Is6() || prefix.Addr().Is4In6() {
+		return netip.Prefix{}, errors.New("an IPv6 prefix is required")
+	}
+
+	for _, bits := range dns64PrefixLengths {
+		if prefix.Bits() == bits {
+			return prefix.Masked(), nil
+		}
+	}
+
+	return netip.Prefix{}, fmt.Errorf("unsupported prefix length %d, expected 32, 40, 48, 56, 64 or 96", prefix.Bits())
+}
+
+func setDNS64Prefixes(values []string) {
+	var list []netip.Prefix
+
+	for _, value := range values {
+		prefix, err := parseDNS64Prefix(value)
+		if err != nil {
+			hclog.L().Error("ignoring invalid DNS64 prefix", "prefix", value, "error", err)
+
+			continue
+		}
+
+		list = append(list, prefix)
+	}
+
+	dns64Lock.Lock()
+	dns64Configured = list
+	dns64Discovered = nil
+	dns64Lock.Unlock()
+}
+
+// resetDNS64Discovery discovers the NAT64 prefixes again on the next
+// query, e.g. after the network changed.
+func resetDNS64Discovery() {
+	dns64Lock.Lock()
+	dns64Discovered = nil
+	dns64Lock.Unlock()
+}
+
+// getDNS64Prefixes returns the configured NAT64 prefixes. If there are none,
+// the prefixes are discovered using RFC 7050 on the first call.
+func getDNS64Prefixes(ctx context.Context) []netip.Prefix {
+	dns64Lock.Lock()
+	defer dns64Lock.Unlock()
+
+	if len(dns64Configured) > 0 {
+		return dns64Configured
+	}
+
+	if dns64Discovered == nil {
+		dns64Discovered = discoverDNS64Prefixes(ctx)
+	}
+
+	return dns64Discovered
+}
+
+// discoverDNS64Prefixes resolves ipv4only.arpa using the bootstrap
+// resolvers, which belong to the local network unlike the encrypted
+// servers, and extracts the NAT64 prefixes from the answer. The well-known
+// prefix is returned if discovery fails.
+func discoverDNS64Prefixes(ctx context.Context) []netip.Prefix {
+	bootstrapLock.RLock()
+	configured := len(bootstrapServers) > 0
+	bootstrapLock.RUnlock()
+
+	if !configured {
+		hclog.L().Info("no bootstrap resolvers configured to discover the NAT64 prefix, using the well-known prefix")
+
+		return []netip.Prefix{wellKnownPrefix}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, dns64DiscoveryTimeout)
+	defer cancel()
+
+	addrs, err := bootstrapResolver.LookupNetIP(ctx, "ip6", dns64DiscoveryName)
+	if err != nil {
+		hclog.L().Warn("failed to discover the NAT64 prefix, using the well-known prefix", "error", err)
+
+		return []netip.Prefix{wellKnownPrefix}
+	}
+
+	var prefixes []netip.Prefix
+	for _, addr := range addrs {
+		if prefix, ok := extractDNS64Prefix(addr); ok && !containsPrefix(prefixes, prefix) {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+
+	if len(prefixes) == 0 {
+		hclog.L().Warn("no NAT64 prefix found, using the well-known prefix")
+
+		return []netip.Prefix{wellKnownPrefix}
+	}
+
+	hclog.L().Info("discovered NAT64 prefixes", "prefixes", prefixes)
+
+	return prefixes
+}
+
+// extractDNS64Prefix returns the prefix addr has been synthesized with from
+// one of the addresses of ipv4only.arpa.
+func extractDNS64Prefix(addr netip.Addr) (netip.Prefix, bool) {
+	for _, bits := range dns64PrefixLengths {
+		prefix, err := addr.Prefix(bits)
+		if err != nil {
+			continue
+		}
+
+		for _, known := range dns64DiscoveryAddrs {
+			if embedIPv4(prefix, known) == addr {
+				return prefix, true
+			}
+		}
+	}
+
+	return netip.Prefix{}, false
+}
+
+func containsPrefix(list []netip.Prefix, prefix netip.Prefix) bool {
+	for _, p := range list {
+		if p == prefix {
+			return true
+		}
+	}
+
+	return false
+}
+
+// embedIPv4 embeds v4 into prefix as defined in section 2.2 of RFC 6052.
+// Bits 64 to 71 are left zero.
+func embedIPv4(prefix netip.Prefix, v4 netip.Addr) netip.Addr {
+	b := prefix.Masked().Addr().As16()
+	a := v4.As4()
+
+	switch prefix.Bits() {
+	case 32:
+		copy(b[4:8], a[:])
+	case 40:
+		copy(b[5:8], a[:3])
+		b[9] = a[3]
+	case 48:
+		copy(b[6:8], a[:2])
+		copy(b[9:11], a[2:])
+	case 56:
+		b[7] = a[0]
+		copy(b[9:12], a[1:])
+	case 64:
+		copy(b[9:13], a[:])
+	default:
+		copy(b[12:], a[:])
+	}
+
+	return netip.AddrFrom16(b)
+}
+
+// needsDNS64 reports whether AAAA records must be synthesized for
+// question, that is, DNS64 is enabled and res is an answer without AAAA
+// records.
+func needsDNS64(question *proto.DNSQuestion, res *proto.DNSResponse) bool {
+	if !dns64Enabled.Load() || uint16(question.GetType()) != dns.TypeAAAA {
+		return false
+	}
+
+	if res == nil || res.GetRcode() != dns.RcodeSuccess || reverseIP(question.GetName()) != nil {
+		return false
+	}
+
+	for _, rr := range res.GetRrs() {
+		if uint16(rr.GetType()) == dns.TypeAAAA {
+			return false
+		}
+	}
+
+	return true
+}
+
+// synthesizeDNS64 answers the AAAA question with addresses synthesized from
+// the A records of the name. res and outcome, the answer without AAAA
+// records, are returned if the name has no A records either.
+func synthesizeDNS64(ctx context.Context, question *proto.DNSQuestion, conn *proto.Connection, res *proto.DNSResponse, outcome queryOutcome) (*proto.DNSResponse, queryOutcome, error) {
+	ipv4, ipv4Outcome, err := filteredLookup(ctx, &proto.DNSQuestion{
+		Name:  question.GetName(),
+		Type:  uint32(dns.TypeA),
+		Class: question.GetClass(),
+	}, conn)
+	if err != nil || ipv4 == nil || ipv4.GetRcode() != dns.RcodeSuccess {
+		return res, outcome, nil
+	}
+
+	prefixes := getDNS64Prefixes(ctx)
+
+	var (
+		rrs         []*proto.DNSRR
+		synthesized bool
+	)
+	for _, rr := range ipv4.GetRrs() {
+		if uint16(rr.GetType()) != dns.TypeA {
+			// keep CNAME records leading to the addresses
+			rrs = append(rrs, rr)
+
+			continue
+		}
+
+		v4, ok := netip.AddrFromSlice(rr.GetData())
+		if !ok || !v4.Is4() {
+			continue
+		}
+
+		for _, prefix := range prefixes {
+			addr := embedIPv4(prefix, v4).As16()
+
+			rrs = append(rrs, &proto.DNSRR{
+				Name:  rr.GetName(),
+				Type:  uint32(dns.TypeAAAA),
+				Class: rr.GetClass(),
+				Ttl:   rr.GetTtl(),
+				Data:  addr[:],
+			})
+			synthesized = true
+		}
+	}
+
+	if !synthesized {
+		return res, outcome, nil
+	}
+
+	return &proto.DNSResponse{
+		Rcode: dns.RcodeSuccess,
+		Rrs:   rrs,
+	}, ipv4Outcome, nil
+}
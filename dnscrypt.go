@@ -0,0 +1,566 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/ameshkov/dnscrypt/v2"
+	"github.com/ameshkov/dnscrypt/v2/xsecretbox"
+	"github.com/ameshkov/dnsstamps"
+	"github.com/hashicorp/go-hclog"
+	"github.com/miekg/dns"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+)
+
+const (
+	// defaultTimeout is used for network operations if the context does not
+	// carry a deadline.
+	defaultTimeout = 5 * time.Second
+
+	// certRefreshInterval defines how often the certificates of DNSCrypt
+	// servers are checked for upcoming expiry.
+	certRefreshInterval = 10 * time.Minute
+
+	// certRefreshMargin defines how long before expiry the certificate of
+	// a DNSCrypt server is refreshed.
+	certRefreshMargin = time.Hour
+)
+
+// relayMagic is prepended to each query sent through an anonymized DNSCrypt
+// relay, followed by the IPv6 address and port of the target server.
+var relayMagic = []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x00, 0x00}
+
+// dnscryptTransport sends queries to a DNSCrypt server, optionally through
+// an anonymized DNSCrypt relay.
+type dnscryptTransport struct {
+	name  string
+	stamp dnsstamps.ServerStamp
+	relay *relay
+
+	// info is replaced whenever the server certificate is refreshed.
+	info atomic.Pointer[dnscrypt.ResolverInfo]
+
+	// tcp holds idle TCP connections to the server or relay.
+	tcp *connPool[net.Conn]
+}
+
+func newDNSCryptTransport(name string, stamp dnsstamps.ServerStamp, relay *relay, info *dnscrypt.ResolverInfo) *dnscryptTransport {
+	t := &dnscryptTransport{
+		name:  name,
+		stamp: stamp,
+		relay: relay,
+		tcp:   newConnPool[net.Conn](),
+	}
+	t.info.Store(info)
+
+	return t
+}
+
+func (t *dnscryptTransport) exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	info := t.info.Load()
+
+	// never use an expired certificate, even if the background refresh
+	// did not yet succeed.
+	if certExpiresWithin(info.ResolverCert, 0) {
+		if err := t.refresh(ctx); err != nil {
+			return nil, err
+		}
+
+		info = t.info.Load()
+	}
+
+	// proxies only support TCP
+	if proxyEnabled() || networkFor(t.name, t.stamp.ProviderName) == "tcp" {
+		return t.exchangeTCP(ctx, info, req)
+	}
+
+	res, err := exchangeEncrypted(ctx, "udp", info, t.relay, req)
+	if err != nil || !res.Truncated {
+		return res, err
+	}
+
+	// DNSCrypt servers truncate responses that are larger than the query
+	// so retry over TCP.
+	return t.exchangeTCP(ctx, info, req)
+}
+
+// exchangeTCP sends req to the server over TCP, re-using idle connections
+// and negotiating edns-tcp-keepalive.
+func (t *dnscryptTransport) exchangeTCP(ctx context.Context, info *dnscrypt.ResolverInfo, req *dns.Msg) (*dns.Msg, error) {
+	req = withTCPKeepalive(req)
+
+	conn, reused := t.tcp.get()
+	if !reused {
+		var err error
+		conn, err = t.dialTCP(ctx, info)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	res, err := exchangeEncryptedConn(ctx, conn, info, t.relay, req)
+	if err != nil && reused {
+		// the server might have closed the idle connection so retry
+		// once using a new one.
+		conn, err = t.dialTCP(ctx, info)
+		if err != nil {
+			return nil, err
+		}
+
+		res, err = exchangeEncryptedConn(ctx, conn, info, t.relay, req)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	t.tcp.put(conn, keepaliveTimeout(res))
+
+	return res, nil
+}
+
+// dialTCP connects to the server, or to the relay if one is used.
+func (t *dnscryptTransport) dialTCP(ctx context.Context, info *dnscrypt.ResolverInfo) (net.Conn, error) {
+	addr := info.ServerAddress
+	if t.relay != nil {
+		addr = t.relay.addr
+	}
+
+	return dialNetwork(ctx, "tcp", addr)
+}
+
+// refresh fetches the current certificate of the server and replaces
+// the resolver information used for new queries. Queries in flight keep
+// using the previous information.
+func (t *dnscryptTransport) refresh(ctx context.Context) error {
+	info, err := dialStamp(ctx, t.stamp, t.relay, networkFor(t.name, t.stamp.ProviderName))
+	if err != nil {
+		return err
+	}
+
+	t.info.Store(info)
+	storeCachedCert(t.stamp, info.ResolverCert, t.relay)
+
+	return nil
+}
+
+// certExpiresWithin returns true if cert expires within d.
+func certExpiresWithin(cert *dnscrypt.Cert, d time.Duration) bool {
+	return time.Now().Add(d).After(time.Unix(int64(cert.NotAfter), 0))
+}
+
+// refreshCertificates periodically refreshes the certificates of all
+// DNSCrypt servers that are about to expire.
+func refreshCertificates(ctx context.Context) {
+	ticker := time.NewTicker(certRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		resolverLock.RLock()
+		list := servers
+		resolverLock.RUnlock()
+
+		for _, srv := range list {
+			t, ok := srv.transport.(*dnscryptTransport)
+			if !ok || !certExpiresWithin(t.info.Load().ResolverCert, certRefreshMargin) {
+				continue
+			}
+
+			dialCtx, cancel := context.WithTimeout(ctx, defaultTimeout)
+			err := t.refresh(dialCtx)
+			cancel()
+
+			if err != nil {
+				hclog.L().Error("failed to refresh DNSCrypt certificate", "server", t.name, "error", err)
+
+				continue
+			}
+
+			hclog.L().Info("refreshed DNSCrypt certificate", "server", t.name, "serial", t.info.Load().ResolverCert.Serial)
+		}
+	}
+}
+
+// dialDNSCrypt dials the DNSCrypt server described by stamp. If relays are
+// configured for the server, they are tried in random order until the
+// certificate could be fetched through one of them.
+func dialDNSCrypt(name string, stamp dnsstamps.ServerStamp) (*dnscryptTransport, error) {
+	relays := relaysFor(name, stamp.ProviderName)
+
+	if t := transportFromCache(name, stamp, relays); t != nil {
+		return t, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancel()
+
+	if len(relays) == 0 {
+		info, err := dialStamp(ctx, stamp, nil, networkFor(name, stamp.ProviderName))
+		if err != nil {
+			return nil, err
+		}
+
+		storeCachedCert(stamp, info.ResolverCert, nil)
+
+		return newDNSCryptTransport(name, stamp, nil, info), nil
+	}
+
+	var err error
+	for _, r := range relays {
+		var info *dnscrypt.ResolverInfo
+		info, err = dialStamp(ctx, stamp, r, networkFor(name, stamp.ProviderName))
+		if err != nil {
+			hclog.L().Warn("failed to dial server through relay", "server", name, "relay", r.name, "error", err)
+
+			continue
+		}
+
+		storeCachedCert(stamp, info.ResolverCert, r)
+
+		return newDNSCryptTransport(name, stamp, r, info), nil
+	}
+
+	return nil, fmt.Errorf("failed to dial %s through any relay: %w", name, err)
+}
+
+// dialStamp fetches and validates the certificate of the DNSCrypt server
+// described by stamp using network. If relay is not nil the certificate is
+// fetched through the relay.
+func dialStamp(ctx context.Context, stamp dnsstamps.ServerStamp, relay *relay, network string) (*dnscrypt.ResolverInfo, error) {
+	if stamp.Proto != dnsstamps.StampProtoTypeDNSCrypt {
+		return nil, dnscrypt.ErrInvalidDNSStamp
+	}
+
+	cert, err := fetchCert(ctx, stamp, relay, network)
+	if err != nil {
+		return nil, err
+	}
+
+	return newResolverInfo(stamp, cert)
+}
+
+// newResolverInfo generates a new client key pair and computes the key
+// shared with the DNSCrypt server described by stamp and cert.
+func newResolverInfo(stamp dnsstamps.ServerStamp, cert *dnscrypt.Cert) (*dnscrypt.ResolverInfo, error) {
+	info := &dnscrypt.ResolverInfo{
+		ServerPublicKey: stamp.ServerPk,
+		ServerAddress:   stamp.ServerAddrStr,
+		ProviderName:    stamp.ProviderName,
+		ResolverCert:    cert,
+	}
+
+	if _, err := io.ReadFull(rand.Reader, info.SecretKey[:]); err != nil {
+		return nil, err
+	}
+	curve25519.ScalarBaseMult(&info.PublicKey, &info.SecretKey)
+
+	var err error
+	switch cert.EsVersion {
+	case dnscrypt.XChacha20Poly1305:
+		info.SharedKey, err = xsecretbox.SharedKey(info.SecretKey, cert.ResolverPk)
+		if err != nil {
+			return nil, err
+		}
+	case dnscrypt.XSalsa20Poly1305:
+		box.Precompute(&info.SharedKey, &cert.ResolverPk, &info.SecretKey)
+	default:
+		return nil, dnscrypt.ErrEsVersion
+	}
+
+	return info, nil
+}
+
+// fetchCert queries the certificates published by the DNSCrypt server
+// described by stamp and returns the one with the highest serial that
+// has a valid date and signature.
+func fetchCert(ctx context.Context, stamp dnsstamps.ServerStamp, relay *relay, network string) (*dnscrypt.Cert, error) {
+	query := new(dns.Msg)
+	query.SetQuestion(dns.Fqdn(stamp.ProviderName), dns.TypeTXT)
+
+	packet, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := roundTrip(ctx, network, stamp.ServerAddrStr, relay, packet)
+	if err != nil {
+		return nil, err
+	}
+
+	res := new(dns.Msg)
+	if err := res.Unpack(response); err != nil {
+		return nil, err
+	}
+
+	if res.Rcode != dns.RcodeSuccess {
+		return nil, dnscrypt.ErrFailedToFetchCert
+	}
+
+	var (
+		current *dnscrypt.Cert
+		certErr error = dnscrypt.ErrFailedToFetchCert
+	)
+	for _, rr := range res.Answer {
+		txt, ok := rr.(*dns.TXT)
+		if !ok {
+			continue
+		}
+
+		cert := new(dnscrypt.Cert)
+		if err := cert.Deserialize(unescapeTXT(strings.Join(txt.Txt, ""))); err != nil {
+			certErr = err
+
+			continue
+		}
+
+		if !cert.VerifyDate() {
+			certErr = dnscrypt.ErrInvalidDate
+
+			continue
+		}
+
+		if !cert.VerifySignature(stamp.ServerPk) {
+			certErr = dnscrypt.ErrInvalidCertSignature
+
+			continue
+		}
+
+		if current == nil ||
+			cert.Serial > current.Serial ||
+			(cert.Serial == current.Serial && cert.EsVersion > current.EsVersion) {
+			current = cert
+		}
+	}
+
+	if current == nil {
+		return nil, certErr
+	}
+
+	return current, nil
+}
+
+// exchangeEncrypted encrypts req using info, sends it to the DNSCrypt
+// server (optionally through relay) and decrypts the response.
+func exchangeEncrypted(ctx context.Context, network string, info *dnscrypt.ResolverInfo, relay *relay, req *dns.Msg) (*dns.Msg, error) {
+	query, err := encryptQuery(info, req)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := roundTrip(ctx, network, info.ServerAddress, relay, query)
+	if err != nil {
+		return nil, err
+	}
+
+	return decryptResponse(info, response)
+}
+
+// exchangeEncryptedConn is like exchangeEncrypted but uses the existing
+// TCP connection conn. conn is closed if the exchange fails.
+func exchangeEncryptedConn(ctx context.Context, conn net.Conn, info *dnscrypt.ResolverInfo, relay *relay, req *dns.Msg) (*dns.Msg, error) {
+	query, err := encryptQuery(info, req)
+	if err != nil {
+		return nil, err
+	}
+
+	if relay != nil {
+		header, err := relayHeader(info.ServerAddress)
+		if err != nil {
+			return nil, err
+		}
+
+		query = append(header, query...)
+	}
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(defaultTimeout)
+	}
+	_ = conn.SetDeadline(deadline)
+
+	response, err := roundTripTCP(conn, query)
+	if err != nil {
+		conn.Close()
+
+		return nil, err
+	}
+
+	res, err := decryptResponse(info, response)
+	if err != nil {
+		conn.Close()
+
+		return nil, err
+	}
+
+	return res, nil
+}
+
+func encryptQuery(info *dnscrypt.ResolverInfo, req *dns.Msg) ([]byte, error) {
+	packet, err := req.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	q := dnscrypt.EncryptedQuery{
+		EsVersion:   info.ResolverCert.EsVersion,
+		ClientMagic: info.ResolverCert.ClientMagic,
+		ClientPk:    info.PublicKey,
+	}
+
+	return q.Encrypt(packet, info.SharedKey)
+}
+
+func decryptResponse(info *dnscrypt.ResolverInfo, response []byte) (*dns.Msg, error) {
+	r := dnscrypt.EncryptedResponse{
+		EsVersion: info.ResolverCert.EsVersion,
+	}
+
+	plain, err := r.Decrypt(response, info.SharedKey)
+	if err != nil {
+		return nil, err
+	}
+
+	res := new(dns.Msg)
+	if err := res.Unpack(plain); err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// roundTrip sends payload to serverAddr (or to relay, if set) using
+// network and returns the response.
+func roundTrip(ctx context.Context, network string, serverAddr string, relay *relay, payload []byte) ([]byte, error) {
+	addr := serverAddr
+	if relay != nil {
+		header, err := relayHeader(serverAddr)
+		if err != nil {
+			return nil, err
+		}
+
+		payload = append(header, payload...)
+		addr = relay.addr
+	}
+
+	// proxies only support TCP
+	if proxyEnabled() {
+		network = "tcp"
+	}
+
+	conn, err := dialNetwork(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(defaultTimeout)
+	}
+	_ = conn.SetDeadline(deadline)
+
+	if network == "tcp" {
+		return roundTripTCP(conn, payload)
+	}
+
+	if _, err := conn.Write(payload); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, dns.MaxMsgSize)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf[:n], nil
+}
+
+// roundTripTCP writes payload to conn and reads the response, both
+// prefixed with their length.
+func roundTripTCP(conn net.Conn, payload []byte) ([]byte, error) {
+	msg := make([]byte, 2+len(payload))
+	binary.BigEndian.PutUint16(msg, uint16(len(payload)))
+	copy(msg[2:], payload)
+
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+
+	response := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return nil, err
+	}
+
+	return response, nil
+}
+
+// relayHeader returns the header that must be prepended to queries that
+// are sent to the server at serverAddr through a relay.
+func relayHeader(serverAddr string) ([]byte, error) {
+	addr, err := net.ResolveUDPAddr("udp", serverAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	ip := addr.IP.To16()
+	if ip == nil {
+		return nil, fmt.Errorf("invalid server address %q", serverAddr)
+	}
+
+	header := make([]byte, 0, len(relayMagic)+net.IPv6len+2)
+	header = append(header, relayMagic...)
+	header = append(header, ip...)
+	header = binary.BigEndian.AppendUint16(header, uint16(addr.Port))
+
+	return header, nil
+}
+
+// unescapeTXT reverses the escaping applied by miekg/dns to TXT record
+// strings.
+func unescapeTXT(s string) []byte {
+	result := make([]byte, 0, len(s))
+
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			result = append(result, s[i])
+
+			continue
+		}
+
+		i++
+		if i+2 < len(s) && isDigit(s[i]) && isDigit(s[i+1]) && isDigit(s[i+2]) {
+			result = append(result, (s[i]-'0')*100+(s[i+1]-'0')*10+(s[i+2]-'0'))
+			i += 2
+
+			continue
+		}
+
+		result = append(result, s[i])
+	}
+
+	return result
+}
+
+func isDigit(b byte) bool {
+	return b >= '0' && b <= '9'
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"sync/atomic"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/miekg/dns"
+)
+
+// dnssecMode defines how DNSSEC is requested from upstream servers.
+type dnssecMode string
+
+const (
+	// dnssecOff does not request DNSSEC records.
+	dnssecOff = dnssecMode("off")
+
+	// dnssecOn sets the DO bit so validating servers authenticate the
+	// answer.
+	dnssecOn = dnssecMode("on")
+
+	// dnssecStrict sets the DO bit and rejects all answers that have not
+	// been authenticated by the server.
+	dnssecStrict = dnssecMode("strict")
+)
+
+// errNotAuthenticated is returned in strict DNSSEC mode for answers
+// without the AD flag.
+var errNotAuthenticated = errors.New("answer has not been authenticated using DNSSEC")
+
+var currentDNSSEC atomic.Value
+
+func setDNSSECMode(value string) {
+	mode := dnssecMode(value)
+
+	switch mode {
+	case dnssecOff, dnssecOn, dnssecStrict:
+	case "":
+		mode = dnssecOn
+	default:
+		hclog.L().Error("unknown DNSSEC mode, using on", "mode", value)
+
+		mode = dnssecOn
+	}
+
+	currentDNSSEC.Store(mode)
+}
+
+func getDNSSECMode() dnssecMode {
+	if m, ok := currentDNSSEC.Load().(dnssecMode); ok {
+		return m
+	}
+
+	return dnssecOn
+}
+
+// requestDNSSEC sets the DO bit on req if DNSSEC is enabled. It requires
+// an OPT record.
+func requestDNSSEC(req *dns.Msg) {
+	if getDNSSECMode() == dnssecOff {
+		return
+	}
+
+	if opt := req.IsEdns0(); opt != nil {
+		opt.SetDo()
+	}
+}
+
+// checkDNSSEC strips the DNSSEC records that have been added to res because
+// of the DO bit and returns errNotAuthenticated if res must be rejected in
+// strict mode.
+func checkDNSSEC(res *dns.Msg, question dns.Question) error {
+	if getDNSSECMode() == dnssecOff {
+		return nil
+	}
+
+	answers := res.Answer[:0]
+	for _, rr := range res.Answer {
+		switch rr.Header().Rrtype {
+		case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+			if rr.Header().Rrtype != question.Qtype {
+				continue
+			}
+		}
+
+		answers = append(answers, rr)
+	}
+	res.Answer = answers
+
+	// Portmaster has no way to receive the AD flag
+	hclog.L().Trace("DNSSEC status", "name", question.Name, "authenticated", res.AuthenticatedData)
+
+	if getDNSSECMode() == dnssecStrict && !res.AuthenticatedData {
+		return errNotAuthenticated
+	}
+
+	return nil
+}
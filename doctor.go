@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/ameshkov/dnsstamps"
+	"github.com/miekg/dns"
+	"github.com/safing/portmaster/plugin/shared"
+	"github.com/spf13/cobra"
+)
+
+const (
+	// maxClockSkew is the clock difference to a remote server above which
+	// the doctor command warns about the local clock.
+	maxClockSkew = time.Minute
+
+	// certExpiryWarning is the remaining validity of a DNSCrypt
+	// certificate below which the doctor command warns about it.
+	certExpiryWarning = 24 * time.Hour
+)
+
+// doctorReport prints the findings of the doctor command.
+type doctorReport struct {
+	out    io.Writer
+	failed bool
+}
+
+func (r *doctorReport) ok(format string, args ...any) {
+	fmt.Fprintf(r.out, "[OK]   %s\n", fmt.Sprintf(format, args...))
+}
+
+// warn reports a problem that does not prevent the plugin from working
+// together with a hint on how to solve it.
+func (r *doctorReport) warn(hint, format string, args ...any) {
+	fmt.Fprintf(r.out, "[WARN] %s\n       %s\n", fmt.Sprintf(format, args...), hint)
+}
+
+// fail reports a problem that prevents the plugin from working together
+// with a hint on how to solve it.
+func (r *doctorReport) fail(hint, format string, args ...any) {
+	r.failed = true
+
+	fmt.Fprintf(r.out, "[FAIL] %s\n       %s\n", fmt.Sprintf(format, args...), hint)
+}
+
+// doctorCommand returns the command that diagnoses common problems of the
+// plugin installation and configuration.
+func doctorCommand() *cobra.Command {
+	var flags installFlags
+
+	cmd := &cobra.Command{
+		Use:   "doctor",
+		Short: "Diagnose problems with the plugin installation, configuration and servers",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			cmd.SilenceErrors = true
+
+			report := &doctorReport{out: cmd.OutOrStdout()}
+
+			checkRegistration(report, flags)
+			if checkConfiguration(cmd.Context(), report, flags) {
+				checkClock(cmd.Context(), report)
+
+				for _, cfg := range configuredServers() {
+					checkServer(cmd.Context(), report, cfg)
+				}
+			}
+
+			if report.failed {
+				return errors.New("problems found")
+			}
+
+			return nil
+		},
+	}
+
+	flags.register(cmd)
+
+	return cmd
+}
+
+// checkRegistration checks that the plugin is installed and registered as
+// a resolver in plugins.json.
+func checkRegistration(report *doctorReport, flags installFlags) {
+	installHint := "Run the install command using the same --data and --name."
+
+	if _, err := os.Stat(filepath.Join(flags.installDir, "plugins", flags.pluginName)); err != nil {
+		report.fail(installHint, "plugin executable not found: %s", err)
+	} else {
+		report.ok("plugin executable installed")
+	}
+
+	cfgs, err := readPluginConfigs(filepath.Join(flags.installDir, "plugins.json"))
+	if err != nil {
+		report.fail("Fix or remove plugins.json and run the install command again.", "%s", err)
+
+		return
+	}
+
+	idx := slices.IndexFunc(cfgs, func(cfg shared.PluginConfig) bool {
+		return cfg.Name == flags.pluginName
+	})
+
+	switch {
+	case idx < 0:
+		report.fail(installHint, "%s is not registered in plugins.json", flags.pluginName)
+	case !slices.Contains(cfgs[idx].Types, shared.PluginTypeResolver):
+		report.fail(installHint, "%s is registered in plugins.json but not as a resolver", flags.pluginName)
+	default:
+		report.ok("registered as resolver in plugins.json")
+	}
+
+	if idx >= 0 && !slices.Contains(cfgs[idx].Types, shared.PluginTypeDecider) {
+		report.warn(installHint, "%s is not registered as decider in plugins.json, connections to blocked domains are only blocked when resolved by the plugin", flags.pluginName)
+	}
+
+	if idx >= 0 && !slices.Contains(cfgs[idx].Types, shared.PluginTypeReporter) {
+		report.warn(installHint, "%s is not registered as reporter in plugins.json, the connection log stays empty", flags.pluginName)
+	}
+}
+
+// checkConfiguration applies and validates the configuration of the plugin.
+// It returns false if no servers are configured.
+func checkConfiguration(ctx context.Context, report *doctorReport, flags installFlags) bool {
+	config, err := readPortmasterConfig(flags.configFile())
+	if err != nil {
+		report.fail("Fix the syntax of the Portmaster configuration file.", "%s", err)
+
+		return false
+	}
+
+	values := effectiveValues(pluginSection(config, flags.pluginName, false))
+	for _, opt := range configOptions {
+		if val, ok := envOverride(opt); ok {
+			values[opt.Key] = val
+		}
+
+		if opt.validate == nil {
+			continue
+		}
+
+		if err := opt.validate(values[opt.Key]); err != nil {
+			report.warn("Correct the setting in the Portmaster UI.", "setting %q: %s", opt.Name, err)
+		}
+	}
+
+	if !values["enabled"].Bool {
+		report.warn("Enable the plugin in the Portmaster UI.", "the plugin is disabled, queries are resolved by the Portmaster")
+	}
+
+	if err := flags.applyConfig(ctx); err != nil {
+		report.fail("Check the network connection and the resolver lists setting.", "failed to download resolver lists: %s", err)
+
+		return false
+	}
+
+	configs := configuredServers()
+	if len(configs) == 0 {
+		report.fail("Add server stamps or server names in the Portmaster UI.", "no servers configured")
+
+		return false
+	}
+
+	report.ok("configured servers: %d", len(configs))
+
+	return true
+}
+
+// checkClock compares the local clock with the time reported by the
+// servers of the resolver lists. Certificates are validated using the
+// local clock, so a wrong clock breaks all servers.
+func checkClock(ctx context.Context, report *doctorReport) {
+	sourcesLock.RLock()
+	list := sourceList
+	sourcesLock.RUnlock()
+
+	if len(list) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, list[0].url, nil)
+	if err != nil {
+		return
+	}
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		report.warn("Check the network connection.", "failed to check the clock: %s", err)
+
+		return
+	}
+	res.Body.Close()
+
+	remote, err := http.ParseTime(res.Header.Get("Date"))
+	if err != nil {
+		return
+	}
+
+	skew := time.Since(remote).Round(time.Second)
+	if skew.Abs() > maxClockSkew {
+		report.fail("Synchronize the system clock, certificates cannot be validated otherwise.", "the local clock is off by %s", skew)
+
+		return
+	}
+
+	report.ok("clock in sync")
+}
+
+// checkServer checks that the server described by cfg is reachable and has
+// a valid certificate. DNSCrypt servers are checked over UDP and TCP.
+func checkServer(ctx context.Context, report *doctorReport, cfg serverConfig) {
+	stamp, err := dnsstamps.NewServerStampFromString(cfg.stamp)
+	if err == nil && stamp.Proto == dnsstamps.StampProtoTypeDNSCrypt {
+		checkDNSCryptServer(ctx, report, cfg, stamp)
+
+		return
+	}
+
+	srv, err := dialServer(cfg)
+	if err != nil {
+		report.fail("Check the server stamp.", "%s: %s", cfg.name, err)
+
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	req := new(dns.Msg)
+	req.SetQuestion(".", dns.TypeNS)
+
+	started := time.Now()
+	_, err = srv.exchange(ctx, req)
+
+	switch {
+	case isCertificateError(err):
+		report.fail("Check the SPKI pins of the server and whether a proxy or firewall intercepts TLS connections.", "%s: invalid certificate: %s", cfg.name, err)
+	case err != nil:
+		report.fail("Check that the server is up and that your network does not block it.", "%s: unreachable: %s", cfg.name, err)
+	default:
+		report.ok("%s: reachable, %s", cfg.name, time.Since(started).Round(time.Millisecond))
+	}
+}
+
+// checkDNSCryptServer fetches the certificate of a DNSCrypt server over UDP
+// and TCP, through the first configured relay if any.
+func checkDNSCryptServer(ctx context.Context, report *doctorReport, cfg serverConfig, stamp dnsstamps.ServerStamp) {
+	var r *relay
+	if relays := relaysFor(cfg.name, stamp.ProviderName); len(relays) > 0 {
+		r = relays[0]
+	}
+
+	results := make(map[string]error)
+	for _, network := range []string{"udp", "tcp"} {
+		ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+		info, err := dialStamp(ctx, stamp, r, network)
+		cancel()
+
+		if err != nil {
+			results[network] = classifyDialError(err)
+
+			continue
+		}
+
+		results[network] = nil
+
+		if network != "udp" {
+			continue
+		}
+
+		expires := time.Unix(int64(info.ResolverCert.NotAfter), 0)
+		if remaining := time.Until(expires); remaining < certExpiryWarning {
+			report.warn("The certificate should be rotated by the operator soon, consider using another server.", "%s: certificate expires in %s", cfg.name, remaining.Round(time.Minute))
+		}
+	}
+
+	udpErr, tcpErr := results["udp"], results["tcp"]
+
+	switch {
+	case udpErr == nil && tcpErr == nil:
+		report.ok("%s: reachable over UDP and TCP, certificate valid", cfg.name)
+	case errors.Is(udpErr, errCertificate) || errors.Is(tcpErr, errCertificate):
+		err := udpErr
+		if !errors.Is(err, errCertificate) {
+			err = tcpErr
+		}
+
+		report.fail("Check the system clock and the public key in the server stamp.", "%s: %s", cfg.name, err)
+	case udpErr != nil && tcpErr == nil:
+		report.warn(fmt.Sprintf("Your network probably blocks UDP, set \"%s tcp\" in the server protocols setting.", cfg.name), "%s: unreachable over UDP but reachable over TCP: %s", cfg.name, udpErr)
+	case udpErr == nil && tcpErr != nil:
+		report.warn("Large responses are truncated over UDP and cannot be retried over TCP.", "%s: reachable over UDP but not over TCP: %s", cfg.name, tcpErr)
+	default:
+		report.fail("Check that the server is up and that your network does not block it.", "%s: %s", cfg.name, udpErr)
+	}
+}
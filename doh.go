@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/ameshkov/dnsstamps"
+	"github.com/miekg/dns"
+)
+
+// dohTransport sends queries to a DNS-over-HTTPS server as defined in
+// RFC 8484.
+type dohTransport struct {
+	url    string
+	client *http.Client
+}
+
+// newDoHTransport creates a new DNS-over-HTTPS transport for the server
+// described by stamp. If the stamp contains an IP address, connections are
+// made to that address instead of resolving the server hostname.
+func newDoHTransport(stamp dnsstamps.ServerStamp) (*dohTransport, error) {
+	if stamp.ProviderName == "" {
+		return nil, fmt.Errorf("DoH stamp does not contain a hostname")
+	}
+
+	u := url.URL{
+		Scheme: "https",
+		Host:   stamp.ProviderName,
+		Path:   stamp.Path,
+	}
+
+	host := u.Hostname()
+	port := u.Port()
+	if port == "" {
+		port = "443"
+	}
+
+	dialAddr := net.JoinHostPort(host, port)
+	if stamp.ServerAddrStr != "" {
+		if ip, _, err := net.SplitHostPort(stamp.ServerAddrStr); err == nil {
+			dialAddr = net.JoinHostPort(ip, port)
+		} else {
+			dialAddr = net.JoinHostPort(stamp.ServerAddrStr, port)
+		}
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName: host,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if len(stamp.Hashes) > 0 {
+		tlsConfig.VerifyPeerCertificate = verifyCertHashes(stamp.Hashes)
+	}
+
+	transport := &http.Transport{
+		TLSClientConfig:     tlsConfig,
+		ForceAttemptHTTP2:   true,
+		MaxIdleConns:        1,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: defaultTimeout,
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return dialUpstream(ctx, network, dialAddr)
+		},
+	}
+
+	return &dohTransport{
+		url: u.String(),
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   defaultTimeout,
+		},
+	}, nil
+}
+
+func (t *dohTransport) exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	// RFC 8484 recommends to use a message ID of zero
+	msg := req.Copy()
+	msg.Id = 0
+
+	packet, err := msg.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, t.url, bytes.NewReader(packet))
+	if err != nil {
+		return nil, err
+	}
+
+	httpReq.Header.Set("Content-Type", "application/dns-message")
+	httpReq.Header.Set("Accept", "application/dns-message")
+
+	httpRes, err := t.client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer httpRes.Body.Close()
+
+	if httpRes.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected HTTP status %s", httpRes.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(httpRes.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, err
+	}
+
+	res := new(dns.Msg)
+	if err := res.Unpack(body); err != nil {
+		return nil, err
+	}
+
+	res.Id = req.Id
+
+	return res, nil
+}
+
+// verifyCertHashes returns a certificate verification function that
+// requires the SHA256 digest of at least one TBS certificate of the
+// verified chain to match one of hashes.
+func verifyCertHashes(hashes [][]byte) func([][]byte, [][]*x509.Certificate) error {
+	return func(_ [][]byte, chains [][]*x509.Certificate) error {
+		for _, chain := range chains {
+			for _, cert := range chain {
+				digest := sha256.Sum256(cert.RawTBSCertificate)
+
+				for _, hash := range hashes {
+					if bytes.Equal(digest[:], hash) {
+						return nil
+					}
+				}
+			}
+		}
+
+		return errors.New("no certificate matches the hashes of the server stamp")
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ameshkov/dnsstamps"
+	"github.com/hashicorp/go-hclog"
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+// quicBlockedDuration defines how long the DNS-over-TLS fallback is used
+// after QUIC connections to a server failed before QUIC is tried again.
+const quicBlockedDuration = 5 * time.Minute
+
+// errQUICDialing is returned by getConn while another query dials the
+// QUIC connection.
+var errQUICDialing = errors.New("QUIC connection is being dialed")
+
+// doqTransport sends queries to a DNS-over-QUIC server as defined in
+// RFC 9250. Each query is sent on a dedicated stream of a shared QUIC
+// connection. If the server cannot be reached using QUIC, queries are sent
+// using DNS-over-TLS to the same host instead.
+type doqTransport struct {
+	addr      string
+	tlsConfig *tls.Config
+	fallback  transport
+
+	lock         sync.Mutex
+	conn         quic.Connection
+	blockedUntil time.Time
+
+	// dialing is set while a new connection is dialed.
+	dialing bool
+}
+
+// newDoQTransport creates a new DNS-over-QUIC transport for the server
+// described by stamp.
+func newDoQTransport(stamp dnsstamps.ServerStamp) (*doqTransport, error) {
+	host := stamp.ProviderName
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	addr := stamp.ServerAddrStr
+	if addr == "" {
+		addr = net.JoinHostPort(host, "853")
+	}
+
+	// dnsstamps uses 784 as the default DoQ port which was used by
+	// pre-standard implementations.
+	if h, port, err := net.SplitHostPort(addr); err == nil && port == "784" {
+		addr = net.JoinHostPort(h, "853")
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName: host,
+		MinVersion: tls.VersionTLS13,
+		NextProtos: []string{"doq"},
+	}
+
+	if len(stamp.Hashes) > 0 {
+		tlsConfig.VerifyPeerCertificate = verifyCertHashes(stamp.Hashes)
+	}
+
+	return newDoQTransportWithFallback(addr, tlsConfig), nil
+}
+
+// parseDoQURL parses a DNS-over-QUIC server in the format
+// "quic://host[:port][?spki=<pin>]".
+func parseDoQURL(value string) (*doqTransport, error) {
+	u, err := url.Parse(value)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme != "quic" || u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid DNS-over-QUIC server %q", value)
+	}
+
+	// re-use the DNS-over-TLS parser for the TLS configuration
+	dot, err := parseDoTURL("tls" + strings.TrimPrefix(value, "quic"))
+	if err != nil {
+		return nil, err
+	}
+
+	port := u.Port()
+	if port == "" {
+		port = "853"
+	}
+
+	tlsConfig := dot.tlsConfig.Clone()
+	tlsConfig.MinVersion = tls.VersionTLS13
+	tlsConfig.NextProtos = []string{"doq"}
+
+	return newDoQTransportWithFallback(net.JoinHostPort(u.Hostname(), port), tlsConfig), nil
+}
+
+func newDoQTransportWithFallback(addr string, tlsConfig *tls.Config) *doqTransport {
+	host, _, _ := net.SplitHostPort(addr)
+
+	fallbackConfig := tlsConfig.Clone()
+	fallbackConfig.MinVersion = tls.VersionTLS12
+	fallbackConfig.NextProtos = nil
+
+	return &doqTransport{
+		addr:      addr,
+		tlsConfig: tlsConfig,
+		fallback: &dotTransport{
+			addr:      net.JoinHostPort(host, "853"),
+			tlsConfig: fallbackConfig,
+			idle:      newConnPool[*dns.Conn](),
+		},
+	}
+}
+
+func (t *doqTransport) exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	// QUIC cannot be sent through the proxy
+	if proxyEnabled() {
+		return t.fallback.exchange(ctx, req)
+	}
+
+	conn, err := t.getConn(ctx)
+	if errors.Is(err, errQUICDialing) {
+		return t.fallback.exchange(ctx, req)
+	}
+
+	if err != nil {
+		if t.markBlocked() {
+			hclog.L().Warn("failed to connect using QUIC, falling back to DNS-over-TLS", "server", t.addr, "error", err)
+		}
+
+		return t.fallback.exchange(ctx, req)
+	}
+
+	res, err := t.exchangeStream(ctx, conn, req)
+	if err != nil {
+		t.closeConn(conn)
+
+		return nil, err
+	}
+
+	return res, nil
+}
+
+func (t *doqTransport) exchangeStream(ctx context.Context, conn quic.Connection, req *dns.Msg) (*dns.Msg, error) {
+	// RFC 9250 requires the message ID to be zero
+	msg := req.Copy()
+	msg.Id = 0
+
+	packet, err := msg.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(defaultTimeout)
+	}
+	_ = stream.SetDeadline(deadline)
+
+	payload := make([]byte, 2+len(packet))
+	binary.BigEndian.PutUint16(payload, uint16(len(packet)))
+	copy(payload[2:], packet)
+
+	if _, err := stream.Write(payload); err != nil {
+		return nil, err
+	}
+
+	// closing the stream signals the server that no more data will be
+	// sent.
+	if err := stream.Close(); err != nil {
+		return nil, err
+	}
+
+	var length [2]byte
+	if _, err := io.ReadFull(stream, length[:]); err != nil {
+		return nil, err
+	}
+
+	response := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(stream, response); err != nil {
+		return nil, err
+	}
+
+	res := new(dns.Msg)
+	if err := res.Unpack(response); err != nil {
+		return nil, err
+	}
+
+	res.Id = req.Id
+
+	return res, nil
+}
+
+// getConn returns the shared QUIC connection and dials a new one if
+// required. It fails immediately while QUIC is considered blocked, and
+// with errQUICDialing while another query dials the connection so a slow
+// handshake doesn't stall concurrent queries.
+func (t *doqTransport) getConn(ctx context.Context) (quic.Connection, error) {
+	t.lock.Lock()
+	if time.Now().Before(t.blockedUntil) {
+		t.lock.Unlock()
+
+		return nil, fmt.Errorf("QUIC is blocked")
+	}
+
+	if t.conn != nil {
+		select {
+		case <-t.conn.Context().Done():
+			t.conn = nil
+		default:
+			conn := t.conn
+			t.lock.Unlock()
+
+			return conn, nil
+		}
+	}
+
+	if t.dialing {
+		t.lock.Unlock()
+
+		return nil, errQUICDialing
+	}
+
+	t.dialing = true
+	t.lock.Unlock()
+
+	conn, err := t.dial(ctx)
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.dialing = false
+	if err != nil {
+		return nil, err
+	}
+
+	t.conn = conn
+
+	return conn, nil
+}
+
+// dial connects to the server using QUIC.
+func (t *doqTransport) dial(ctx context.Context) (quic.Connection, error) {
+	addr, err := resolveUpstreamAddr(ctx, t.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return quic.DialAddr(ctx, addr, t.tlsConfig, &quic.Config{
+		HandshakeIdleTimeout: defaultTimeout,
+		MaxIdleTimeout:       90 * time.Second,
+	})
+}
+
+func (t *doqTransport) closeConn(conn quic.Connection) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.conn == conn {
+		t.conn = nil
+	}
+
+	_ = conn.CloseWithError(0, "")
+}
+
+// markBlocked marks QUIC as blocked and reports whether it was not
+// blocked before.
+func (t *doqTransport) markBlocked() bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	wasBlocked := time.Now().Before(t.blockedUntil)
+	t.blockedUntil = time.Now().Add(quicBlockedDuration)
+
+	return !wasBlocked
+}
+
+// isDoQURL returns true if value should be parsed using parseDoQURL.
+func isDoQURL(value string) bool {
+	return strings.HasPrefix(value, "quic://")
+}
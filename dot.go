@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ameshkov/dnsstamps"
+	"github.com/miekg/dns"
+)
+
+// dotTransport sends queries to a DNS-over-TLS server as defined in
+// RFC 7858. Connections are kept open and re-used for subsequent queries.
+type dotTransport struct {
+	addr      string
+	tlsConfig *tls.Config
+
+	idle *connPool[*dns.Conn]
+}
+
+// newDoTTransport creates a new DNS-over-TLS transport for the server
+// described by stamp.
+func newDoTTransport(stamp dnsstamps.ServerStamp) (*dotTransport, error) {
+	host := stamp.ProviderName
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	addr := stamp.ServerAddrStr
+	if addr == "" {
+		addr = net.JoinHostPort(host, "853")
+	}
+
+	// dnsstamps uses 843 instead of 853 as the default DoT port
+	if h, port, err := net.SplitHostPort(addr); err == nil && port == "843" {
+		addr = net.JoinHostPort(h, "853")
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName: host,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if len(stamp.Hashes) > 0 {
+		tlsConfig.VerifyPeerCertificate = verifyCertHashes(stamp.Hashes)
+	}
+
+	return &dotTransport{
+		addr:      addr,
+		tlsConfig: tlsConfig,
+		idle:      newConnPool[*dns.Conn](),
+	}, nil
+}
+
+// parseDoTURL parses a DNS-over-TLS server in the format
+// "tls://host[:port][?spki=<pin>]" where pin is the base64 encoded SHA256
+// digest of the subject public key info of one of the certificates in
+// the chain. The spki parameter may be specified multiple times.
+func parseDoTURL(value string) (*dotTransport, error) {
+	u, err := url.Parse(value)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme != "tls" || u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid DNS-over-TLS server %q", value)
+	}
+
+	port := u.Port()
+	if port == "" {
+		port = "853"
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName: u.Hostname(),
+		MinVersion: tls.VersionTLS12,
+	}
+
+	// The query is parsed manually since base64 encoded pins may contain
+	// "+" which would otherwise be decoded as a space.
+	var hashes [][]byte
+	for _, param := range strings.Split(u.RawQuery, "&") {
+		if !strings.HasPrefix(param, "spki=") {
+			continue
+		}
+
+		pin, err := url.PathUnescape(strings.TrimPrefix(param, "spki="))
+		if err != nil {
+			return nil, fmt.Errorf("invalid SPKI pin %q: %w", param, err)
+		}
+
+		hash, err := base64.StdEncoding.DecodeString(pin)
+		if err != nil || len(hash) != sha256.Size {
+			return nil, fmt.Errorf("invalid SPKI pin %q", pin)
+		}
+
+		hashes = append(hashes, hash)
+	}
+
+	if len(hashes) > 0 {
+		tlsConfig.VerifyPeerCertificate = verifySPKIPins(hashes)
+	}
+
+	return &dotTransport{
+		addr:      net.JoinHostPort(u.Hostname(), port),
+		tlsConfig: tlsConfig,
+		idle:      newConnPool[*dns.Conn](),
+	}, nil
+}
+
+func (t *dotTransport) exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	req = withTCPKeepalive(req)
+
+	conn, reused, err := t.getConn(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := t.exchangeConn(ctx, conn, req)
+	if err != nil && reused {
+		// the server might have closed the idle connection so retry
+		// once using a new one.
+		conn, err = t.dial(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		res, err = t.exchangeConn(ctx, conn, req)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	t.idle.put(conn, keepaliveTimeout(res))
+
+	return res, nil
+}
+
+func (t *dotTransport) exchangeConn(ctx context.Context, conn *dns.Conn, req *dns.Msg) (*dns.Msg, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(defaultTimeout)
+	}
+	_ = conn.SetDeadline(deadline)
+
+	if err := conn.WriteMsg(req); err != nil {
+		conn.Close()
+
+		return nil, err
+	}
+
+	res, err := conn.ReadMsg()
+	if err != nil {
+		conn.Close()
+
+		return nil, err
+	}
+
+	if res.Id != req.Id {
+		conn.Close()
+
+		return nil, dns.ErrId
+	}
+
+	return res, nil
+}
+
+// getConn returns an idle connection or dials a new one. The returned
+// bool is true if the connection has been used before.
+func (t *dotTransport) getConn(ctx context.Context) (*dns.Conn, bool, error) {
+	if conn, ok := t.idle.get(); ok {
+		return conn, true, nil
+	}
+
+	conn, err := t.dial(ctx)
+
+	return conn, false, err
+}
+
+func (t *dotTransport) dial(ctx context.Context) (*dns.Conn, error) {
+	raw, err := dialUpstream(ctx, "tcp", t.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn := tls.Client(raw, t.tlsConfig)
+	if err := conn.HandshakeContext(ctx); err != nil {
+		raw.Close()
+
+		return nil, err
+	}
+
+	return &dns.Conn{Conn: conn}, nil
+}
+
+// errPinMismatch is returned if none of the certificates of a server
+// matches the configured SPKI pins.
+var errPinMismatch = errors.New("no certificate matches the configured SPKI pins")
+
+// verifySPKIPins returns a certificate verification function that
+// requires the SHA256 digest of the subject public key info of at least
+// one certificate in the verified chain to match one of pins.
+func verifySPKIPins(pins [][]byte) func([][]byte, [][]*x509.Certificate) error {
+	return func(_ [][]byte, chains [][]*x509.Certificate) error {
+		for _, chain := range chains {
+			for _, cert := range chain {
+				digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+
+				for _, pin := range pins {
+					if string(digest[:]) == string(pin) {
+						return nil
+					}
+				}
+			}
+		}
+
+		return errPinMismatch
+	}
+}
+
+// isDoTURL returns true if value should be parsed using parseDoTURL.
+func isDoTURL(value string) bool {
+	return strings.HasPrefix(value, "tls://")
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"net"
+	"sync/atomic"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/miekg/dns"
+)
+
+// defaultEDNSBufferSize is the UDP buffer size recommended by DNS Flag
+// Day 2020 to avoid IP fragmentation.
+const defaultEDNSBufferSize = 1232
+
+var (
+	// ednsBufferSize holds the UDP buffer size advertised to upstream
+	// servers. EDNS0 is disabled if it's zero.
+	ednsBufferSize atomic.Int64
+
+	// clientSubnet is the EDNS Client Subnet option attached to queries or
+	// nil.
+	clientSubnet atomic.Pointer[dns.EDNS0_SUBNET]
+)
+
+func setEDNSBufferSize(size int64) {
+	switch {
+	case size < 0:
+		size = 0
+	case size > 0 && size < dns.MinMsgSize:
+		hclog.L().Warn("EDNS buffer size too small, using minimum", "size", size, "minimum", dns.MinMsgSize)
+
+		size = dns.MinMsgSize
+	case size > dns.MaxMsgSize:
+		size = dns.MaxMsgSize
+	}
+
+	ednsBufferSize.Store(size)
+}
+
+// setClientSubnet configures the EDNS Client Subnet option attached to
+// queries. value is a subnet in CIDR notation, the host bits are cleared.
+// Use "0.0.0.0/0" to ask servers not to use the client's address at all,
+// or an empty value to not send ECS data.
+func setClientSubnet(value string) {
+	if value == "" {
+		clientSubnet.Store(nil)
+
+		return
+	}
+
+	_, subnet, err := net.ParseCIDR(value)
+	if err != nil {
+		hclog.L().Error("invalid client subnet, not sending ECS data", "subnet", value, "error", err)
+		clientSubnet.Store(nil)
+
+		return
+	}
+
+	ones, _ := subnet.Mask.Size()
+
+	ecs := &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		SourceNetmask: uint8(ones),
+		Address:       subnet.IP,
+	}
+
+	if ip4 := subnet.IP.To4(); ip4 != nil {
+		ecs.Family = 1
+		ecs.Address = ip4
+	} else {
+		ecs.Family = 2
+	}
+
+	clientSubnet.Store(ecs)
+}
+
+// addEDNS adds an OPT record to req advertising the configured UDP buffer
+// size.
+func addEDNS(req *dns.Msg) {
+	size := ednsBufferSize.Load()
+	if size == 0 {
+		return
+	}
+
+	req.SetEdns0(uint16(size), false)
+
+	if ecs := clientSubnet.Load(); ecs != nil {
+		opt := req.IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{
+			Code:          ecs.Code,
+			Family:        ecs.Family,
+			SourceNetmask: ecs.SourceNetmask,
+			Address:       ecs.Address,
+		})
+	}
+}
+
+// stripECS removes all EDNS Client Subnet options from res.
+func stripECS(res *dns.Msg) {
+	opt := res.IsEdns0()
+	if opt == nil {
+		return
+	}
+
+	options := opt.Option[:0]
+	for _, o := range opt.Option {
+		if o.Option() != dns.EDNS0SUBNET {
+			options = append(options, o)
+		}
+	}
+
+	opt.Option = options
+}
+
+// responseRcode returns the RCODE of res that is passed to Portmaster.
+// Extended RCODEs from the upstream OPT record are already merged into
+// res.Rcode but cannot be represented without an OPT record, which
+// Portmaster does not add to its reply, so they are reported as SERVFAIL.
+func responseRcode(res *dns.Msg) uint32 {
+	if res.Rcode > 0xF {
+		return dns.RcodeServerFailure
+	}
+
+	return uint32(res.Rcode)
+}
+
+// defaultPaddingBlockSize is the block size recommended by RFC 8467 for
+// padding queries.
+const defaultPaddingBlockSize = 128
+
+// paddingBlockSize holds the block size queries are padded to. Padding is
+// disabled if it's zero.
+var paddingBlockSize atomic.Int64
+
+func setPaddingBlockSize(size int64) {
+	if size < 0 || size > dns.MaxMsgSize {
+		hclog.L().Error("invalid padding block size, disabling padding", "size", size)
+
+		size = 0
+	}
+
+	paddingBlockSize.Store(size)
+}
+
+// padQuery adds an EDNS padding option to req so its length is a multiple
+// of the configured block size. It must be called after all other changes
+// to req and requires an OPT record.
+func padQuery(req *dns.Msg) {
+	block := int(paddingBlockSize.Load())
+
+	opt := req.IsEdns0()
+	if block == 0 || opt == nil {
+		return
+	}
+
+	// the padding option itself adds four bytes for its code and length
+	length := req.Len() + 4
+	padding := (block - length%block) % block
+
+	opt.Option = append(opt.Option, &dns.EDNS0_PADDING{
+		Padding: make([]byte, padding),
+	})
+}
+
+// repadQuery replaces the padding of req after other options have been
+// added.
+func repadQuery(req *dns.Msg) {
+	opt := req.IsEdns0()
+	if opt == nil {
+		return
+	}
+
+	options := opt.Option[:0]
+	for _, o := range opt.Option {
+		if o.Option() != dns.EDNS0PADDING {
+			options = append(options, o)
+		}
+	}
+	opt.Option = options
+
+	padQuery(req)
+}
+
+// withoutEDNS returns a copy of req with a new message ID and without an
+// OPT record.
+func withoutEDNS(req *dns.Msg) *dns.Msg {
+	msg := req.Copy()
+	msg.Id = dns.Id()
+
+	extra := msg.Extra[:0]
+	for _, rr := range msg.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	msg.Extra = extra
+
+	return msg
+}
+
+// isRejection reports whether rcode means the server refused to answer
+// the query rather than the query having no answer.
+func isRejection(rcode int) bool {
+	switch rcode {
+	case dns.RcodeFormatError, dns.RcodeNotImplemented, dns.RcodeRefused:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/safing/portmaster/plugin/shared/proto"
+)
+
+// envPrefix is the prefix of environment variables that override options.
+const envPrefix = "DNSCRYPT_PLUGIN_"
+
+// envName returns the environment variable that overrides the option with
+// key, e.g. DNSCRYPT_PLUGIN_CACHE_MIN_TTL for cacheMinTTL.
+func envName(key string) string {
+	runes := []rune(key)
+
+	var b strings.Builder
+	b.WriteString(envPrefix)
+	for idx, r := range runes {
+		if idx > 0 && unicode.IsUpper(r) {
+			prev := runes[idx-1]
+			nextLower := idx+1 < len(runes) && unicode.IsLower(runes[idx+1])
+
+			if !unicode.IsUpper(prev) || nextLower {
+				b.WriteByte('_')
+			}
+		}
+
+		b.WriteRune(unicode.ToUpper(r))
+	}
+
+	return b.String()
+}
+
+// envOverride returns the value of opt set using its environment variable.
+// The second return value is false if the variable is not set or invalid.
+func envOverride(opt configOption) (*proto.Value, bool) {
+	name := envName(opt.Key)
+
+	raw, ok := os.LookupEnv(name)
+	if !ok {
+		return nil, false
+	}
+
+	value, err := parseEnvValue(opt.OptionType, raw)
+	if err != nil {
+		hclog.L().Error("ignoring invalid environment variable", "name", name, "error", err)
+
+		return nil, false
+	}
+
+	return value, true
+}
+
+// parseEnvValue parses raw as a value of an option with type t. String
+// arrays are either given as a JSON array or separated by commas.
+func parseEnvValue(t proto.OptionType, raw string) (*proto.Value, error) {
+	switch t {
+	case proto.OptionType_OPTION_TYPE_BOOL:
+		v, err := strconv.ParseBool(raw)
+
+		return &proto.Value{Bool: v}, err
+	case proto.OptionType_OPTION_TYPE_INT:
+		v, err := strconv.ParseInt(raw, 10, 64)
+
+		return &proto.Value{Int: v}, err
+	case proto.OptionType_OPTION_TYPE_STRING:
+		return &proto.Value{String_: raw}, nil
+	case proto.OptionType_OPTION_TYPE_STRING_ARRAY:
+		values := []string{}
+
+		if strings.HasPrefix(strings.TrimSpace(raw), "[") {
+			err := json.Unmarshal([]byte(raw), &values)
+
+			return &proto.Value{StringArray: values}, err
+		}
+
+		for _, value := range strings.Split(raw, ",") {
+			if value = strings.TrimSpace(value); value != "" {
+				values = append(values, value)
+			}
+		}
+
+		return &proto.Value{StringArray: values}, nil
+	default:
+		return nil, fmt.Errorf("unsupported option type %s", t)
+	}
+}
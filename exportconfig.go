@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/safing/portmaster/plugin/shared/proto"
+	"github.com/spf13/cobra"
+)
+
+// exportedKeys are the options that have an equivalent in dnscrypt-proxy.
+var exportedKeys = map[string]bool{
+	"serverStamps":       true,
+	"serverNames":        true,
+	"sources":            true,
+	"requireDNSSEC":      true,
+	"requireNoLog":       true,
+	"requireNoFilter":    true,
+	"ipv4Servers":        true,
+	"ipv6Servers":        true,
+	"relayRoutes":        true,
+	"bootstrapResolvers": true,
+	"lbStrategy":         true,
+	"proxy":              true,
+	"cacheEnabled":       true,
+	"cacheSize":          true,
+	"cacheMinTTL":        true,
+	"cacheMaxTTL":        true,
+	"queryTimeout":       true,
+}
+
+// effectiveValues returns the values of all options of the plugin, using
+// the values from section and the defaults for options not set there.
+func effectiveValues(section map[string]interface{}) map[string]*proto.Value {
+	values := make(map[string]*proto.Value, len(configOptions))
+
+	for _, opt := range configOptions {
+		value := opt.Default
+		if raw, ok := section[opt.Key]; ok {
+			if v, ok := toValue(opt.OptionType, raw); ok {
+				value = v
+			}
+		}
+
+		values[opt.Key] = value
+	}
+
+	return values
+}
+
+// toValue converts a value from the Portmaster configuration file to a
+// value of an option with type t.
+func toValue(t proto.OptionType, raw interface{}) (*proto.Value, bool) {
+	switch t {
+	case proto.OptionType_OPTION_TYPE_BOOL:
+		v, ok := raw.(bool)
+
+		return &proto.Value{Bool: v}, ok
+	case proto.OptionType_OPTION_TYPE_INT:
+		v, ok := raw.(float64)
+
+		return &proto.Value{Int: int64(v)}, ok
+	case proto.OptionType_OPTION_TYPE_STRING:
+		v, ok := raw.(string)
+
+		return &proto.Value{String_: v}, ok
+	case proto.OptionType_OPTION_TYPE_STRING_ARRAY:
+		list, ok := raw.([]interface{})
+		if !ok {
+			return nil, false
+		}
+
+		values := make([]string, 0, len(list))
+		for _, item := range list {
+			s, ok := item.(string)
+			if !ok {
+				return nil, false
+			}
+
+			values = append(values, s)
+		}
+
+		return &proto.Value{StringArray: values}, true
+	default:
+		return nil, false
+	}
+}
+
+// proxyConfigFrom maps the option values of the plugin to a dnscrypt-proxy
+// configuration. The second return value lists the options that have been
+// changed from their default but cannot be expressed in dnscrypt-proxy.
+func proxyConfigFrom(values map[string]*proto.Value) (*proxyConfig, []string) {
+	cfg := &proxyConfig{
+		ServerNames: values["serverNames"].StringArray,
+		Static:      make(map[string]proxyStatic),
+		Sources:     make(map[string]proxySource),
+	}
+
+	var entries []serverConfig
+	for _, value := range values["serverStamps"].StringArray {
+		if entry, ok := parseStampEntry(value); ok {
+			entries = append(entries, entry)
+		}
+	}
+
+	for _, entry := range entries {
+		if _, ok := cfg.Static[entry.name]; ok {
+			continue
+		}
+
+		cfg.Static[entry.name] = proxyStatic{Stamp: entry.stamp}
+		cfg.ServerNames = append(cfg.ServerNames, entry.name)
+	}
+
+	for _, value := range values["sources"].StringArray {
+		fields := strings.Fields(value)
+		if len(fields) != 2 {
+			continue
+		}
+
+		file := path.Base(fields[0])
+		cfg.Sources[strings.TrimSuffix(file, path.Ext(file))] = proxySource{
+			URLs:        []string{fields[0]},
+			MinisignKey: fields[1],
+			CacheFile:   file,
+		}
+	}
+
+	for _, value := range values["relayRoutes"].StringArray {
+		fields := strings.Fields(value)
+		if len(fields) < 2 {
+			continue
+		}
+
+		cfg.AnonymizedDNS.Routes = append(cfg.AnonymizedDNS.Routes, proxyRoute{
+			ServerName: fields[0],
+			Via:        fields[1:],
+		})
+	}
+
+	boolPtr := func(key string) *bool {
+		v := values[key].Bool
+
+		return &v
+	}
+	cfg.IPv4Servers = boolPtr("ipv4Servers")
+	cfg.IPv6Servers = boolPtr("ipv6Servers")
+	cfg.RequireDNSSEC = boolPtr("requireDNSSEC")
+	cfg.RequireNoLog = boolPtr("requireNoLog")
+	cfg.RequireNoFilter = boolPtr("requireNoFilter")
+	cfg.Cache = boolPtr("cacheEnabled")
+
+	intPtr := func(key string) *int64 {
+		v := values[key].Int
+
+		return &v
+	}
+	cfg.Timeout = intPtr("queryTimeout")
+	cfg.CacheSize = intPtr("cacheSize")
+	cfg.CacheMinTTL = intPtr("cacheMinTTL")
+	cfg.CacheMaxTTL = intPtr("cacheMaxTTL")
+
+	cfg.BootstrapResolvers = values["bootstrapResolvers"].StringArray
+	cfg.Proxy = values["proxy"].String_
+
+	var unsupported []string
+	switch lbStrategy(values["lbStrategy"].String_) {
+	case strategyFirstAvailable:
+		cfg.LBStrategy = "first"
+	case strategyRandom:
+		cfg.LBStrategy = "random"
+	case strategyPowerOfTwo:
+		cfg.LBStrategy = "p2"
+	default:
+		unsupported = append(unsupported, "lbStrategy")
+	}
+
+	for _, opt := range configOptions {
+		if exportedKeys[opt.Key] || isDefault(opt, values[opt.Key]) {
+			continue
+		}
+
+		unsupported = append(unsupported, opt.Key)
+	}
+
+	return cfg, unsupported
+}
+
+// isDefault returns true if value is the default value of opt.
+func isDefault(opt configOption, value *proto.Value) bool {
+	return value.Bool == opt.Default.Bool &&
+		value.Int == opt.Default.Int &&
+		value.String_ == opt.Default.String_ &&
+		strings.Join(value.StringArray, "\n") == strings.Join(opt.Default.StringArray, "\n")
+}
+
+// exportCommand returns the command that prints the configuration of the
+// plugin in the format of dnscrypt-proxy.toml.
+func exportCommand() *cobra.Command {
+	var flags installFlags
+
+	cmd := &cobra.Command{
+		Use:   "export",
+		Short: "Export the configuration as dnscrypt-proxy.toml",
+		Long:  "Print the effective configuration of the plugin, read from the Portmaster configuration, in the format of dnscrypt-proxy.toml. Settings without an equivalent in dnscrypt-proxy are listed in a comment.",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			config, err := readPortmasterConfig(flags.configFile())
+			if err != nil {
+				return err
+			}
+
+			cfg, unsupported := proxyConfigFrom(effectiveValues(pluginSection(config, flags.pluginName, false)))
+
+			var buf bytes.Buffer
+			fmt.Fprintf(&buf, "# Exported from the Portmaster settings of %s\n", flags.pluginName)
+			if len(unsupported) > 0 {
+				fmt.Fprintf(&buf, "# Settings without an equivalent in dnscrypt-proxy: %s\n", strings.Join(unsupported, ", "))
+			}
+			buf.WriteString("\n")
+
+			if err := toml.NewEncoder(&buf).Encode(cfg); err != nil {
+				return err
+			}
+
+			_, err = cmd.OutOrStdout().Write(buf.Bytes())
+
+			return err
+		},
+	}
+
+	flags.register(cmd)
+
+	return cmd
+}
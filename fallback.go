@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"sync/atomic"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/miekg/dns"
+	"github.com/safing/portmaster/plugin/shared/proto"
+)
+
+// fallbackMode defines what happens to queries that cannot be answered
+// by any of the configured servers.
+type fallbackMode string
+
+const (
+	// fallbackPortmaster lets Portmaster resolve the query using its
+	// own resolvers.
+	fallbackPortmaster = fallbackMode("portmaster")
+
+	// fallbackFailClosed answers the query with SERVFAIL so it never
+	// leaves the plugin unencrypted.
+	fallbackFailClosed = fallbackMode("fail-closed")
+)
+
+// errNoServers is passed to fallback if no servers are configured or
+// none of them could be dialed.
+var errNoServers = errors.New("no servers available")
+
+var currentFallback atomic.Value
+
+func setFallbackMode(value string) {
+	mode := fallbackMode(value)
+
+	switch mode {
+	case fallbackPortmaster, fallbackFailClosed:
+	case "":
+		mode = fallbackPortmaster
+	default:
+		hclog.L().Error("unknown fallback mode, using portmaster", "mode", value)
+
+		mode = fallbackPortmaster
+	}
+
+	currentFallback.Store(mode)
+
+	notifyFallbackMode(mode)
+}
+
+func getFallbackMode() fallbackMode {
+	if m, ok := currentFallback.Load().(fallbackMode); ok {
+		return m
+	}
+
+	return fallbackPortmaster
+}
+
+// notifyFallbackMode tells the user what happens to queries if none of
+// the servers is reachable.
+func notifyFallbackMode(mode fallbackMode) {
+	message := "Queries that cannot be answered by any of the configured servers are resolved by Portmaster's own resolvers."
+	if mode == fallbackFailClosed {
+		message = "Queries that cannot be answered by any of the configured servers fail instead of being resolved by Portmaster's own resolvers."
+	}
+
+	notify(&proto.Notification{
+		EventId: "dnscrypt-fallback-mode",
+		Title:   "DNSCrypt: Fallback mode " + string(mode),
+		Message: message,
+	})
+}
+
+// fallback returns the result of a query that could not be answered by
+// any server because of err. In fail-closed mode that's an explicit
+// SERVFAIL response. Otherwise the query is left to Portmaster, reporting
+// err unless there simply are no servers to ask. outcome is returned
+// unchanged.
+func fallback(outcome queryOutcome, err error) (*proto.DNSResponse, queryOutcome, error) {
+	if getFallbackMode() == fallbackFailClosed {
+		hclog.L().Warn("failing query", "error", err)
+
+		return &proto.DNSResponse{
+			Rcode: dns.RcodeServerFailure,
+		}, outcome, nil
+	}
+
+	if errors.Is(err, errNoServers) {
+		return nil, outcome, nil
+	}
+
+	return nil, outcome, err
+}
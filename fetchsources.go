@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+// fetchSourcesCommand returns the command that runs the download and
+// verification of the resolver lists and reports the result of each step.
+func fetchSourcesCommand() *cobra.Command {
+	var (
+		flags   installFlags
+		sources []string
+		reload  bool
+	)
+
+	cmd := &cobra.Command{
+		Use:   "fetch-sources",
+		Short: "Download and verify the resolver lists and report the result of each step",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			cmd.SilenceErrors = true
+
+			values, err := flags.applyFilterConfig()
+			if err != nil {
+				return err
+			}
+
+			if len(sources) == 0 {
+				sources = values["sources"].StringArray
+			}
+
+			var (
+				report  = &testReport{out: cmd.OutOrStdout()}
+				filter  = getFilter()
+				entries = make(map[string]*sourceEntry)
+			)
+			for idx, value := range sources {
+				if idx > 0 {
+					fmt.Fprintln(cmd.OutOrStdout())
+				}
+
+				for _, entry := range checkSource(cmd.Context(), report, value, filter) {
+					if _, ok := entries[entry.Name]; !ok {
+						entries[entry.Name] = entry
+					}
+				}
+			}
+
+			var matching int
+			for _, entry := range entries {
+				if _, ok := filter.selectStamp(entry); ok {
+					matching++
+				}
+			}
+
+			fmt.Fprintf(cmd.OutOrStdout(), "\n%d resolver lists, %d unique resolvers, %d matching the configured requirements\n", len(sources), len(entries), matching)
+
+			if report.failed {
+				return errors.New("failed to fetch some resolver lists")
+			}
+
+			if reload {
+				if err := writeControlRequest(flags.dataDirectory(), reloadFile); err != nil {
+					return err
+				}
+
+				fmt.Fprintln(cmd.OutOrStdout(), "Requested the running plugin to download the resolver lists again.")
+			}
+
+			return nil
+		},
+	}
+
+	flags.register(cmd)
+	cmd.Flags().StringArrayVar(&sources, "source", nil, "Resolver list to use instead of the configured ones, in the format \"<url> <minisign-key>\"")
+	cmd.Flags().BoolVar(&reload, "reload", false, "Ask the running plugin to download the resolver lists again if all lists are valid")
+
+	return cmd
+}
+
+// checkSource downloads, verifies and parses the resolver list value,
+// adding the result of each step to report. It returns the resolvers of
+// the list or nil if any step failed.
+func checkSource(ctx context.Context, report *testReport, value string, filter serverFilter) []*sourceEntry {
+	src, err := parseSource(value)
+	if err != nil {
+		report.fail("Source", err)
+
+		return nil
+	}
+	report.pass("Source", "%s", src.url)
+
+	data, err := download(ctx, src.url)
+	if err != nil {
+		report.fail("List", err)
+		report.skip("Signature", "list not downloaded")
+
+		return nil
+	}
+	report.pass("List", "%d bytes", len(data))
+
+	sig, err := download(ctx, src.url+".minisig")
+	if err != nil {
+		report.fail("Signature", err)
+
+		return nil
+	}
+
+	if err := src.key.verify(data, sig); err != nil {
+		report.fail("Signature", err)
+
+		return nil
+	}
+	report.pass("Signature", "valid")
+
+	entries, err := parseResolverList(data)
+	if err != nil {
+		report.fail("Resolvers", err)
+
+		return nil
+	}
+
+	var matching int
+	for _, entry := range entries {
+		if _, ok := filter.selectStamp(entry); ok {
+			matching++
+		}
+	}
+	report.pass("Resolvers", "%d parsed, %d matching the configured requirements", len(entries), matching)
+
+	return entries
+}
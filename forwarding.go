@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/miekg/dns"
+)
+
+// errNoForwardServer is returned if a query matches a forwarding rule but
+// none of the servers of the rule is available.
+var errNoForwardServer = errors.New("no server available for forwarding rule")
+
+var (
+	forwardingLock  sync.RWMutex
+	forwardingRules map[string][]string
+
+	// plainServers holds the plain DNS servers of the forwarding rules by
+	// their address.
+	plainServers map[string]*server
+)
+
+// setForwardingRules configures the servers that queries for specific
+// domains are forwarded to. Each entry has the format
+// "<domain> <server> [<server>...]" where server is either the name of a
+// configured server or the address of a plain DNS server.
+func setForwardingRules(values []string) {
+	m := make(map[string][]string)
+
+	forwardingLock.RLock()
+	previous := plainServers
+	forwardingLock.RUnlock()
+
+	plain := make(map[string]*server)
+
+	for _, value := range values {
+		fields := strings.Fields(value)
+		if len(fields) < 2 {
+			hclog.L().Error("ignoring invalid forwarding rule", "rule", value)
+
+			continue
+		}
+
+		domain := dns.CanonicalName(fields[0])
+
+		for _, target := range fields[1:] {
+			if addr, ok := plainServerAddr(target); ok {
+				target = addr
+
+				// keep the health and latency of servers that are
+				// still used
+				if _, ok := plain[addr]; !ok {
+					if srv, ok := previous[addr]; ok {
+						plain[addr] = srv
+					} else {
+						plain[addr] = newPlainServer(addr)
+					}
+				}
+			}
+
+			m[domain] = append(m[domain], target)
+		}
+	}
+
+	forwardingLock.Lock()
+	forwardingRules = m
+	plainServers = plain
+	forwardingLock.Unlock()
+}
+
+// forwardServers returns the servers from list that queries for name
+// are forwarded to. The rule for the longest matching domain wins. The
+// second return value is false if no rule matches name.
+func forwardServers(list []*server, name string) ([]*server, bool) {
+	forwardingLock.RLock()
+	defer forwardingLock.RUnlock()
+
+	if len(forwardingRules) == 0 {
+		return nil, false
+	}
+
+	name = dns.CanonicalName(name)
+
+	var names []string
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if targets, ok := forwardingRules[name[off:]]; ok {
+			names = targets
+
+			break
+		}
+	}
+
+	if names == nil {
+		return nil, false
+	}
+
+	matched := serversByName(list, names)
+	for _, name := range names {
+		if srv, ok := plainServers[name]; ok {
+			matched = append(matched, srv)
+		}
+	}
+
+	return matched, true
+}
+
+// serversByName returns all servers from list that have one of names as
+// their name or as the provider name of their stamp.
+func serversByName(list []*server, names []string) []*server {
+	var matched []*server
+	for _, srv := range list {
+		for _, n := range names {
+			if srv.hasName(n) {
+				matched = append(matched, srv)
+
+				break
+			}
+		}
+	}
+
+	return matched
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// providerPrefix is the prefix DNSCrypt provider names are required to
+// start with.
+const providerPrefix = "2.dnscrypt-cert."
+
+// generateStampCommand returns the command that builds the stamp of a
+// self-hosted DNSCrypt server.
+func generateStampCommand() *cobra.Command {
+	var (
+		fields stampFields
+		port   int
+		verify bool
+	)
+
+	cmd := &cobra.Command{
+		Use:   "generate-stamp <host>",
+		Short: "Generate the stamp of a self-hosted DNSCrypt server",
+		Long:  "Generate the stamp of a self-hosted DNSCrypt server, e.g. one running encrypted-dns-server. Hostnames are resolved since DNSCrypt stamps require an IP address. Unless --verify=false is given, the certificate of the server is fetched to make sure it has been signed using the provider public key.",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+
+			host := args[0]
+			if fields.publicKey == "" {
+				return errors.New("--public-key is required, encrypted-dns-server prints it when it starts")
+			}
+
+			ip, err := resolveHost(cmd.Context(), host)
+			if err != nil {
+				return err
+			}
+
+			fields.protocol = "dnscrypt"
+			fields.address = net.JoinHostPort(ip, strconv.Itoa(port))
+
+			switch {
+			case fields.provider == "" && net.ParseIP(host) == nil:
+				fields.provider = providerPrefix + host
+			case fields.provider == "":
+				return errors.New("--provider is required if the server is given by IP address")
+			case !strings.HasPrefix(fields.provider, providerPrefix):
+				fields.provider = providerPrefix + fields.provider
+			}
+
+			stamp, err := fields.build()
+			if err != nil {
+				return err
+			}
+
+			if verify {
+				ctx, cancel := context.WithTimeout(cmd.Context(), defaultTimeout)
+				defer cancel()
+
+				info, err := dialStamp(ctx, stamp, nil, "udp")
+				if err != nil {
+					return fmt.Errorf("failed to verify the certificate of %s: %w", fields.address, err)
+				}
+
+				cmd.PrintErrf("Verified certificate of %s, valid until %s\n", fields.provider, time.Unix(int64(info.ResolverCert.NotAfter), 0).Format(time.RFC3339))
+			}
+
+			fmt.Fprintln(cmd.OutOrStdout(), stamp.String())
+
+			return nil
+		},
+	}
+
+	fields.registerProperties(cmd)
+	cmd.Flags().IntVar(&port, "port", 443, "The port the server listens on")
+	cmd.Flags().StringVar(&fields.provider, "provider", "", "The provider name of the server, prefixed with \"2.dnscrypt-cert.\" if required (default \"2.dnscrypt-cert.<host>\")")
+	cmd.Flags().StringVar(&fields.publicKey, "public-key", "", "The hex encoded provider public key of the server")
+	cmd.Flags().BoolVar(&verify, "verify", true, "Fetch the certificate of the server to verify the stamp")
+
+	return cmd
+}
+
+// resolveHost returns host if it's an IP address and the first address of
+// host otherwise.
+func resolveHost(ctx context.Context, host string) (string, error) {
+	if net.ParseIP(host) != nil {
+		return host, nil
+	}
+
+	addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+	if err != nil {
+		return "", err
+	}
+	if len(addrs) == 0 {
+		return "", fmt.Errorf("no addresses found for %s", host)
+	}
+
+	return addrs[0], nil
+}
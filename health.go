@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/safing/portmaster/plugin/framework"
+)
+
+const (
+	// servfailThreshold is the number of consecutive SERVFAIL responses
+	// after which the circuit of a server is opened.
+	servfailThreshold = 3
+
+	// circuitCloseThreshold is the number of consecutive successful
+	// probes required before a server is put back into rotation.
+	circuitCloseThreshold = 3
+
+	// circuitMinBackoff is the time the circuit of a server stays open
+	// before it is probed for the first time.
+	circuitMinBackoff = 5 * time.Second
+
+	// circuitMaxBackoff limits the time between two probes of a server
+	// with an open circuit.
+	circuitMaxBackoff = 10 * time.Minute
+
+	// halfOpenProbeInterval is the time between the probes that are
+	// required to close a half-open circuit.
+	halfOpenProbeInterval = time.Second
+)
+
+// errServerFailure is recorded for a server that answered with SERVFAIL.
+var errServerFailure = errors.New("server failure")
+
+// circuitState is the state of the circuit breaker of a server.
+type circuitState int
+
+const (
+	// circuitClosed means the server is in rotation.
+	circuitClosed circuitState = iota
+
+	// circuitOpen means the server failed and is probed using an
+	// exponential backoff.
+	circuitOpen
+
+	// circuitHalfOpen means the server answered a probe but did not yet
+	// answer circuitCloseThreshold probes in a row.
+	circuitHalfOpen
+)
+
+func (state circuitState) String() string {
+	switch state {
+	case circuitClosed:
+		return "closed"
+	case circuitOpen:
+		return "open"
+	case circuitHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// health is the circuit breaker of a server.
+type health struct {
+	lock      sync.Mutex
+	state     circuitState
+	servfails int
+	successes int
+	backoff   time.Duration
+
+	// lastSuccess and failures are reported by the status command.
+	lastSuccess time.Time
+	failures    int64
+}
+
+// healthy reports whether srv is currently in rotation, that is, its
+// circuit is closed.
+func (srv *server) healthy() bool {
+	srv.health.lock.Lock()
+	defer srv.health.lock.Unlock()
+
+	return srv.health.state == circuitClosed
+}
+
+// reportSuccess resets the SERVFAIL counter of srv.
+func (srv *server) reportSuccess() {
+	srv.health.lock.Lock()
+	defer srv.health.lock.Unlock()
+
+	srv.health.servfails = 0
+	srv.health.lastSuccess = time.Now()
+
+	recordServerUsage(srv.name, true)
+	recordAlertExchange(srv.name, true)
+}
+
+// reportFailure records a failed exchange with srv. The circuit is
+// opened immediately if the exchange failed and after servfailThreshold
+// consecutive SERVFAIL responses.
+func (srv *server) reportFailure(err error) {
+	srv.health.lock.Lock()
+	defer srv.health.lock.Unlock()
+
+	srv.health.failures++
+
+	recordServerUsage(srv.name, false)
+	recordAlertExchange(srv.name, false)
+
+	if srv.health.state != circuitClosed {
+		return
+	}
+
+	if errors.Is(err, errServerFailure) {
+		srv.health.servfails++
+		if srv.health.servfails < servfailThreshold {
+			return
+		}
+	}
+
+	hclog.L().Warn("opening circuit of failing server", "server", srv.name, "error", err)
+
+	srv.health.state = circuitOpen
+	srv.health.backoff = circuitMinBackoff
+
+	go srv.reprobe(framework.Context())
+}
+
+// reprobe probes a server with an open circuit using an exponential
+// backoff and closes the circuit once the server answered
+// circuitCloseThreshold probes in a row. It stops if the server has been
+// removed from the server list in the meantime.
+func (srv *server) reprobe(ctx context.Context) {
+	for {
+		srv.health.lock.Lock()
+		wait := srv.health.backoff
+		if srv.health.state == circuitHalfOpen {
+			wait = halfOpenProbeInterval
+		}
+		srv.health.lock.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+
+		if !isConfigured(srv) {
+			return
+		}
+
+		_, err := probe(ctx, srv)
+
+		if srv.recordProbe(err) {
+			hclog.L().Info("server recovered, closing circuit", "server", srv.name)
+
+			return
+		}
+	}
+}
+
+// recordProbe updates the circuit of srv with the result of a probe and
+// reports whether the circuit has been closed.
+func (srv *server) recordProbe(err error) bool {
+	srv.health.lock.Lock()
+	defer srv.health.lock.Unlock()
+
+	if err != nil {
+		hclog.L().Debug("server still failing", "server", srv.name, "state", srv.health.state, "error", err)
+
+		if srv.health.state == circuitOpen {
+			srv.health.backoff *= 2
+			if srv.health.backoff > circuitMaxBackoff {
+				srv.health.backoff = circuitMaxBackoff
+			}
+		}
+
+		srv.health.state = circuitOpen
+		srv.health.successes = 0
+
+		return false
+	}
+
+	srv.health.successes++
+	if srv.health.successes < circuitCloseThreshold {
+		srv.health.state = circuitHalfOpen
+
+		return false
+	}
+
+	srv.health.state = circuitClosed
+	srv.health.successes = 0
+	srv.health.servfails = 0
+
+	return true
+}
+
+// isConfigured reports whether srv is part of the current server list or
+// one of the plain servers of the forwarding rules.
+func isConfigured(srv *server) bool {
+	resolverLock.RLock()
+	for _, s := range servers {
+		if s == srv {
+			resolverLock.RUnlock()
+
+			return true
+		}
+	}
+	resolverLock.RUnlock()
+
+	forwardingLock.RLock()
+	defer forwardingLock.RUnlock()
+
+	return plainServers[srv.name] == srv
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/miekg/dns"
+)
+
+const (
+	// hostsServer is logged as the server of queries answered from the
+	// hosts file.
+	hostsServer = "hosts"
+
+	// hostsCheckInterval defines how often the hosts file is checked for
+	// changes.
+	hostsCheckInterval = 5 * time.Second
+)
+
+var (
+	hostsLock sync.Mutex
+	hostsPath string
+
+	// hostsTTL is the TTL in seconds of the records of the hosts file.
+	hostsTTL atomic.Uint32
+
+	// hostsChanged is used to reload the hosts file after the
+	// configuration changed.
+	hostsChanged = make(chan struct{}, 1)
+)
+
+func init() {
+	hostsTTL.Store(cloakTTL)
+}
+
+// setHostsFile configures the hosts file answered by the plugin. It's
+// loaded by watchHostsFile.
+func setHostsFile(path string) {
+	hostsLock.Lock()
+	hostsPath = strings.TrimSpace(path)
+	hostsLock.Unlock()
+
+	reloadHostsFile()
+}
+
+func setHostsTTL(ttl int64) {
+	if ttl <= 0 {
+		ttl = cloakTTL
+	}
+
+	hostsTTL.Store(uint32(ttl))
+
+	reloadHostsFile()
+}
+
+// reloadHostsFile triggers loading the hosts file again.
+func reloadHostsFile() {
+	select {
+	case hostsChanged <- struct{}{}:
+	default:
+	}
+}
+
+// watchHostsFile loads the hosts file whenever the configuration changes
+// and whenever the file has been modified.
+func watchHostsFile(ctx context.Context) {
+	ticker := time.NewTicker(hostsCheckInterval)
+	defer ticker.Stop()
+
+	var (
+		loadedPath string
+		loadedTime time.Time
+	)
+	for {
+		force := false
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-hostsChanged:
+			force = true
+		case <-ticker.C:
+		}
+
+		hostsLock.Lock()
+		path := hostsPath
+		hostsLock.Unlock()
+
+		if path != "" && !filepath.IsAbs(path) {
+			path = filepath.Join(dataDirectory(), path)
+		}
+
+		var modified time.Time
+		if path != "" {
+			stat, err := os.Stat(path)
+			if err == nil {
+				modified = stat.ModTime()
+			}
+		}
+
+		if !force && path == loadedPath && modified.Equal(loadedTime) {
+			continue
+		}
+
+		loadedPath, loadedTime = path, modified
+
+		entries := make(map[string]*cloakTarget)
+		if path != "" {
+			if err := readHostsFile(path, entries); err != nil {
+				hclog.L().Error("failed to read hosts file", "path", path, "error", err)
+			} else {
+				hclog.L().Info("loaded hosts file", "path", path, "names", len(entries))
+			}
+		}
+
+		cloakingLock.Lock()
+		hostsEntries = entries
+		cloakingLock.Unlock()
+	}
+}
+
+// readHostsFile adds the entries of the hosts file at path to entries.
+// Each line contains an address followed by any number of names, which
+// may start with "*." to match all subdomains. Comments start with "#".
+// Addresses listed for the same name on multiple lines are combined.
+func readHostsFile(path string, entries map[string]*cloakTarget) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	ttl := hostsTTL.Load()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+
+		ip := net.ParseIP(fields[0])
+		if ip == nil {
+			hclog.L().Warn("ignoring hosts file entry with invalid address", "path", path, "address", fields[0])
+
+			continue
+		}
+
+		for _, name := range fields[1:] {
+			if _, ok := dns.IsDomainName(strings.TrimPrefix(name, "*.")); !ok {
+				continue
+			}
+
+			name = dns.CanonicalName(name)
+
+			target, ok := entries[name]
+			if !ok {
+				target = &cloakTarget{
+					server: hostsServer,
+					ttl:    ttl,
+				}
+				entries[name] = target
+			}
+
+			target.addresses = append(target.addresses, ip)
+		}
+	}
+
+	return scanner.Err()
+}
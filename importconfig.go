@@ -0,0 +1,289 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/spf13/cobra"
+)
+
+// proxyConfig is the part of a dnscrypt-proxy.toml file that can be mapped
+// to the options of the plugin.
+type proxyConfig struct {
+	ServerNames        []string `toml:"server_names,omitempty"`
+	IPv4Servers        *bool    `toml:"ipv4_servers,omitempty"`
+	IPv6Servers        *bool    `toml:"ipv6_servers,omitempty"`
+	RequireDNSSEC      *bool    `toml:"require_dnssec,omitempty"`
+	RequireNoLog       *bool    `toml:"require_nolog,omitempty"`
+	RequireNoFilter    *bool    `toml:"require_nofilter,omitempty"`
+	LBStrategy         string   `toml:"lb_strategy,omitempty"`
+	Timeout            *int64   `toml:"timeout,omitempty"`
+	BootstrapResolvers []string `toml:"bootstrap_resolvers,omitempty"`
+	Proxy              string   `toml:"proxy,omitempty"`
+	Cache              *bool    `toml:"cache,omitempty"`
+	CacheSize          *int64   `toml:"cache_size,omitempty"`
+	CacheMinTTL        *int64   `toml:"cache_min_ttl,omitempty"`
+	CacheMaxTTL        *int64   `toml:"cache_max_ttl,omitempty"`
+	ForwardingRules    string   `toml:"forwarding_rules,omitempty"`
+
+	Sources map[string]proxySource `toml:"sources,omitempty"`
+	Static  map[string]proxyStatic `toml:"static,omitempty"`
+
+	AnonymizedDNS struct {
+		Routes []proxyRoute `toml:"routes,omitempty"`
+	} `toml:"anonymized_dns,omitempty"`
+}
+
+type proxySource struct {
+	URLs        []string `toml:"urls,omitempty"`
+	MinisignKey string   `toml:"minisign_key,omitempty"`
+	CacheFile   string   `toml:"cache_file,omitempty"`
+}
+
+type proxyStatic struct {
+	Stamp string `toml:"stamp,omitempty"`
+}
+
+type proxyRoute struct {
+	ServerName string   `toml:"server_name,omitempty"`
+	Via        []string `toml:"via,omitempty"`
+}
+
+// proxyStrategies maps the load balancing strategies of dnscrypt-proxy to
+// the ones of the plugin.
+var proxyStrategies = map[string]lbStrategy{
+	"first":  strategyFirstAvailable,
+	"random": strategyRandom,
+	"p2":     strategyPowerOfTwo,
+	"ph":     strategyPowerOfTwo,
+}
+
+// pluginValues maps cfg to option values of the plugin. The second return
+// value lists the settings of cfg that could not be mapped.
+func (cfg *proxyConfig) pluginValues() (map[string]interface{}, []string) {
+	values := make(map[string]interface{})
+	var skipped []string
+
+	// servers from the static section are configured by stamp, all
+	// others are looked up in the resolver lists.
+	var (
+		names  []string
+		stamps []string
+	)
+	for _, name := range cfg.ServerNames {
+		if static, ok := cfg.Static[name]; ok {
+			stamps = append(stamps, name+" "+static.Stamp)
+		} else {
+			names = append(names, name)
+		}
+	}
+	if len(cfg.ServerNames) == 0 {
+		for _, name := range sortedKeys(cfg.Static) {
+			stamps = append(stamps, name+" "+cfg.Static[name].Stamp)
+		}
+	}
+	if names != nil {
+		values["serverNames"] = names
+	}
+	if stamps != nil {
+		values["serverStamps"] = stamps
+	}
+
+	if len(cfg.Sources) > 0 {
+		var sources []string
+		for _, name := range sortedKeys(cfg.Sources) {
+			src := cfg.Sources[name]
+			if len(src.URLs) == 0 || src.MinisignKey == "" {
+				skipped = append(skipped, "sources."+name)
+
+				continue
+			}
+
+			// the remaining URLs are mirrors of the first one
+			sources = append(sources, src.URLs[0]+" "+src.MinisignKey)
+		}
+		values["sources"] = sources
+	}
+
+	if len(cfg.AnonymizedDNS.Routes) > 0 {
+		var routes []string
+		for _, route := range cfg.AnonymizedDNS.Routes {
+			if route.ServerName == "" || len(route.Via) == 0 {
+				continue
+			}
+
+			routes = append(routes, route.ServerName+" "+strings.Join(route.Via, " "))
+		}
+		values["relayRoutes"] = routes
+	}
+
+	setBool := func(key string, value *bool) {
+		if value != nil {
+			values[key] = *value
+		}
+	}
+	setBool("ipv4Servers", cfg.IPv4Servers)
+	setBool("ipv6Servers", cfg.IPv6Servers)
+	setBool("requireDNSSEC", cfg.RequireDNSSEC)
+	setBool("requireNoLog", cfg.RequireNoLog)
+	setBool("requireNoFilter", cfg.RequireNoFilter)
+	setBool("cacheEnabled", cfg.Cache)
+
+	setInt := func(key string, value *int64) {
+		if value != nil {
+			values[key] = *value
+		}
+	}
+	setInt("queryTimeout", cfg.Timeout)
+	setInt("cacheSize", cfg.CacheSize)
+	setInt("cacheMinTTL", cfg.CacheMinTTL)
+	setInt("cacheMaxTTL", cfg.CacheMaxTTL)
+
+	if cfg.LBStrategy != "" {
+		if strategy, ok := proxyStrategies[cfg.LBStrategy]; ok {
+			values["lbStrategy"] = string(strategy)
+		} else if strings.HasPrefix(cfg.LBStrategy, "p") {
+			values["lbStrategy"] = string(strategyPowerOfTwo)
+		} else {
+			skipped = append(skipped, "lb_strategy")
+		}
+	}
+
+	if cfg.BootstrapResolvers != nil {
+		values["bootstrapResolvers"] = cfg.BootstrapResolvers
+	}
+
+	if cfg.Proxy != "" {
+		values["proxy"] = cfg.Proxy
+	}
+
+	// dnscrypt-proxy keeps the forwarding rules in a separate file.
+	if cfg.ForwardingRules != "" {
+		skipped = append(skipped, "forwarding_rules")
+	}
+
+	return values, skipped
+}
+
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// readPortmasterConfig reads the Portmaster configuration file at path. An
+// empty configuration is returned if the file does not exist.
+func readPortmasterConfig(path string) (map[string]interface{}, error) {
+	config := make(map[string]interface{})
+
+	blob, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return config, nil
+		}
+
+		return nil, err
+	}
+
+	if err := json.Unmarshal(blob, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+
+	return config, nil
+}
+
+// pluginSection returns the map holding the options of the plugin in the
+// hierarchical Portmaster configuration, creating it if create is true.
+func pluginSection(config map[string]interface{}, pluginName string, create bool) map[string]interface{} {
+	section := config
+	for _, part := range []string{"plugins", pluginName} {
+		next, ok := section[part].(map[string]interface{})
+		if !ok {
+			if !create {
+				return nil
+			}
+
+			next = make(map[string]interface{})
+			section[part] = next
+		}
+
+		section = next
+	}
+
+	return section
+}
+
+// importCommand returns the command that imports the configuration of
+// dnscrypt-proxy into the Portmaster configuration.
+func importCommand() *cobra.Command {
+	var (
+		flags  installFlags
+		dryRun bool
+	)
+
+	cmd := &cobra.Command{
+		Use:   "import <dnscrypt-proxy.toml>",
+		Short: "Import the configuration of dnscrypt-proxy",
+		Long:  "Import server names, resolver lists, anonymized DNS routes and filters from a dnscrypt-proxy.toml file into the Portmaster configuration. Stop the Portmaster before importing as it overwrites the configuration file when settings are changed.",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var cfg proxyConfig
+			if _, err := toml.DecodeFile(args[0], &cfg); err != nil {
+				return err
+			}
+
+			values, skipped := cfg.pluginValues()
+
+			for _, key := range skipped {
+				fmt.Fprintf(cmd.ErrOrStderr(), "skipping unsupported setting %s\n", key)
+			}
+
+			if dryRun {
+				blob, err := json.MarshalIndent(values, "", "  ")
+				if err != nil {
+					return err
+				}
+
+				fmt.Fprintln(cmd.OutOrStdout(), string(blob))
+
+				return nil
+			}
+
+			config, err := readPortmasterConfig(flags.configFile())
+			if err != nil {
+				return err
+			}
+
+			section := pluginSection(config, flags.pluginName, true)
+			for key, value := range values {
+				section[key] = value
+			}
+
+			blob, err := json.MarshalIndent(config, "", "  ")
+			if err != nil {
+				return err
+			}
+
+			if err := os.WriteFile(flags.configFile(), blob, 0600); err != nil {
+				return err
+			}
+
+			fmt.Fprintf(cmd.OutOrStdout(), "imported %d settings into %s\n", len(values), flags.configFile())
+
+			return nil
+		},
+	}
+
+	flags.register(cmd)
+	cmd.Flags().BoolVar(&dryRun, "dry-run", false, "Print the imported settings instead of writing them")
+
+	return cmd
+}
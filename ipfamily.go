@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+// ipPreference defines which address family is preferred if a server is
+// reachable using both, IPv4 and IPv6.
+type ipPreference string
+
+const (
+	preferAny  = ipPreference("any")
+	preferIPv4 = ipPreference("ipv4")
+	preferIPv6 = ipPreference("ipv6")
+)
+
+// ipv6Probe is a global IPv6 address used to check whether the host has a
+// route to the IPv6 internet. No traffic is sent to it.
+const ipv6Probe = "[2001:4860:4860::8888]:53"
+
+// ipv6CheckInterval defines how long the result of the IPv6 connectivity
+// check is cached.
+const ipv6CheckInterval = time.Minute
+
+var (
+	ipv6Lock      sync.Mutex
+	ipv6Available bool
+	ipv6Checked   time.Time
+)
+
+func parseIPPreference(value string) ipPreference {
+	pref := ipPreference(value)
+
+	switch pref {
+	case preferAny, preferIPv4, preferIPv6:
+	case "":
+		pref = preferAny
+	default:
+		hclog.L().Error("unknown IP preference, using any", "preference", value)
+
+		pref = preferAny
+	}
+
+	return pref
+}
+
+// hasIPv6Connectivity reports whether the host has a route to the IPv6
+// internet.
+func hasIPv6Connectivity() bool {
+	ipv6Lock.Lock()
+	defer ipv6Lock.Unlock()
+
+	if time.Since(ipv6Checked) < ipv6CheckInterval {
+		return ipv6Available
+	}
+
+	// connecting a UDP socket only looks up the route without sending
+	// any packets.
+	conn, err := net.Dial("udp6", ipv6Probe)
+	if err == nil {
+		conn.Close()
+	}
+
+	ipv6Available = err == nil
+	ipv6Checked = time.Now()
+
+	return ipv6Available
+}
+
+// pickIP returns the address from ips that should be used according to
+// pref. IPv6 addresses are skipped if the host has no IPv6 connectivity
+// unless there is no other address.
+func pickIP(ips []net.IPAddr, pref ipPreference) net.IPAddr {
+	var ipv4, ipv6 []net.IPAddr
+	for _, ip := range ips {
+		if ip.IP.To4() != nil {
+			ipv4 = append(ipv4, ip)
+		} else {
+			ipv6 = append(ipv6, ip)
+		}
+	}
+
+	if len(ipv6) > 0 && len(ipv4) > 0 {
+		switch {
+		case pref == preferIPv6 && hasIPv6Connectivity():
+			return ipv6[0]
+		case pref == preferIPv4 || !hasIPv6Connectivity():
+			return ipv4[0]
+		}
+	}
+
+	return ips[0]
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"io"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// maxIdleConns is the maximum number of idle TCP connections kept open
+// to an upstream server.
+const maxIdleConns = 4
+
+// defaultIdleTimeout is the time an idle TCP connection is kept open if
+// the server did not announce its own timeout using edns-tcp-keepalive.
+const defaultIdleTimeout = 30 * time.Second
+
+// idleConn is a connection waiting in a connPool.
+type idleConn[T io.Closer] struct {
+	conn    T
+	expires time.Time
+}
+
+// connPool keeps idle connections to a server open so they can be re-used
+// for subsequent queries.
+type connPool[T io.Closer] struct {
+	idle chan idleConn[T]
+}
+
+func newConnPool[T io.Closer]() *connPool[T] {
+	return &connPool[T]{
+		idle: make(chan idleConn[T], maxIdleConns),
+	}
+}
+
+// get returns an idle connection. The returned bool is false if there is
+// no idle connection that has not yet expired.
+func (p *connPool[T]) get() (T, bool) {
+	for {
+		select {
+		case c := <-p.idle:
+			if time.Now().Before(c.expires) {
+				return c.conn, true
+			}
+
+			c.conn.Close()
+		default:
+			var zero T
+
+			return zero, false
+		}
+	}
+}
+
+// put returns conn to the pool for at most timeout. conn is closed if
+// the pool is full or timeout is zero.
+func (p *connPool[T]) put(conn T, timeout time.Duration) {
+	if timeout <= 0 {
+		conn.Close()
+
+		return
+	}
+
+	select {
+	case p.idle <- idleConn[T]{conn: conn, expires: time.Now().Add(timeout)}:
+	default:
+		conn.Close()
+	}
+}
+
+// withTCPKeepalive returns a copy of req that requests edns-tcp-keepalive
+// (RFC 7828). req is returned unchanged if it has no OPT record.
+func withTCPKeepalive(req *dns.Msg) *dns.Msg {
+	if req.IsEdns0() == nil {
+		return req
+	}
+
+	msg := req.Copy()
+
+	opt := msg.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_TCP_KEEPALIVE{
+		Code: dns.EDNS0TCPKEEPALIVE,
+	})
+	repadQuery(msg)
+
+	return msg
+}
+
+// keepaliveTimeout returns how long the connection res has been received
+// on may be kept open according to the edns-tcp-keepalive option of the
+// server.
+func keepaliveTimeout(res *dns.Msg) time.Duration {
+	if opt := res.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if k, ok := o.(*dns.EDNS0_TCP_KEEPALIVE); ok && k.Timeout > 0 {
+				return time.Duration(k.Timeout) * 100 * time.Millisecond
+			}
+		}
+	}
+
+	return defaultIdleTimeout
+}
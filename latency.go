@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+)
+
+// latencyBuckets are the upper bounds of the buckets of latency histograms.
+// Slower responses are counted in an additional overflow bucket.
+var latencyBuckets = []time.Duration{
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+}
+
+// latencyHistogram counts response times in latencyBuckets.
+type latencyHistogram struct {
+	Counts []int64 `json:"counts"`
+}
+
+// observe adds d to the histogram.
+func (h *latencyHistogram) observe(d time.Duration) {
+	if h.Counts == nil {
+		h.Counts = make([]int64, len(latencyBuckets)+1)
+	}
+
+	idx := len(latencyBuckets)
+	for i, bound := range latencyBuckets {
+		if d <= bound {
+			idx = i
+
+			break
+		}
+	}
+
+	h.Counts[idx]++
+}
+
+func (h latencyHistogram) total() int64 {
+	var total int64
+	for _, count := range h.Counts {
+		total += count
+	}
+
+	return total
+}
+
+// percentile returns the upper bound of the bucket containing the p-th
+// percentile of the observed response times. The second return value is
+// false if the percentile is in the overflow bucket.
+func (h latencyHistogram) percentile(p float64) (time.Duration, bool) {
+	total := h.total()
+	if total == 0 {
+		return 0, true
+	}
+
+	rank := int64(float64(total)*p/100 + 0.5)
+
+	var seen int64
+	for idx, count := range h.Counts {
+		seen += count
+		if seen >= rank && idx < len(latencyBuckets) {
+			return latencyBuckets[idx], true
+		}
+	}
+
+	return latencyBuckets[len(latencyBuckets)-1], false
+}
+
+// printLatencyHistograms prints the latency histograms of servers as a
+// table together with the estimated median and 95th percentile.
+func printLatencyHistograms(out io.Writer, servers []serverStatus) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', tabwriter.AlignRight)
+	defer w.Flush()
+
+	fmt.Fprint(w, "SERVER\tQUERIES\tP50\tP95\t")
+	for _, bound := range latencyBuckets {
+		fmt.Fprintf(w, "≤%s\t", bound)
+	}
+	fmt.Fprintf(w, ">%s\t\n", latencyBuckets[len(latencyBuckets)-1])
+
+	percentile := func(h latencyHistogram, p float64) string {
+		if h.total() == 0 {
+			return "-"
+		}
+
+		d, ok := h.percentile(p)
+		if !ok {
+			return ">" + d.String()
+		}
+
+		return "≤" + d.String()
+	}
+
+	for _, s := range servers {
+		h := s.Histogram
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t", s.Name, h.total(), percentile(h, 50), percentile(h, 95))
+
+		for idx := 0; idx <= len(latencyBuckets); idx++ {
+			count := int64(0)
+			if idx < len(h.Counts) {
+				count = h.Counts[idx]
+			}
+
+			fmt.Fprintf(w, "%d\t", count)
+		}
+		fmt.Fprintln(w)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/ameshkov/dnsstamps"
+	"github.com/hashicorp/go-hclog"
+	"github.com/safing/portmaster/plugin/shared/proto"
+	"github.com/spf13/cobra"
+)
+
+// filterKeys are the options that restrict which servers of the resolver
+// lists may be used.
+var filterKeys = []string{
+	"requireDNSSEC",
+	"requireNoLog",
+	"requireNoFilter",
+	"ipv4Servers",
+	"ipv6Servers",
+	"ipPreference",
+}
+
+// listResolversCommand returns the command that prints the servers of the
+// configured resolver lists that match the configured requirements.
+func listResolversCommand() *cobra.Command {
+	var (
+		flags   installFlags
+		sources []string
+	)
+
+	cmd := &cobra.Command{
+		Use:   "list-resolvers",
+		Short: "List the servers of the resolver lists matching the configured requirements",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+
+			values, err := flags.applyFilterConfig()
+			if err != nil {
+				return err
+			}
+
+			if len(sources) == 0 {
+				sources = values["sources"].StringArray
+			}
+
+			entries, err := fetchSources(cmd.Context(), sources)
+			if err != nil {
+				return err
+			}
+
+			printResolvers(cmd.OutOrStdout(), entries, getFilter())
+
+			return nil
+		},
+	}
+
+	flags.register(cmd)
+	cmd.Flags().StringArrayVar(&sources, "source", nil, "Resolver list to use instead of the configured ones, in the format \"<url> <minisign-key>\"")
+
+	return cmd
+}
+
+// applyFilterConfig applies only the filter options of the configuration
+// file and returns all configured values.
+func (f *installFlags) applyFilterConfig() (map[string]*proto.Value, error) {
+	config, err := readPortmasterConfig(f.configFile())
+	if err != nil {
+		return nil, err
+	}
+
+	values := effectiveValues(pluginSection(config, f.pluginName, false))
+	for _, opt := range configOptions {
+		if slices.Contains(filterKeys, opt.Key) {
+			opt.apply(values[opt.Key])
+		}
+	}
+
+	return values, nil
+}
+
+// fetchSources downloads all resolver lists in values and returns their
+// servers by name. Servers listed in multiple lists are taken from the
+// first one.
+func fetchSources(ctx context.Context, values []string) (map[string]*sourceEntry, error) {
+	dir, err := os.MkdirTemp("", "dnscrypt-sources")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	entries := make(map[string]*sourceEntry)
+	for _, value := range values {
+		src, err := parseSource(value)
+		if err != nil {
+			return nil, err
+		}
+
+		result, err := fetchSource(ctx, src, dir, true)
+		if err != nil {
+			hclog.L().Error("failed to fetch resolver list", "url", src.url, "error", err)
+
+			continue
+		}
+
+		for _, entry := range result {
+			if _, ok := entries[entry.Name]; !ok {
+				entries[entry.Name] = entry
+			}
+		}
+	}
+
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("no servers found in %d resolver lists", len(values))
+	}
+
+	return entries, nil
+}
+
+// printResolvers prints the servers in entries that match filter as a
+// table sorted by name.
+func printResolvers(out io.Writer, entries map[string]*sourceEntry, filter serverFilter) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	defer w.Flush()
+
+	fmt.Fprintln(w, "NAME\tPROTOCOL\tADDRESS\tFLAGS")
+	for _, name := range sortedKeys(entries) {
+		s, ok := filter.selectStamp(entries[name])
+		if !ok {
+			continue
+		}
+
+		stamp, err := dnsstamps.NewServerStampFromString(s)
+		if err != nil {
+			continue
+		}
+
+		addr := stamp.ServerAddrStr
+		if addr == "" {
+			addr = stamp.ProviderName
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", name, stamp.Proto.String(), addr, stampFlags(stamp))
+	}
+}
+
+// stampFlags returns the informal properties of stamp.
+func stampFlags(stamp dnsstamps.ServerStamp) string {
+	var flags []string
+	if stamp.Props&dnsstamps.ServerInformalPropertyDNSSEC != 0 {
+		flags = append(flags, "dnssec")
+	}
+	if stamp.Props&dnsstamps.ServerInformalPropertyNoLog != 0 {
+		flags = append(flags, "no-log")
+	}
+	if stamp.Props&dnsstamps.ServerInformalPropertyNoFilter != 0 {
+		flags = append(flags, "no-filter")
+	}
+
+	if len(flags) == 0 {
+		return "-"
+	}
+
+	return strings.Join(flags, ",")
+}
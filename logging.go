@@ -0,0 +1,139 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+// logLevels are the supported values of the log level option.
+var logLevels = []string{"trace", "debug", "info", "warn", "error"}
+
+var (
+	loggingLock sync.Mutex
+	logLevel    = hclog.Info
+	logEncoding = logFormatText
+	logPath     string
+
+	// logFileHandle is the opened log file, logFileOpened its path.
+	logFileHandle *os.File
+	logFileOpened string
+
+	// loggingActive is set by setupLogging. Until then, changes to the
+	// logging options are only recorded so commands that apply the
+	// configuration keep logging to the terminal.
+	loggingActive bool
+)
+
+// setupLogging replaces the default logger with one using the configured
+// level, format and log file.
+func setupLogging() {
+	loggingLock.Lock()
+	defer loggingLock.Unlock()
+
+	loggingActive = true
+	configureLoggerLocked()
+}
+
+func setLogLevel(value string) {
+	level := hclog.LevelFromString(value)
+	if level == hclog.NoLevel {
+		if value != "" {
+			hclog.L().Error("unknown log level, using info", "level", value)
+		}
+
+		level = hclog.Info
+	}
+
+	loggingLock.Lock()
+	defer loggingLock.Unlock()
+
+	logLevel = level
+	configureLoggerLocked()
+}
+
+func setLogFormat(value string) {
+	format := logFormat(value)
+
+	switch format {
+	case logFormatText, logFormatJSON:
+	case "":
+		format = logFormatText
+	default:
+		hclog.L().Error("unknown log format, using text", "format", value)
+
+		format = logFormatText
+	}
+
+	loggingLock.Lock()
+	defer loggingLock.Unlock()
+
+	logEncoding = format
+	configureLoggerLocked()
+}
+
+func setLogFile(path string) {
+	loggingLock.Lock()
+	defer loggingLock.Unlock()
+
+	logPath = strings.TrimSpace(path)
+	configureLoggerLocked()
+}
+
+// configureLoggerLocked sets up the default logger. Logs are always
+// written to stderr, which is collected by the Portmaster, and in
+// addition to the log file if one is configured. It must be called with
+// loggingLock held.
+func configureLoggerLocked() {
+	if !loggingActive {
+		return
+	}
+
+	var previous *os.File
+	if logPath != logFileOpened {
+		previous = logFileHandle
+		logFileHandle, logFileOpened = nil, ""
+
+		if logPath != "" {
+			file, err := openLogFile(logPath)
+			if err != nil {
+				hclog.L().Error("failed to open log file", "path", logPath, "error", err)
+			} else {
+				logFileHandle, logFileOpened = file, logPath
+			}
+		}
+	}
+
+	var output io.Writer = os.Stderr
+	if logFileHandle != nil {
+		output = io.MultiWriter(os.Stderr, logFileHandle)
+	}
+
+	hclog.SetDefault(hclog.New(&hclog.LoggerOptions{
+		Level:      logLevel,
+		Output:     output,
+		JSONFormat: logEncoding == logFormatJSON,
+	}))
+
+	if previous != nil {
+		previous.Close()
+	}
+}
+
+// openLogFile opens the log file at path for appending. Relative paths are
+// resolved in the plugin data directory.
+func openLogFile(path string) (*os.File, error) {
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dataDirectory(), path)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	return os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+}
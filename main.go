@@ -2,10 +2,18 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"net/url"
 	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/ameshkov/dnscrypt/v2"
+	"github.com/ameshkov/dnsstamps"
 	"github.com/hashicorp/go-hclog"
 	"github.com/miekg/dns"
 	"github.com/safing/portmaster/plugin/framework"
@@ -13,13 +21,117 @@ import (
 	"github.com/safing/portmaster/plugin/shared"
 	"github.com/safing/portmaster/plugin/shared/proto"
 	"github.com/spf13/cobra"
+	"go.opentelemetry.io/otel/attribute"
 )
 
-var (
-	client dnscrypt.Client
+// transport exchanges DNS messages with an upstream server using one
+// of the supported encrypted DNS protocols.
+type transport interface {
+	exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, error)
+}
+
+// server is a configured upstream server together with the transport
+// used to query it.
+type server struct {
+	name      string
+	stamp     string
+	transport transport
+
+	rttLock   sync.Mutex
+	rtt       time.Duration
+	histogram latencyHistogram
+
+	health  health
+	cookies cookies
+}
+
+// observe records the response time of a successful exchange with
+// the server.
+func (srv *server) observe(d time.Duration) {
+	srv.rttLock.Lock()
+	defer srv.rttLock.Unlock()
+
+	if srv.rtt == 0 {
+		srv.rtt = d
+	} else {
+		// exponentially weighted moving average
+		srv.rtt = (srv.rtt*7 + d) / 8
+	}
+
+	srv.histogram.observe(d)
+}
+
+// latencyHistogram returns a copy of the latency histogram of the server.
+func (srv *server) latencyHistogram() latencyHistogram {
+	srv.rttLock.Lock()
+	defer srv.rttLock.Unlock()
+
+	return latencyHistogram{
+		Counts: slices.Clone(srv.histogram.Counts),
+	}
+}
+
+// inheritLatency takes over the latency measured for old, which srv
+// replaces.
+func (srv *server) inheritLatency(old *server) {
+	rtt, histogram := old.latency(), old.latencyHistogram()
+
+	srv.rttLock.Lock()
+	defer srv.rttLock.Unlock()
+
+	srv.rtt = rtt
+	srv.histogram = histogram
+}
+
+// latency returns the average response time of the server. It returns
+// zero if no query has been sent to the server yet.
+func (srv *server) latency() time.Duration {
+	srv.rttLock.Lock()
+	defer srv.rttLock.Unlock()
+
+	return srv.rtt
+}
 
+// exchange sends req to the server and returns the response.
+func (srv *server) exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	if timeout := queryTimeout.Load(); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(timeout)*time.Millisecond)
+		defer cancel()
+	}
+
+	if dnsCookies.Load() && req.IsEdns0() != nil {
+		return srv.exchangeWithCookie(ctx, req)
+	}
+
+	return srv.transport.exchange(ctx, req)
+}
+
+// pluginEnabled is cleared to pass all queries on to Portmaster without
+// uninstalling the plugin.
+var pluginEnabled atomic.Bool
+
+// defaultQueryTimeout is the default time in milliseconds a server may take
+// to answer a query before the next one is tried.
+const defaultQueryTimeout = 1000
+
+// queryTimeout holds the time in milliseconds a server may take to answer a
+// query. Queries are only limited by the deadline set by Portmaster if it's
+// zero.
+var queryTimeout atomic.Int64
+
+func setQueryTimeout(ms int64) {
+	queryTimeout.Store(max(ms, 0))
+}
+
+var (
 	resolverLock sync.RWMutex
-	resolverInfo *dnscrypt.ResolverInfo
+	servers      []*server
+
+	// active is the index of the server in servers that is tried first
+	// when using strategyFirstAvailable. It is moved to the next server
+	// whenever an exchange fails.
+	active int
 )
 
 func convertRRs(list []dns.RR) []*proto.DNSRR {
@@ -40,13 +152,25 @@ func convertRRs(list []dns.RR) []*proto.DNSRR {
 		case *dns.CNAME:
 			rType = dns.TypeCNAME
 			rData = []byte(v.Target)
+		case *dns.PTR:
+			// like CNAMEs, use the domain name instead of its wire format
+			rType = dns.TypePTR
+			rData = []byte(v.Ptr)
 		case *dns.TXT:
-			rType = dns.TypeCNAME
-			if len(v.Txt) > 0 {
-				rData = []byte(v.Txt[0])
-			}
+			// Portmaster turns the data into a single character-string
+			// so all strings are joined. That's how SPF and DKIM records
+			// are interpreted anyway.
+			rType = dns.TypeTXT
+			rData = []byte(strings.Join(v.Txt, ""))
 		default:
-			continue
+			var err error
+			rType = answer.Header().Rrtype
+			rData, err = packRData(answer)
+			if err != nil {
+				hclog.L().Warn("failed to pack resource record", "rr", answer.String(), "error", err)
+
+				continue
+			}
 		}
 
 		rrs = append(rrs, &proto.DNSRR{
@@ -61,127 +185,885 @@ func convertRRs(list []dns.RR) []*proto.DNSRR {
 	return rrs
 }
 
-func resolve(ctx context.Context, question *proto.DNSQuestion, conn *proto.Connection) (*proto.DNSResponse, error) {
-	resolverLock.RLock()
-	defer resolverLock.RUnlock()
+// packRData returns the RDATA of rr in wire format.
+func packRData(rr dns.RR) ([]byte, error) {
+	buf := make([]byte, dns.Len(rr))
 
-	if resolverInfo == nil {
-		return nil, nil
+	end, err := dns.PackRR(rr, buf, 0, nil, false)
+	if err != nil {
+		return nil, err
+	}
+
+	// the header consists of the owner name, type, class, TTL and the
+	// length of the RDATA.
+	nameEnd, err := dns.PackDomainName(rr.Header().Name, buf, 0, nil, false)
+	if err != nil {
+		return nil, err
 	}
 
+	return buf[nameEnd+10 : end], nil
+}
+
+// newRequest returns a query for question with all configured EDNS
+// options.
+func newRequest(question dns.Question) *dns.Msg {
 	req := &dns.Msg{}
 	req.Id = dns.Id()
 	req.RecursionDesired = true
-	req.Question = []dns.Question{
-		{
-			Name:   question.Name,
-			Qtype:  uint16(question.Type),
-			Qclass: uint16(question.Class),
-		},
+	req.Question = []dns.Question{question}
+
+	addEDNS(req)
+	requestDNSSEC(req)
+	padQuery(req)
+
+	return req
+}
+
+func resolve(ctx context.Context, question *proto.DNSQuestion, conn *proto.Connection) (*proto.DNSResponse, error) {
+	if !pluginEnabled.Load() {
+		return nil, nil
+	}
+
+	ctx, span := startSpan(ctx, "resolve",
+		attribute.String("dns.name", question.GetName()),
+		attribute.String("dns.type", dns.Type(question.GetType()).String()),
+	)
+
+	started := time.Now()
+
+	res, outcome, err := answer(ctx, question, conn)
+	countQuery(res, err)
+	recordUsage(question, res, err, outcome)
+	logQuery(question, conn, res, err, outcome, time.Since(started))
+	recordResolved(question, res, outcome)
+
+	span.SetAttributes(
+		attribute.String("dns.server", outcome.server),
+		attribute.String("dns.cache", string(outcome.cache)),
+	)
+	if res != nil {
+		span.SetAttributes(attribute.String("dns.rcode", dns.RcodeToString[int(res.GetRcode())]))
+	}
+	endSpan(span, err)
+
+	return res, err
+}
+
+// answer answers question using the cloaking rules, the cache or the
+// configured servers.
+func answer(ctx context.Context, question *proto.DNSQuestion, conn *proto.Connection) (*proto.DNSResponse, queryOutcome, error) {
+	// private addresses are only known to the local network so leave
+	// them to Portmaster.
+	if localReverse.Load() && isPrivateReverse(question.Name) {
+		return nil, queryOutcome{}, nil
+	}
+
+	// so are the names of captive portals blocking access to the servers
+	if captivePortalName(question.GetName()) {
+		return nil, queryOutcome{}, nil
+	}
+
+	if blockedType(uint16(question.GetType())) {
+		hclog.L().Debug("refusing query of blocked type", "name", question.Name, "type", dns.Type(question.GetType()))
+
+		return &proto.DNSResponse{
+			Rcode: dns.RcodeRefused,
+		}, queryOutcome{server: blocklistServer}, nil
+	}
+
+	if target, ok := cloakLookup(question.GetName()); ok {
+		return cloak(ctx, question, conn, target)
+	}
+
+	res, outcome, err := filteredLookup(ctx, question, conn)
+	if err == nil && needsDNS64(question, res) {
+		return synthesizeDNS64(ctx, question, conn, res, outcome)
+	}
+
+	return res, outcome, err
+}
+
+// filteredLookup answers question using lookup and blocks answers that
+// contain blocked or, for public domains, private addresses.
+func filteredLookup(ctx context.Context, question *proto.DNSQuestion, conn *proto.Connection) (*proto.DNSResponse, queryOutcome, error) {
+	res, outcome, err := lookup(ctx, question, conn)
+	if err == nil && blockedAnswer(res) && !allowed(question.GetName()) {
+		hclog.L().Debug("blocking answer containing a blocked IP", "name", question.Name)
+
+		return &proto.DNSResponse{
+			Rcode: dns.RcodeNameError,
+		}, queryOutcome{server: blocklistServer, cache: outcome.cache}, nil
+	}
+
+	if err == nil && rebinding(question.GetName(), res) {
+		hclog.L().Warn("blocking answer with private address for public domain", "name", question.Name, "server", outcome.server)
+
+		return &proto.DNSResponse{
+			Rcode: dns.RcodeNameError,
+		}, queryOutcome{server: blocklistServer, cache: outcome.cache}, nil
+	}
+
+	return res, outcome, err
+}
+
+// lookup answers question from the cache or using the configured servers
+// unless it's blocked.
+func lookup(ctx context.Context, question *proto.DNSQuestion, conn *proto.Connection) (*proto.DNSResponse, queryOutcome, error) {
+	if blocked(question.GetName()) {
+		hclog.L().Debug("blocking query", "name", question.Name)
+
+		return &proto.DNSResponse{
+			Rcode: dns.RcodeNameError,
+		}, queryOutcome{server: blocklistServer}, nil
+	}
+
+	_, span := startSpan(ctx, "cache lookup")
+	cached, prefetch, ok := cacheLookup(dnsQuestion(question), routingKey(conn))
+	span.SetAttributes(attribute.Bool("cache.hit", ok))
+	endSpan(span, nil)
+
+	if ok {
+		if prefetch {
+			go prefetchEntry(question, conn)
+		}
+
+		return toResponse(ctx, cached), queryOutcome{cache: cacheUseHit}, nil
 	}
 
-	result, err := client.Exchange(req, resolverInfo)
+	return resolveShared(ctx, question, conn)
+}
+
+// dnsQuestion converts question to its miekg/dns representation.
+func dnsQuestion(question *proto.DNSQuestion) dns.Question {
+	return dns.Question{
+		Name:   question.Name,
+		Qtype:  uint16(question.Type),
+		Qclass: uint16(question.Class),
+	}
+}
+
+// resolveUpstream sends question to the configured servers and caches
+// the response.
+func resolveUpstream(ctx context.Context, question *proto.DNSQuestion, conn *proto.Connection) (*proto.DNSResponse, queryOutcome, error) {
+	resolverLock.RLock()
+	list, start := servers, active
+	resolverLock.RUnlock()
+
+	cacheQuestion := dnsQuestion(question)
+	routing := routingKey(conn)
+	outcome := queryOutcome{cache: cacheUseMiss}
+
+	// forwarding rules may use plain DNS servers that are available
+	// even if no other server is
+	_, span := startSpan(ctx, "rule evaluation")
+	matched, restricted, err := ruleServers(list, question, conn)
+	span.SetAttributes(
+		attribute.Bool("rules.matched", restricted),
+		attribute.Int("rules.servers", len(matched)),
+	)
+	endSpan(span, err)
+
 	if err != nil {
-		return nil, err
+		if len(list) == 0 {
+			err = errNoServers
+		}
+
+		if res, ok := staleResponse(ctx, cacheQuestion, routing, err); ok {
+			return res, queryOutcome{cache: cacheUseStale}, nil
+		}
+
+		return fallback(outcome, err)
+	}
+
+	if restricted {
+		list, start = matched, 0
 	}
 
-	// TODO(ppacher): add support for extra and NS as well.
+	if len(list) == 0 {
+		if res, ok := staleResponse(ctx, cacheQuestion, routing, errNoServers); ok {
+			return res, queryOutcome{cache: cacheUseStale}, nil
+		}
+
+		return fallback(outcome, errNoServers)
+	}
+
+	req := newRequest(dns.Question{
+		Name:   question.Name,
+		Qtype:  uint16(question.Type),
+		Qclass: uint16(question.Class),
+	})
+
+	// changing the case does not change the length of the padded query
+	caseRandomized := randomizeCase.Load()
+	if caseRandomized {
+		req.Question[0].Name = randomCase(req.Question[0].Name)
+	}
+
+	ordered := orderServers(list, start)
+
+	key, sticky := stickyKey(conn)
+	if sticky {
+		preferSticky(key, ordered)
+	}
+
+	attempts := attemptOrder(ordered)
+
+	var (
+		lastErr  error
+		rejected *dns.Msg
+	)
+	for idx, srv := range attempts {
+		exchangeCtx, span := startSpan(ctx, "exchange",
+			attribute.String("dns.server", srv.name),
+			attribute.Int("dns.attempt", idx+1),
+		)
+
+		started := time.Now()
+
+		result, err := srv.exchange(exchangeCtx, req)
+		if err != nil {
+			endSpan(span, err)
+
+			hclog.L().Warn("failed to exchange DNS message", "server", srv.name, "error", err)
+			lastErr = err
+
+			// don't blame the server if the query has been canceled
+			if ctx.Err() != nil {
+				break
+			}
+
+			srv.reportFailure(err)
+
+			continue
+		}
+
+		srv.observe(time.Since(started))
+
+		if result.Rcode == dns.RcodeFormatError && req.IsEdns0() != nil {
+			// the server might not support EDNS or one of the options
+			if plain, err := srv.exchange(exchangeCtx, withoutEDNS(req)); err == nil {
+				result = plain
+			}
+		}
+
+		span.SetAttributes(attribute.String("dns.rcode", dns.RcodeToString[result.Rcode]))
+		endSpan(span, nil)
+
+		if caseRandomized {
+			if err := verifyCase(req, result, question.Name); err != nil {
+				hclog.L().Warn("discarding response", "server", srv.name, "error", err)
+				srv.reportFailure(err)
+				lastErr = err
+
+				continue
+			}
+		}
+
+		stripECS(result)
+
+		// give another server a chance if the query has been rejected
+		if isRejection(result.Rcode) && rejected == nil && idx < len(attempts)-1 {
+			hclog.L().Debug("server rejected query, retrying with the next server", "server", srv.name, "rcode", dns.RcodeToString[result.Rcode])
+
+			rejected = result
+			outcome.server = srv.name
+			req.Id = dns.Id()
+
+			continue
+		}
+
+		outcome.server = srv.name
+
+		if result.Rcode == dns.RcodeServerFailure {
+			srv.reportFailure(errServerFailure)
+		} else {
+			srv.reportSuccess()
+		}
+
+		if !restricted && srv != list[start] && getStrategy() == strategyFirstAvailable {
+			markActive(srv)
+		}
+
+		if sticky {
+			pinSticky(key, srv)
+		}
+
+		// bogus answers must not be resolved by other servers or
+		// Portmaster.
+		if err := checkDNSSEC(result, req.Question[0]); err != nil {
+			hclog.L().Warn("rejecting answer", "name", question.Name, "server", srv.name, "error", err)
+
+			return &proto.DNSResponse{
+				Rcode: dns.RcodeServerFailure,
+			}, outcome, nil
+		}
+
+		if flattenCNAME.Load() {
+			flattenCNAMEs(ctx, srv, result, cacheQuestion)
+		}
+
+		clampTTLs(result)
+		cacheStore(cacheQuestion, routing, result)
+
+		// The plugin protocol only carries the answer section and Portmaster
+		// places all returned records there, so authority and additional
+		// records cannot be passed on.
+		if len(result.Ns) > 0 || len(result.Extra) > 0 {
+			hclog.L().Trace("dropping authority and additional records", "name", question.Name, "ns", len(result.Ns), "extra", len(result.Extra))
+		}
+
+		return toResponse(ctx, result), outcome, nil
+	}
+
+	if rejected != nil {
+		return &proto.DNSResponse{
+			Rcode: responseRcode(rejected),
+		}, outcome, nil
+	}
+
+	if res, ok := staleResponse(ctx, cacheQuestion, routing, lastErr); ok {
+		return res, queryOutcome{cache: cacheUseStale}, nil
+	}
+
+	checkCaptivePortal()
+
+	return fallback(outcome, lastErr)
+}
+
+// staleResponse returns the expired cache entry for question resolved
+// using routing, if any, for queries that could not be answered by any
+// server because of err.
+func staleResponse(ctx context.Context, question dns.Question, routing string, err error) (*proto.DNSResponse, bool) {
+	stale, ok := cacheLookupStale(question, routing)
+	if !ok {
+		return nil, false
+	}
+
+	hclog.L().Debug("serving stale response", "name", question.Name, "error", err)
+
+	return toResponse(ctx, stale), true
+}
+
+// ruleServers returns the servers from list that match the forwarding,
+// application or network rules for the query, in that order of precedence.
+// The second return value is false if no rule matches.
+func ruleServers(list []*server, question *proto.DNSQuestion, conn *proto.Connection) ([]*server, bool, error) {
+	if matched, ok := forwardServers(list, question.GetName()); ok {
+		if len(matched) == 0 {
+			return nil, true, errNoForwardServer
+		}
+
+		return matched, true, nil
+	}
+
+	if matched, ok := applicationServers(list, conn); ok {
+		if len(matched) == 0 {
+			return nil, true, errNoApplicationServer
+		}
+
+		return matched, true, nil
+	}
+
+	if matched, ok := networkServers(list); ok {
+		if len(matched) == 0 {
+			return nil, true, errNoNetworkServer
+		}
+
+		return matched, true, nil
+	}
+
+	return nil, false, nil
+}
+
+// toResponse converts res to the response returned to Portmaster.
+func toResponse(ctx context.Context, res *dns.Msg) *proto.DNSResponse {
+	_, span := startSpan(ctx, "record conversion", attribute.Int("dns.answers", len(res.Answer)))
+	defer span.End()
 
 	return &proto.DNSResponse{
-		Rcode: uint32(result.Rcode),
-		Rrs:   convertRRs(result.Answer),
-	}, nil
+		Rcode: responseRcode(res),
+		Rrs:   convertRRs(res.Answer),
+	}
 }
 
-func getResolverInfo(server string) {
+// markActive makes srv the first one to try for future queries.
+// It's a no-op if srv has been removed from the server list in the
+// meantime.
+func markActive(srv *server) {
+	resolverLock.Lock()
+	defer resolverLock.Unlock()
 
+	for idx, s := range servers {
+		if s == srv {
+			hclog.L().Info("failing over to next server", "server", srv.name)
+
+			active = idx
+
+			return
+		}
+	}
+}
+
+// serverConfig is a server that should be dialed.
+type serverConfig struct {
+	name  string
+	stamp string
+}
+
+func getResolverInfo(cfg serverConfig) *server {
 	// Fetching and validating the server certificate
-	info, err := client.Dial(server)
+	srv, err := dialServer(cfg)
 	if err != nil {
-        _, err := framework.Notify().CreateNotification(framework.Context(), &proto.Notification{
-			EventId: "dnscrypt-invalid-stamp",
-			Title:   "DNSCrypt: Server Stamp invalid",
-			Message: err.Error(),
+		hclog.L().Error("failed to dial server", "server", cfg.name, "error", err)
+
+		notify(&proto.Notification{
+			EventId: "dnscrypt-invalid-stamp-" + cfg.name,
+			Title:   dialErrorTitle(err),
+			Message: fmt.Sprintf("%s: %s%s", cfg.name, err, describeStamp(cfg.stamp)),
 		})
-        if err != nil {
-		    hclog.L().Error("failed to create notification", "error", err)
-        }
 
+		return nil
+	}
+
+	return srv
+}
+
+// dialServer dials the server described by cfg using the transport
+// matching the protocol of the server stamp.
+func dialServer(cfg serverConfig) (*server, error) {
+	if isDoTURL(cfg.stamp) || isDoQURL(cfg.stamp) {
+		var (
+			t   transport
+			err error
+		)
+		if isDoTURL(cfg.stamp) {
+			t, err = parseDoTURL(cfg.stamp)
+		} else {
+			t, err = parseDoQURL(cfg.stamp)
+		}
+		if err != nil {
+			return nil, malformed(err)
+		}
+
+		return &server{
+			name:      cfg.name,
+			stamp:     cfg.stamp,
+			transport: t,
+		}, nil
+	}
+
+	stamp, err := dnsstamps.NewServerStampFromString(cfg.stamp)
+	if err != nil {
+		return nil, malformed(err)
+	}
+
+	var t transport
+	switch stamp.Proto {
+	case dnsstamps.StampProtoTypeDNSCrypt:
+		t, err = dialDNSCrypt(cfg.name, stamp)
+		if err != nil {
+			err = classifyDialError(err)
+		}
+	case dnsstamps.StampProtoTypeDoH:
+		t, err = newDoHTransport(stamp)
+	case dnsstamps.StampProtoTypeTLS:
+		t, err = newDoTTransport(stamp)
+	case dnsstamps.StampProtoTypeDoQ:
+		t, err = newDoQTransport(stamp)
+	default:
+		err = fmt.Errorf("unsupported stamp protocol %s", stamp.Proto.String())
+	}
+
+	if err != nil {
+		if !errors.Is(err, errUnreachable) && !errors.Is(err, errCertificate) {
+			err = malformed(err)
+		}
+
+		return nil, err
+	}
+
+	return &server{
+		name:      cfg.name,
+		stamp:     cfg.stamp,
+		transport: t,
+	}, nil
+}
+
+var (
+	reloadLock sync.Mutex
+
+	configLock      sync.Mutex
+	stampList       []serverConfig
+	configuredNames []string
+)
+
+// setStampList configures the servers that should be used, one per entry,
+// and re-dials all servers.
+func setStampList(values []string) {
+	var configs []serverConfig
+	for _, value := range values {
+		cfg, ok := parseStampEntry(value)
+		if !ok {
+			if strings.TrimSpace(value) != "" {
+				hclog.L().Error("ignoring invalid server stamp entry", "entry", value)
+			}
+
+			continue
+		}
+
+		configs = append(configs, cfg)
+	}
+
+	configLock.Lock()
+	stampList = configs
+	configLock.Unlock()
+
+	reloadServers()
+}
+
+// parseStampEntry parses an entry in the format "[<name>] <stamp>". Servers
+// without a name are named using stampName.
+func parseStampEntry(value string) (serverConfig, bool) {
+	fields := strings.Fields(value)
+
+	switch len(fields) {
+	case 1:
+		return serverConfig{
+			name:  stampName(fields[0]),
+			stamp: fields[0],
+		}, true
+	case 2:
+		return serverConfig{
+			name:  fields[0],
+			stamp: fields[1],
+		}, true
+	default:
+		return serverConfig{}, false
+	}
+}
+
+// setServerNames configures the names of the servers from the resolver
+// lists that should be used and re-dials all servers.
+func setServerNames(names []string) {
+	configLock.Lock()
+	configuredNames = names
+	configLock.Unlock()
+
+	reloadServers()
+}
+
+// reloadServers dials all configured servers and replaces the list of
+// servers used by resolve once all of them have been dialed. Servers that
+// cannot be dialed keep their previous connection if their configuration
+// did not change and are skipped otherwise. If none of the servers can be
+// dialed the previous list is kept.
+func reloadServers() {
+	if !configLoaded.Load() {
 		return
 	}
 
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	configs := configuredServers()
+
+	resolverLock.RLock()
+	previous := servers
+	resolverLock.RUnlock()
+
+	// dial all servers in parallel while queries are still served by the
+	// previous servers.
+	dialed := make([]*server, len(configs))
+
+	var wg sync.WaitGroup
+	for idx, cfg := range configs {
+		wg.Add(1)
+
+		go func(idx int, cfg serverConfig) {
+			defer wg.Done()
+
+			dialed[idx] = getResolverInfo(cfg)
+		}(idx, cfg)
+	}
+	wg.Wait()
+
+	var list []*server
+	for idx, cfg := range configs {
+		old := findServer(previous, cfg)
+
+		srv := dialed[idx]
+		switch {
+		case srv != nil && old != nil:
+			// keep the measured latency so load balancing does not
+			// start over
+			srv.inheritLatency(old)
+		case srv == nil && old != nil:
+			hclog.L().Warn("failed to dial server, keeping the previous connection", "server", cfg.name)
+
+			srv = old
+		case srv == nil:
+			continue
+		}
+
+		list = append(list, srv)
+	}
+
+	if len(list) == 0 && len(configs) > 0 && len(previous) > 0 {
+		hclog.L().Error("failed to dial any of the configured servers, keeping the previous servers")
+
+		return
+	}
+
+	// responses of the previous servers must not be served once the
+	// servers have been changed.
+	if len(previous) > 0 && !sameServers(previous, list) {
+		flushCache()
+	}
+
 	resolverLock.Lock()
 	defer resolverLock.Unlock()
 
-	resolverInfo = info
+	servers = list
+	active = 0
 }
 
-func setupAndWatchConfig(ctx context.Context) error {
-	if err := framework.Config().RegisterOption(ctx, &proto.Option{
-		Name:        "DNSCrypt Server",
-		Description: "Stamp of the DNSCrypt server",
-		Key:         "dnscryptServer",
-		OptionType:  proto.OptionType_OPTION_TYPE_STRING,
-		Default: &proto.Value{
-			String_: "",
-		},
-	}); err != nil {
-		return err
-	}
+// configuredServers returns the configured server stamps, without
+// duplicates, followed by the configured servers of the resolver lists
+// that satisfy the server requirements.
+func configuredServers() []serverConfig {
+	configLock.Lock()
+	entries := stampList
+	names := configuredNames
+	configLock.Unlock()
 
-	ch, err := framework.Config().WatchValue(framework.Context(), "dnscryptServer")
-	if err != nil {
-		return err
+	var configs []serverConfig
+	seen := make(map[string]bool)
+	for _, cfg := range entries {
+		if seen[cfg.stamp] {
+			continue
+		}
+		seen[cfg.stamp] = true
+
+		configs = append(configs, cfg)
 	}
 
-	go func() {
-		for msg := range ch {
-			getResolverInfo(msg.Value.String_)
+	filter := getFilter()
+
+	// servers configured by stamp must use an allowed address family
+	// just like the servers selected from the resolver lists
+	configs = slices.DeleteFunc(configs, func(cfg serverConfig) bool {
+		if filter.allowsStamp(cfg.stamp) {
+			return false
 		}
-	}()
 
-	val, err := framework.Config().GetValue(ctx, "dnscryptServer")
-	if err != nil {
-		return err
+		hclog.L().Warn("skipping server with an address of a disabled IP version, see the ipv4Servers and ipv6Servers settings", "name", cfg.name)
+
+		return true
+	})
+
+	for _, name := range names {
+		entry, ok := lookupServer(name)
+		if !ok {
+			hclog.L().Warn("server not found in resolver lists", "name", name)
+
+			continue
+		}
+
+		stamp, ok := filter.selectStamp(entry)
+		if !ok {
+			hclog.L().Warn("server does not match the configured requirements", "name", name)
+
+			continue
+		}
+
+		configs = append(configs, serverConfig{
+			name:  name,
+			stamp: stamp,
+		})
+	}
+
+	return configs
+}
+
+// sameServers returns true if a and b contain the same servers in the same
+// order.
+func sameServers(a, b []*server) bool {
+	if len(a) != len(b) {
+		return false
 	}
 
-	if srv := val.String_; srv != "" {
-		getResolverInfo(srv)
+	for idx := range a {
+		if a[idx].name != b[idx].name || a[idx].stamp != b[idx].stamp {
+			return false
+		}
+	}
+
+	return true
+}
+
+// findServer returns the server from list that has been dialed for cfg
+// or nil.
+func findServer(list []*server, cfg serverConfig) *server {
+	for _, srv := range list {
+		if srv.name == cfg.name && srv.stamp == cfg.stamp {
+			return srv
+		}
 	}
 
 	return nil
 }
 
+// hasName reports whether srv is referred to as name in other settings,
+// either by its configured name or by the provider name of its stamp.
+func (srv *server) hasName(name string) bool {
+	return srv.name == name || (srv.stamp != "" && stampName(srv.stamp) == name)
+}
+
+// stampName returns the name used for a server that is configured by
+// stamp rather than by name. That's the provider name for sdns:// stamps
+// and the host for tls:// and quic:// URLs.
+func stampName(stamp string) string {
+	if isDoTURL(stamp) || isDoQURL(stamp) {
+		if u, err := url.Parse(stamp); err == nil {
+			return u.Host
+		}
+	}
+
+	if parsed, err := dnsstamps.NewServerStampFromString(stamp); err == nil {
+		return parsed.ProviderName
+	}
+
+	return stamp
+}
+
+// protocolName returns the short name of the protocol used by stamp.
+func protocolName(stamp string) string {
+	switch {
+	case isDoTURL(stamp):
+		return "DoT"
+	case isDoQURL(stamp):
+		return "DoQ"
+	}
+
+	if parsed, err := dnsstamps.NewServerStampFromString(stamp); err == nil {
+		return parsed.Proto.String()
+	}
+
+	return "-"
+}
+
+// dataDirectory returns the directory the plugin stores cached data in.
+func dataDirectory() string {
+	return filepath.Join(framework.BaseDirectory(), "plugins", "data", framework.PluginName())
+}
+
 func main() {
 	rootCmd := &cobra.Command{
 		Use: "portmaster-plugin-dnscrypt",
 		Run: func(cmd *cobra.Command, args []string) {
-            err := framework.RegisterResolver(
+			err := framework.RegisterResolver(
 				framework.ResolverFunc(resolve),
 			)
-            if err != nil {
-                panic(err)
-            }
+			if err != nil {
+				panic(err)
+			}
+
+			err = framework.RegisterDecider(
+				framework.DeciderFunc(decide),
+			)
+			if err != nil {
+				panic(err)
+			}
+
+			err = framework.RegisterReporter(
+				framework.ReporterFunc(reportConnection),
+			)
+			if err != nil {
+				panic(err)
+			}
 
 			framework.OnInit(func(ctx context.Context) error {
+				setupLogging()
+				setupTracing()
+				setupPprof()
+
+				meta := getBuildMetadata()
+				hclog.L().Info("starting plugin", "version", meta.Version, "commit", meta.Commit)
+
+				setCertCacheFile(filepath.Join(dataDirectory(), "certs.json"))
+				setBlocklistCacheDir(filepath.Join(dataDirectory(), "blocklists"))
+				migrateConfig(
+					filepath.Join(dataDirectory(), "migrations.json"),
+					filepath.Join(framework.BaseDirectory(), "config.json"),
+					framework.PluginName(),
+				)
+
 				if err := setupAndWatchConfig(ctx); err != nil {
 					return err
 				}
 
+				loadCache(filepath.Join(dataDirectory(), "cache.json"))
+				loadSummary(filepath.Join(dataDirectory(), "summary.json"))
+
+				go watchSources(framework.Context(), filepath.Join(dataDirectory(), "sources"))
+				go refreshCertificates(framework.Context())
+				go probeServers(framework.Context())
+				go watchControlRequests(framework.Context(), dataDirectory())
+				go watchBlocklists(framework.Context())
+				go watchCaptivePortal(framework.Context())
+				go watchHostsFile(framework.Context())
+				go sendSummaries(framework.Context())
+
 				return nil
 			})
 
+			framework.OnShutdown(func(ctx context.Context) error {
+				queryLog.close()
+				nxLog.close()
+				connectionLog.close()
+				shutdownTracing(ctx)
+				stopPprof()
+
+				if err := saveSummary(filepath.Join(dataDirectory(), "summary.json")); err != nil {
+					hclog.L().Warn("failed to save summary", "error", err)
+				}
+
+				return saveCache(filepath.Join(dataDirectory(), "cache.json"))
+			})
+
 			framework.Serve()
 		},
 	}
 
 	rootCmd.AddCommand(
 		cmds.InstallCommand(&cmds.InstallCommandConfig{
-			PluginName: "portmaster-plugin-dnscrypt",
+			PluginName:   "portmaster-plugin-dnscrypt",
+			StaticConfig: registrationConfig(),
 			Types: []shared.PluginType{
 				shared.PluginTypeResolver,
+				shared.PluginTypeDecider,
+				shared.PluginTypeReporter,
 			},
 		}),
+		uninstallCommand(),
+		flushCacheCommand(),
+		cacheCommand(),
+		reloadCommand(),
+		testCommand(),
+		benchmarkCommand(),
+		listResolversCommand(),
+		fetchSourcesCommand(),
+		verifySourcesCommand(),
+		stampCommand(),
+		generateStampCommand(),
+		queryCommand(),
+		statusCommand(),
+		doctorCommand(),
+		showCertCommand(),
+		importCommand(),
+		exportCommand(),
+		versionCommand(),
+		pprofCommand(),
 	)
 
 	if err := rootCmd.Execute(); err != nil {
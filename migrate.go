@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/safing/portmaster/plugin/shared/proto"
+)
+
+// configMigration carries the value of an option over to the option that
+// replaced it.
+type configMigration struct {
+	from    string
+	to      string
+	convert func(raw interface{}) (*proto.Value, bool)
+}
+
+// configMigrations lists all migrations in the order they have been added.
+// Migrations must never be removed or reordered since the index of the
+// last applied migration is persisted.
+var configMigrations = []configMigration{
+	{
+		// the single "dnscryptServer" string has been replaced by the
+		// "serverStamps" list.
+		from: "dnscryptServer",
+		to:   "serverStamps",
+		convert: func(raw interface{}) (*proto.Value, bool) {
+			value, ok := raw.(string)
+			if !ok || strings.TrimSpace(value) == "" {
+				return nil, false
+			}
+
+			return &proto.Value{StringArray: parseStamps(value)}, true
+		},
+	},
+}
+
+// migrationState is persisted in the plugin data directory. Portmaster drops
+// values of options that are not registered anymore, so migrated values
+// are kept there until the user changes the new option.
+type migrationState struct {
+	Version int                     `json:"version"`
+	Values  map[string]*proto.Value `json:"values,omitempty"`
+}
+
+var (
+	migrationLock sync.Mutex
+	migrationFile string
+	migrations    migrationState
+)
+
+// migrateConfig applies all migrations that have not been applied yet using
+// the values stored for pluginName in the Portmaster configuration file.
+// Values of options that have been set by the user are never replaced.
+func migrateConfig(stateFile, configFile, pluginName string) {
+	migrationLock.Lock()
+	defer migrationLock.Unlock()
+
+	migrationFile = stateFile
+
+	if blob, err := os.ReadFile(stateFile); err == nil {
+		if err := json.Unmarshal(blob, &migrations); err != nil {
+			hclog.L().Warn("failed to parse migration state", "error", err)
+		}
+	}
+
+	if migrations.Version >= len(configMigrations) {
+		return
+	}
+
+	config, err := readPortmasterConfig(configFile)
+	if err != nil {
+		hclog.L().Error("failed to read configuration for migration", "error", err)
+
+		return
+	}
+
+	section := pluginSection(config, pluginName, false)
+	if migrations.Values == nil {
+		migrations.Values = make(map[string]*proto.Value)
+	}
+
+	for _, m := range configMigrations[migrations.Version:] {
+		raw, ok := section[m.from]
+		if !ok {
+			continue
+		}
+
+		if _, set := section[m.to]; set {
+			continue
+		}
+
+		if value, ok := m.convert(raw); ok {
+			hclog.L().Info("migrating configuration option", "from", m.from, "to", m.to)
+
+			migrations.Values[m.to] = value
+		}
+	}
+
+	migrations.Version = len(configMigrations)
+	saveMigrations()
+}
+
+// migratedValue returns the value migrated to key unless value has been
+// changed from the default of the option.
+func migratedValue(opt configOption, value *proto.Value) *proto.Value {
+	migrationLock.Lock()
+	defer migrationLock.Unlock()
+
+	migrated, ok := migrations.Values[opt.Key]
+	if !ok || !isDefault(opt, value) {
+		return value
+	}
+
+	return migrated
+}
+
+// forgetMigratedValue drops the value migrated to key once the user
+// configured the option.
+func forgetMigratedValue(key string) {
+	migrationLock.Lock()
+	defer migrationLock.Unlock()
+
+	if _, ok := migrations.Values[key]; !ok {
+		return
+	}
+
+	delete(migrations.Values, key)
+	saveMigrations()
+}
+
+// saveMigrations must be called with migrationLock held.
+func saveMigrations() {
+	if migrationFile == "" {
+		return
+	}
+
+	blob, err := json.Marshal(migrations)
+	if err != nil {
+		hclog.L().Error("failed to marshal migration state", "error", err)
+
+		return
+	}
+
+	if err := os.MkdirAll(filepath.Dir(migrationFile), 0755); err != nil {
+		hclog.L().Error("failed to create data directory", "error", err)
+
+		return
+	}
+
+	if err := os.WriteFile(migrationFile, blob, 0600); err != nil {
+		hclog.L().Error("failed to write migration state", "error", err)
+	}
+}
+
+// parseStamps splits value into a list of server stamps. Stamps may be
+// separated by whitespace or commas.
+func parseStamps(value string) []string {
+	return strings.FieldsFunc(value, func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	})
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+var (
+	// errInvalidSignature is returned if a minisign signature does not
+	// match the signed data.
+	errInvalidSignature = errors.New("invalid minisign signature")
+
+	// errKeyMismatch is returned if a minisign signature has been created
+	// by a different key than the one used for verification.
+	errKeyMismatch = errors.New("minisign signature created by a different key")
+)
+
+// minisignPublicKey is a minisign public key as used to sign the
+// resolver lists published by the DNSCrypt project.
+type minisignPublicKey struct {
+	keyID [8]byte
+	key   ed25519.PublicKey
+}
+
+// parseMinisignPublicKey parses a base64 encoded minisign public key.
+func parseMinisignPublicKey(s string) (*minisignPublicKey, error) {
+	bin, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("invalid minisign public key: %w", err)
+	}
+
+	if len(bin) != 2+8+ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid minisign public key: unexpected length %d", len(bin))
+	}
+
+	if string(bin[:2]) != "Ed" {
+		return nil, fmt.Errorf("invalid minisign public key: unsupported algorithm %q", bin[:2])
+	}
+
+	pk := &minisignPublicKey{
+		key: ed25519.PublicKey(bin[10:]),
+	}
+	copy(pk.keyID[:], bin[2:10])
+
+	return pk, nil
+}
+
+// ID returns the key ID of pk in the format printed by minisign.
+func (pk *minisignPublicKey) ID() string {
+	return formatKeyID(pk.keyID[:])
+}
+
+// formatKeyID formats the little-endian key ID id as minisign does.
+func formatKeyID(id []byte) string {
+	reversed := slices.Clone(id)
+	slices.Reverse(reversed)
+
+	return strings.ToUpper(hex.EncodeToString(reversed))
+}
+
+// verify verifies that sig is a valid minisign signature of data
+// created by pk. Both, legacy and pre-hashed signatures are
+// supported.
+func (pk *minisignPublicKey) verify(data []byte, sig []byte) error {
+	lines := strings.Split(strings.ReplaceAll(string(sig), "\r\n", "\n"), "\n")
+	if len(lines) < 4 {
+		return fmt.Errorf("%w: incomplete signature file", errInvalidSignature)
+	}
+
+	bin, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[1]))
+	if err != nil {
+		return fmt.Errorf("%w: %s", errInvalidSignature, err)
+	}
+
+	if len(bin) != 2+8+ed25519.SignatureSize {
+		return fmt.Errorf("%w: unexpected signature length %d", errInvalidSignature, len(bin))
+	}
+
+	if !bytes.Equal(bin[2:10], pk.keyID[:]) {
+		return fmt.Errorf("%w: signed by key %s, expected key %s", errKeyMismatch, formatKeyID(bin[2:10]), pk.ID())
+	}
+
+	signature := bin[10:]
+
+	switch string(bin[:2]) {
+	case "Ed":
+	case "ED":
+		hash := blake2b.Sum512(data)
+		data = hash[:]
+	default:
+		return fmt.Errorf("%w: unsupported algorithm %q", errInvalidSignature, bin[:2])
+	}
+
+	if !ed25519.Verify(pk.key, data, signature) {
+		return errInvalidSignature
+	}
+
+	const trustedPrefix = "trusted comment: "
+	if !strings.HasPrefix(lines[2], trustedPrefix) {
+		return fmt.Errorf("%w: missing trusted comment", errInvalidSignature)
+	}
+
+	globalSig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[3]))
+	if err != nil {
+		return fmt.Errorf("%w: %s", errInvalidSignature, err)
+	}
+
+	trusted := append(append([]byte{}, signature...), strings.TrimPrefix(lines[2], trustedPrefix)...)
+	if !ed25519.Verify(pk.key, trusted, globalSig) {
+		return fmt.Errorf("%w: trusted comment has been tampered with", errInvalidSignature)
+	}
+
+	return nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+// errNoNetworkServer is returned if none of the servers configured for the
+// current network is available.
+var errNoNetworkServer = errors.New("no server available for the current network")
+
+// ipv4Probe is a global IPv4 address used to find the local address of the
+// default route. No traffic is sent to it.
+const ipv4Probe = "9.9.9.9:53"
+
+// networkCheckInterval defines how long the local addresses of the default
+// routes are cached.
+const networkCheckInterval = 10 * time.Second
+
+// networkRule selects the servers used while the host is connected to a
+// network.
+type networkRule struct {
+	network netip.Prefix
+	servers []string
+}
+
+var (
+	networkLock  sync.RWMutex
+	networkRules []networkRule
+
+	localAddrLock    sync.Mutex
+	localAddrs       []netip.Addr
+	localAddrChecked time.Time
+)
+
+// setNetworkRules configures the servers that are used while the host is
+// connected to specific networks. Each entry has the format
+// "<network> <server> [<server>...]" where network is in CIDR notation.
+func setNetworkRules(values []string) {
+	var rules []networkRule
+
+	for _, value := range values {
+		fields := strings.Fields(value)
+		if len(fields) < 2 {
+			hclog.L().Error("ignoring invalid network rule", "rule", value)
+
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(fields[0])
+		if err != nil {
+			hclog.L().Error("ignoring invalid network rule", "rule", value, "error", err)
+
+			continue
+		}
+
+		rules = append(rules, networkRule{
+			network: prefix.Masked(),
+			servers: fields[1:],
+		})
+	}
+
+	networkLock.Lock()
+	networkRules = rules
+	networkLock.Unlock()
+}
+
+// defaultRouteAddrs returns the local addresses of the IPv4 and IPv6
+// default routes, which identify the network the host is connected to.
+func defaultRouteAddrs() []netip.Addr {
+	localAddrLock.Lock()
+	defer localAddrLock.Unlock()
+
+	if time.Since(localAddrChecked) < networkCheckInterval {
+		return localAddrs
+	}
+
+	var addrs []netip.Addr
+	for _, probe := range []string{ipv4Probe, ipv6Probe} {
+		// connecting a UDP socket only looks up the route without
+		// sending any packets.
+		conn, err := net.Dial("udp", probe)
+		if err != nil {
+			continue
+		}
+
+		if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok {
+			if ip, ok := netip.AddrFromSlice(addr.IP); ok {
+				addrs = append(addrs, ip.Unmap())
+			}
+		}
+		conn.Close()
+	}
+
+	localAddrs = addrs
+	localAddrChecked = time.Now()
+
+	return addrs
+}
+
+// networkServers returns the servers from list that are used on the
+// network the host is currently connected to. The first matching rule
+// wins. If no rule matches, servers referenced by network rules are
+// removed from list so they are only used on their networks. The second
+// return value is false if there are no network rules.
+func networkServers(list []*server) ([]*server, bool) {
+	networkLock.RLock()
+	defer networkLock.RUnlock()
+
+	if len(networkRules) == 0 {
+		return nil, false
+	}
+
+	addrs := defaultRouteAddrs()
+	for _, rule := range networkRules {
+		for _, addr := range addrs {
+			if rule.network.Contains(addr) {
+				return serversByName(list, rule.servers), true
+			}
+		}
+	}
+
+	var restricted []string
+	for _, rule := range networkRules {
+		restricted = append(restricted, rule.servers...)
+	}
+
+	var matched []*server
+	for _, srv := range list {
+		if !slices.ContainsFunc(restricted, srv.hasName) {
+			matched = append(matched, srv)
+		}
+	}
+
+	return matched, true
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+var (
+	networksLock   sync.RWMutex
+	serverNetworks map[string]string
+)
+
+// setServerNetworks configures the network used to query specific DNSCrypt
+// servers. Each entry has the format "<server> <udp|tcp>".
+func setServerNetworks(values []string) {
+	m := make(map[string]string)
+
+	for _, value := range values {
+		fields := strings.Fields(value)
+		if len(fields) != 2 || (fields[1] != "udp" && fields[1] != "tcp") {
+			hclog.L().Error("ignoring invalid server protocol", "protocol", value)
+
+			continue
+		}
+
+		m[fields[0]] = fields[1]
+	}
+
+	networksLock.Lock()
+	serverNetworks = m
+	networksLock.Unlock()
+}
+
+// networkFor returns the network used to query the DNSCrypt server with
+// name or the provider name of its stamp. That's "udp" unless configured
+// otherwise.
+func networkFor(name, provider string) string {
+	networksLock.RLock()
+	defer networksLock.RUnlock()
+
+	if network, ok := serverNetworks[name]; ok {
+		return network
+	}
+
+	if network, ok := serverNetworks[provider]; ok {
+		return network
+	}
+
+	return "udp"
+}
@@ -0,0 +1,19 @@
+package main
+
+import (
+	"github.com/hashicorp/go-hclog"
+	"github.com/safing/portmaster/plugin/framework"
+	"github.com/safing/portmaster/plugin/shared/proto"
+)
+
+// notify shows n to the user. Notifications are dropped if the plugin has
+// not been started by the Portmaster, e.g. when running a command.
+func notify(n *proto.Notification) {
+	if framework.Notify() == nil {
+		return
+	}
+
+	if _, err := framework.Notify().CreateNotification(framework.Context(), n); err != nil {
+		hclog.L().Error("failed to create notification", "error", err)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"math"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// suspiciousLabelLength is the length above which a label is
+	// considered suspicious. Legitimate labels are rarely that long while
+	// DNS tunnels use labels close to the maximum of 63 characters.
+	suspiciousLabelLength = 40
+
+	// randomMinLength is the minimum length of labels checked for looking
+	// randomly generated. Shorter labels cannot be told apart from words.
+	randomMinLength = 16
+
+	// randomEntropy is the fraction of the maximum Shannon entropy for the
+	// length of a label above which it may have been randomly generated,
+	// as done by domain generation algorithms.
+	randomEntropy = 0.85
+
+	// randomVowelRatio is the fraction of vowels below which a label with
+	// a high entropy is considered to be randomly generated. Words and
+	// brand names usually contain a lot more vowels.
+	randomVowelRatio = 0.25
+)
+
+// Reasons for logging a query to the NXDOMAIN log.
+const (
+	reasonNXDomain    = "nxdomain"
+	reasonLongLabel   = "long-label"
+	reasonHighEntropy = "high-entropy"
+)
+
+// nxLog is the log of queries that failed with NXDOMAIN or look
+// suspicious.
+var nxLog logFile
+
+func setNXLogFile(path string) {
+	nxLog.setPath(strings.TrimSpace(path))
+}
+
+// nxLogReason returns why the query described by entry must be written to
+// the NXDOMAIN log. The second return value is false if it must not be
+// logged.
+func nxLogReason(entry queryLogEntry) (string, bool) {
+	if entry.Rcode == dns.RcodeToString[dns.RcodeNameError] {
+		return reasonNXDomain, true
+	}
+
+	return suspiciousName(entry.Name)
+}
+
+// suspiciousName checks whether name contains very long or randomly
+// looking labels and returns the reason if it does. Reverse lookups are
+// never suspicious.
+func suspiciousName(name string) (string, bool) {
+	name = dns.CanonicalName(name)
+	if dns.IsSubDomain("arpa.", name) {
+		return "", false
+	}
+
+	for _, label := range dns.SplitDomainName(name) {
+		if len(label) > suspiciousLabelLength {
+			return reasonLongLabel, true
+		}
+
+		if looksRandom(label) {
+			return reasonHighEntropy, true
+		}
+	}
+
+	return "", false
+}
+
+// looksRandom returns true if label has a high entropy and only a few
+// vowels.
+func looksRandom(label string) bool {
+	if len(label) < randomMinLength {
+		return false
+	}
+
+	if labelEntropy(label)/math.Log2(float64(len(label))) < randomEntropy {
+		return false
+	}
+
+	vowels := 0
+	for _, r := range strings.ToLower(label) {
+		if strings.ContainsRune("aeiouy", r) {
+			vowels++
+		}
+	}
+
+	return float64(vowels)/float64(len(label)) < randomVowelRatio
+}
+
+// labelEntropy returns the Shannon entropy of label in bits per character.
+func labelEntropy(label string) float64 {
+	counts := make(map[rune]int)
+	for _, r := range label {
+		counts[r]++
+	}
+
+	var entropy float64
+	for _, count := range counts {
+		p := float64(count) / float64(len(label))
+		entropy -= p * math.Log2(p)
+	}
+
+	return entropy
+}
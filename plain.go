@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// plainTransport sends unencrypted queries to a plain DNS server. It's only
+// used for forwarding rules, e.g. for the zones of a company or homelab
+// network that the encrypted servers cannot resolve. Queries are sent
+// directly, never through the configured proxy, as such servers are
+// usually only reachable from the local network.
+type plainTransport struct {
+	addr string
+}
+
+// plainServerAddr returns the address of the plain DNS server described by
+// value, an IP address with an optional port. The second return value is
+// false if value is not an address.
+func plainServerAddr(value string) (string, bool) {
+	if ip := net.ParseIP(value); ip != nil {
+		return net.JoinHostPort(ip.String(), "53"), true
+	}
+
+	host, port, err := net.SplitHostPort(value)
+	if err != nil {
+		return "", false
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return "", false
+	}
+
+	return net.JoinHostPort(ip.String(), port), true
+}
+
+// newPlainServer returns a server using a plain DNS transport for addr.
+func newPlainServer(addr string) *server {
+	return &server{
+		name:      addr,
+		transport: &plainTransport{addr: addr},
+	}
+}
+
+func (t *plainTransport) exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	client := &dns.Client{
+		Net:     "udp",
+		UDPSize: dns.MaxMsgSize,
+	}
+
+	res, _, err := client.ExchangeContext(ctx, req, t.addr)
+	if err == nil && res.Truncated {
+		client.Net = "tcp"
+		res, _, err = client.ExchangeContext(ctx, req, t.addr)
+	}
+
+	return res, err
+}
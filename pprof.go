@@ -0,0 +1,207 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/spf13/cobra"
+)
+
+const (
+	// pprofStartFile and pprofStopFile are the names of the files in the
+	// plugin data directory that request the running plugin to start or
+	// stop the pprof endpoint. The address of the endpoint is written to
+	// pprofResponseFile.
+	pprofStartFile    = "start-pprof"
+	pprofStopFile     = "stop-pprof"
+	pprofResponseFile = "pprof.json"
+
+	// pprofEnv is the environment variable holding the address of a pprof
+	// endpoint to start together with the plugin.
+	pprofEnv = envPrefix + "PPROF"
+
+	// defaultPprofAddress lets the operating system pick a free port.
+	defaultPprofAddress = "127.0.0.1:0"
+)
+
+// errPprofNotLoopback is returned for pprof addresses other than loopback
+// addresses, as the profiles contain the memory of the plugin.
+var errPprofNotLoopback = errors.New("the pprof endpoint must listen on a loopback address")
+
+// pprofStatus is the response to pprof requests.
+type pprofStatus struct {
+	// Address is the address the endpoint listens on, empty if it's
+	// stopped.
+	Address string `json:"address,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+var (
+	pprofLock     sync.Mutex
+	pprofServer   *http.Server
+	pprofListener net.Listener
+)
+
+// setupPprof starts the pprof endpoint if the pprof environment variable
+// is set.
+func setupPprof() {
+	address, ok := os.LookupEnv(pprofEnv)
+	if !ok {
+		return
+	}
+
+	if _, err := startPprof(address); err != nil {
+		hclog.L().Error("failed to start pprof endpoint", "address", address, "error", err)
+	}
+}
+
+// startPprof serves the pprof handlers on address and returns the address
+// the endpoint listens on. The address of the running endpoint is returned
+// if it has already been started.
+func startPprof(address string) (string, error) {
+	if address == "" {
+		address = defaultPprofAddress
+	}
+
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", err
+	}
+
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return "", errPprofNotLoopback
+	}
+
+	pprofLock.Lock()
+	defer pprofLock.Unlock()
+
+	if pprofListener != nil {
+		return pprofListener.Addr().String(), nil
+	}
+
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		return "", err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	srv := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			hclog.L().Error("pprof endpoint failed", "error", err)
+		}
+	}()
+
+	pprofServer, pprofListener = srv, ln
+
+	hclog.L().Warn("started pprof endpoint", "address", ln.Addr().String())
+
+	return ln.Addr().String(), nil
+}
+
+// stopPprof stops the pprof endpoint, if it's running.
+func stopPprof() {
+	pprofLock.Lock()
+	defer pprofLock.Unlock()
+
+	if pprofServer == nil {
+		return
+	}
+
+	if err := pprofServer.Close(); err != nil {
+		hclog.L().Warn("failed to stop pprof endpoint", "error", err)
+	}
+
+	pprofServer, pprofListener = nil, nil
+
+	hclog.L().Info("stopped pprof endpoint")
+}
+
+// handlePprofStart handles the request to start the pprof endpoint.
+func handlePprofStart(dir string) {
+	var status pprofStatus
+
+	address, err := startPprof(defaultPprofAddress)
+	if err != nil {
+		status.Error = err.Error()
+	}
+	status.Address = address
+
+	writeControlResponse(dir, pprofResponseFile, status)
+}
+
+// handlePprofStop handles the request to stop the pprof endpoint.
+func handlePprofStop(dir string) {
+	stopPprof()
+
+	writeControlResponse(dir, pprofResponseFile, pprofStatus{})
+}
+
+// pprofCommand is hidden as it's only needed to debug the resource usage
+// of the plugin.
+func pprofCommand() *cobra.Command {
+	var (
+		flags   installFlags
+		timeout time.Duration
+		stop    bool
+	)
+
+	cmd := &cobra.Command{
+		Use:    "pprof",
+		Short:  "Start a pprof endpoint on localhost in the running plugin",
+		Hidden: true,
+		Args:   cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+
+			request := pprofStartFile
+			if stop {
+				request = pprofStopFile
+			}
+
+			var status pprofStatus
+			if err := requestControlResponse(flags.dataDirectory(), request, pprofResponseFile, timeout, &status); err != nil {
+				return err
+			}
+
+			if status.Error != "" {
+				return errors.New(status.Error)
+			}
+
+			if status.Address == "" {
+				fmt.Fprintln(cmd.OutOrStdout(), "Stopped the pprof endpoint.")
+
+				return nil
+			}
+
+			fmt.Fprintf(cmd.OutOrStdout(), "pprof endpoint listening on http://%s/debug/pprof/\n\n", status.Address)
+			fmt.Fprintf(cmd.OutOrStdout(), "Capture a CPU profile:  go tool pprof http://%s/debug/pprof/profile?seconds=30\n", status.Address)
+			fmt.Fprintf(cmd.OutOrStdout(), "Capture a heap profile: go tool pprof http://%s/debug/pprof/heap\n", status.Address)
+
+			return nil
+		},
+	}
+
+	flags.register(cmd)
+	cmd.Flags().DurationVar(&timeout, "timeout", 3*controlInterval, "Time to wait for the running plugin to answer")
+	cmd.Flags().BoolVar(&stop, "stop", false, "Stop the pprof endpoint")
+
+	return cmd
+}
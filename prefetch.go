@@ -0,0 +1,26 @@
+package main
+
+import (
+	"context"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/safing/portmaster/plugin/framework"
+	"github.com/safing/portmaster/plugin/shared/proto"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// prefetchEntry refreshes the cached response for question in the
+// background.
+func prefetchEntry(question *proto.DNSQuestion, conn *proto.Connection) {
+	ctx, cancel := context.WithTimeout(framework.Context(), defaultTimeout)
+	defer cancel()
+
+	ctx, span := startSpan(ctx, "prefetch", attribute.String("dns.name", question.GetName()))
+
+	_, _, err := resolveUpstream(ctx, question, conn)
+	endSpan(span, err)
+
+	if err != nil {
+		hclog.L().Debug("failed to prefetch cache entry", "name", question.Name, "error", err)
+	}
+}
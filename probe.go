@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/miekg/dns"
+)
+
+// defaultProbeInterval is the default interval in minutes at which latency
+// probes are sent to all servers.
+const defaultProbeInterval = 10
+
+var (
+	// probeInterval holds the configured probe interval in minutes. Probing
+	// is disabled if it's zero.
+	probeInterval atomic.Int64
+
+	probeIntervalChanged = make(chan struct{}, 1)
+)
+
+func setProbeInterval(minutes int64) {
+	if minutes < 0 {
+		minutes = 0
+	}
+
+	probeInterval.Store(minutes)
+
+	select {
+	case probeIntervalChanged <- struct{}{}:
+	default:
+	}
+}
+
+// probeServers periodically sends a lightweight query to each server and
+// records the response time so load balancing can prefer the fastest
+// servers even if they did not receive any regular queries yet.
+func probeServers(ctx context.Context) {
+	for {
+		if probeInterval.Load() > 0 {
+			probeAll(ctx)
+		}
+
+		var tick <-chan time.Time
+		if interval := time.Duration(probeInterval.Load()) * time.Minute; interval > 0 {
+			tick = time.After(interval)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-probeIntervalChanged:
+		case <-tick:
+		}
+	}
+}
+
+// probeAll probes all servers and logs the measured latencies.
+func probeAll(ctx context.Context) {
+	if !pluginEnabled.Load() {
+		return
+	}
+
+	resolverLock.RLock()
+	list := servers
+	resolverLock.RUnlock()
+
+	for _, srv := range list {
+		rtt, err := probe(ctx, srv)
+		if err != nil {
+			hclog.L().Warn("latency probe failed", "server", srv.name, "error", err)
+
+			continue
+		}
+
+		hclog.L().Info("latency probe", "server", srv.name, "rtt", rtt, "average", srv.latency())
+	}
+}
+
+// probe sends a query for the root NS records to srv and returns the
+// response time.
+func probe(ctx context.Context, srv *server) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	req := new(dns.Msg)
+	req.SetQuestion(".", dns.TypeNS)
+
+	started := time.Now()
+	if _, err := srv.exchange(ctx, req); err != nil {
+		return 0, err
+	}
+
+	rtt := time.Since(started)
+	srv.observe(rtt)
+
+	return rtt, nil
+}
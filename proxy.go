@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+
+	"github.com/hashicorp/go-hclog"
+	"golang.org/x/net/proxy"
+)
+
+// defaultTorProxy is the SOCKS port of a local Tor daemon.
+const defaultTorProxy = "127.0.0.1:9050"
+
+// errProxyUDP is returned when trying to send UDP traffic while a proxy
+// is configured. SOCKS5 proxies are only used for TCP.
+var errProxyUDP = errors.New("UDP is not supported through the proxy")
+
+var (
+	proxyLock sync.RWMutex
+	proxyAddr string
+	proxyAuth *proxy.Auth
+	torMode   bool
+
+	// torSession is used as the password when isolating Tor circuits so
+	// circuits are not shared with other applications or previous runs of
+	// the plugin.
+	torSession = newTorSession()
+)
+
+func newTorSession() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+
+	return hex.EncodeToString(b[:])
+}
+
+// setProxy configures the SOCKS5 proxy all upstream traffic is sent
+// through. value must be in the format "socks5://[user:password@]host:port"
+// or empty to connect directly.
+func setProxy(value string) {
+	addr, auth, err := parseProxy(value)
+	if err != nil {
+		hclog.L().Error("invalid proxy, connecting directly", "proxy", value, "error", err)
+	}
+
+	proxyLock.Lock()
+	proxyAddr, proxyAuth = addr, auth
+	proxyLock.Unlock()
+
+	reloadServers()
+}
+
+// setTorMode enables or disables routing all upstream traffic through
+// Tor.
+func setTorMode(enabled bool) {
+	proxyLock.Lock()
+	torMode = enabled
+	proxyLock.Unlock()
+
+	reloadServers()
+}
+
+// parseProxy parses a SOCKS5 proxy URL and returns the address and
+// credentials of the proxy. It returns an empty address if value
+// is empty.
+func parseProxy(value string) (string, *proxy.Auth, error) {
+	if value == "" {
+		return "", nil, nil
+	}
+
+	u, err := url.Parse(value)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if u.Scheme != "socks5" && u.Scheme != "socks5h" {
+		return "", nil, fmt.Errorf("unsupported proxy scheme %q", u.Scheme)
+	}
+
+	var auth *proxy.Auth
+	if u.User != nil {
+		auth = &proxy.Auth{
+			User: u.User.Username(),
+		}
+		auth.Password, _ = u.User.Password()
+	}
+
+	return u.Host, auth, nil
+}
+
+// proxyEnabled reports whether upstream traffic is sent through a proxy.
+func proxyEnabled() bool {
+	proxyLock.RLock()
+	defer proxyLock.RUnlock()
+
+	return proxyAddr != "" || torMode
+}
+
+// dialNetwork connects to addr either directly or through the configured
+// proxy. In Tor mode each destination address uses its own credentials
+// so Tor builds a separate circuit for each upstream server.
+func dialNetwork(ctx context.Context, network, addr string) (net.Conn, error) {
+	proxyLock.RLock()
+	socksAddr, auth, tor := proxyAddr, proxyAuth, torMode
+	proxyLock.RUnlock()
+
+	if socksAddr == "" && !tor {
+		var direct net.Dialer
+
+		return direct.DialContext(ctx, network, addr)
+	}
+
+	if network != "tcp" && network != "tcp4" && network != "tcp6" {
+		return nil, errProxyUDP
+	}
+
+	if tor {
+		if socksAddr == "" {
+			socksAddr = defaultTorProxy
+		}
+
+		auth = &proxy.Auth{
+			User:     addr,
+			Password: torSession,
+		}
+	}
+
+	dialer, err := proxy.SOCKS5("tcp", socksAddr, auth, proxy.Direct)
+	if err != nil {
+		return nil, err
+	}
+
+	contextDialer, ok := dialer.(proxy.ContextDialer)
+	if !ok {
+		return nil, fmt.Errorf("proxy dialer does not support contexts")
+	}
+
+	return contextDialer.DialContext(ctx, network, addr)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/spf13/cobra"
+)
+
+// queryCommand returns the command that sends a single query to the
+// configured servers and prints the response.
+func queryCommand() *cobra.Command {
+	var (
+		flags    installFlags
+		servers  []string
+		dnssecOK bool
+	)
+
+	cmd := &cobra.Command{
+		Use:   "query <name> [type]",
+		Short: "Resolve a name using the configured servers and print the response",
+		Long:  "Resolve a name using the servers configured in the Portmaster, or the servers given using --server, and print all sections of the response. Servers are tried in order until one of them answers.",
+		Args:  cobra.RangeArgs(1, 2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+
+			qtype := dns.TypeA
+			if len(args) > 1 {
+				t, ok := dns.StringToType[strings.ToUpper(args[1])]
+				if !ok {
+					return fmt.Errorf("unknown record type %q", args[1])
+				}
+
+				qtype = t
+			}
+
+			configs, err := flags.selectServers(cmd.Context(), servers)
+			if err != nil {
+				return err
+			}
+
+			if len(configs) == 0 {
+				if err := flags.applyConfig(cmd.Context()); err != nil {
+					return err
+				}
+
+				configs = configuredServers()
+			}
+
+			if len(configs) == 0 {
+				return errors.New("no servers configured, use --server to specify one")
+			}
+
+			req := new(dns.Msg)
+			req.SetQuestion(dns.Fqdn(args[0]), qtype)
+			req.SetEdns0(dns.DefaultMsgSize, dnssecOK)
+
+			for _, cfg := range configs {
+				if err := queryServer(cmd, cfg, req); err != nil {
+					cmd.PrintErrf(";; %s: %s\n", cfg.name, err)
+
+					continue
+				}
+
+				return nil
+			}
+
+			return errors.New("none of the servers answered the query")
+		},
+	}
+
+	flags.register(cmd)
+	cmd.Flags().StringArrayVar(&servers, "server", nil, "Stamp or configured name of a server to query instead of all configured servers")
+	_ = cmd.RegisterFlagCompletionFunc("server", flags.completeServerNames)
+	cmd.Flags().BoolVar(&dnssecOK, "dnssec", false, "Request DNSSEC records")
+
+	return cmd
+}
+
+// queryServer dials the server described by cfg, sends req to it and
+// prints the response together with the dial and query time.
+func queryServer(cmd *cobra.Command, cfg serverConfig, req *dns.Msg) error {
+	started := time.Now()
+	srv, err := dialServer(cfg)
+	if err != nil {
+		return err
+	}
+	dialTime := time.Since(started)
+
+	ctx, cancel := context.WithTimeout(cmd.Context(), defaultTimeout)
+	defer cancel()
+
+	started = time.Now()
+	res, err := srv.exchange(ctx, req.Copy())
+	if err != nil {
+		return err
+	}
+	queryTime := time.Since(started)
+
+	fmt.Fprintln(cmd.OutOrStdout(), res.String())
+	fmt.Fprintf(cmd.OutOrStdout(), ";; SERVER: %s (%s)\n", cfg.name, protocolName(cfg.stamp))
+	fmt.Fprintf(cmd.OutOrStdout(), ";; DIAL TIME: %s\n", dialTime.Round(time.Millisecond))
+	fmt.Fprintf(cmd.OutOrStdout(), ";; QUERY TIME: %s\n", queryTime.Round(time.Millisecond))
+	fmt.Fprintf(cmd.OutOrStdout(), ";; MSG SIZE rcvd: %d\n", res.Len())
+
+	return nil
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/miekg/dns"
+	"github.com/safing/portmaster/plugin/shared/proto"
+)
+
+// cacheUse describes whether a query has been answered from the cache.
+type cacheUse string
+
+const (
+	cacheUseHit   = cacheUse("hit")
+	cacheUseStale = cacheUse("stale")
+	cacheUseMiss  = cacheUse("miss")
+)
+
+// queryOutcome describes how a query has been answered.
+type queryOutcome struct {
+	// server is the name of the server that answered the query, if any.
+	server string
+
+	// cache is whether the response has been taken from the cache.
+	cache cacheUse
+}
+
+// logFormat is the format entries are written to a log file in.
+type logFormat string
+
+const (
+	// logFormatText writes one tab separated line per entry.
+	logFormatText = logFormat("text")
+
+	// logFormatJSON writes one JSON object per line.
+	logFormatJSON = logFormat("json")
+)
+
+// logFile is a file log entries are appended to. The file is opened on
+// the first write so commands that only apply the configuration never
+// create it.
+type logFile struct {
+	lock sync.Mutex
+	path string
+	file *os.File
+}
+
+// setPath changes the path of the log file. An empty path disables the
+// log.
+func (l *logFile) setPath(path string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if path == l.path {
+		return
+	}
+
+	l.closeLocked()
+	l.path = path
+}
+
+// enabled returns true if a path is configured.
+func (l *logFile) enabled() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.path != ""
+}
+
+// write appends line to the log file.
+func (l *logFile) write(line []byte) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.path == "" {
+		return
+	}
+
+	if l.file == nil {
+		file, err := openLogFile(l.path)
+		if err != nil {
+			hclog.L().Error("failed to open log file", "path", l.path, "error", err)
+
+			return
+		}
+
+		l.file = file
+	}
+
+	if _, err := l.file.Write(line); err != nil {
+		hclog.L().Error("failed to write log file", "path", l.path, "error", err)
+
+		// try to open the file again on the next write
+		l.closeLocked()
+	}
+}
+
+// close closes the log file. It's opened again on the next write.
+func (l *logFile) close() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.closeLocked()
+}
+
+func (l *logFile) closeLocked() {
+	if l.file == nil {
+		return
+	}
+
+	if err := l.file.Close(); err != nil {
+		hclog.L().Warn("failed to close log file", "path", l.path, "error", err)
+	}
+
+	l.file = nil
+}
+
+// queryLogEntry is an entry of the query log.
+type queryLogEntry struct {
+	Time    time.Time `json:"time"`
+	Name    string    `json:"name"`
+	Type    string    `json:"type"`
+	Rcode   string    `json:"rcode"`
+	Server  string    `json:"server"`
+	Latency float64   `json:"latencyMs"`
+	Cache   cacheUse  `json:"cache"`
+	App     string    `json:"app,omitempty"`
+	PID     int64     `json:"pid,omitempty"`
+
+	// Reason is why the query has been written to the NXDOMAIN log.
+	Reason string `json:"reason,omitempty"`
+}
+
+var (
+	queryLog       logFile
+	queryLogFormat atomic.Value
+)
+
+func setQueryLogFile(path string) {
+	queryLog.setPath(strings.TrimSpace(path))
+}
+
+func setQueryLogFormat(value string) {
+	format := logFormat(value)
+
+	switch format {
+	case logFormatText, logFormatJSON:
+	case "":
+		format = logFormatText
+	default:
+		hclog.L().Error("unknown query log format, using text", "format", value)
+
+		format = logFormatText
+	}
+
+	queryLogFormat.Store(format)
+}
+
+func getQueryLogFormat() logFormat {
+	if f, ok := queryLogFormat.Load().(logFormat); ok {
+		return f
+	}
+
+	return logFormatText
+}
+
+// logQuery writes question and the result of resolving it to the query
+// log and, if it failed with NXDOMAIN or looks suspicious, to the NXDOMAIN
+// log. Queries left to Portmaster are logged with the server "portmaster".
+func logQuery(question *proto.DNSQuestion, conn *proto.Connection, res *proto.DNSResponse, err error, outcome queryOutcome, latency time.Duration) {
+	logQueries, logNX := queryLog.enabled(), nxLog.enabled()
+	if !logQueries && !logNX {
+		return
+	}
+
+	entry := queryLogEntry{
+		Time:    time.Now(),
+		Name:    question.GetName(),
+		Type:    dns.Type(question.GetType()).String(),
+		Server:  outcome.server,
+		Latency: float64(latency.Microseconds()) / 1000,
+		Cache:   outcome.cache,
+	}
+
+	switch {
+	case err != nil:
+		entry.Rcode = "ERROR"
+	case res == nil:
+		entry.Rcode = "-"
+		entry.Server = "portmaster"
+	default:
+		entry.Rcode = dns.RcodeToString[int(res.GetRcode())]
+	}
+
+	if entry.Server == "" {
+		entry.Server = "-"
+	}
+	if entry.Cache == "" {
+		entry.Cache = cacheUseMiss
+	}
+
+	if process := conn.GetProcess(); process != nil {
+		entry.App = process.GetName()
+		entry.PID = process.GetProcessId()
+	}
+
+	format := getQueryLogFormat()
+
+	if logQueries {
+		queryLog.write(formatQueryLogEntry(entry, format))
+	}
+
+	if logNX {
+		if reason, ok := nxLogReason(entry); ok {
+			entry.Reason = reason
+			nxLog.write(formatQueryLogEntry(entry, format))
+		}
+	}
+}
+
+// formatQueryLogEntry returns entry as a line in format.
+func formatQueryLogEntry(entry queryLogEntry, format logFormat) []byte {
+	if format == logFormatJSON {
+		blob, err := json.Marshal(entry)
+		if err != nil {
+			return nil
+		}
+
+		return append(blob, '\n')
+	}
+
+	app := "-"
+	if entry.App != "" {
+		app = fmt.Sprintf("%s(%d)", entry.App, entry.PID)
+	}
+
+	line := fmt.Sprintf("%s\t%s\t%s\t%s\t%s\t%s\t%.1fms\t%s",
+		entry.Time.Format(time.RFC3339),
+		app,
+		entry.Name,
+		entry.Type,
+		entry.Rcode,
+		entry.Server,
+		entry.Latency,
+		entry.Cache,
+	)
+	if entry.Reason != "" {
+		line += "\t" + entry.Reason
+	}
+
+	return []byte(line + "\n")
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/miekg/dns"
+)
+
+var (
+	blockedTypesLock sync.RWMutex
+	blockedTypes     map[uint16]struct{}
+)
+
+// parseQueryType parses the name of a query type, e.g. "TXT", or its
+// generic representation, e.g. "TYPE65".
+func parseQueryType(value string) (uint16, error) {
+	value = strings.ToUpper(strings.TrimSpace(value))
+
+	if qtype, ok := dns.StringToType[value]; ok {
+		return qtype, nil
+	}
+
+	if number, ok := strings.CutPrefix(value, "TYPE"); ok {
+		if qtype, err := strconv.ParseUint(number, 10, 16); err == nil {
+			return uint16(qtype), nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown query type %q", value)
+}
+
+// setBlockedQueryTypes configures the query types that are refused.
+func setBlockedQueryTypes(values []string) {
+	m := make(map[uint16]struct{})
+
+	for _, value := range values {
+		qtype, err := parseQueryType(value)
+		if err != nil {
+			hclog.L().Error("ignoring invalid query type", "type", value, "error", err)
+
+			continue
+		}
+
+		m[qtype] = struct{}{}
+	}
+
+	blockedTypesLock.Lock()
+	blockedTypes = m
+	blockedTypesLock.Unlock()
+}
+
+// blockedType reports whether queries of qtype are refused.
+func blockedType(qtype uint16) bool {
+	blockedTypesLock.RLock()
+	defer blockedTypesLock.RUnlock()
+
+	_, ok := blockedTypes[qtype]
+
+	return ok
+}
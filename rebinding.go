@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+	"github.com/safing/portmaster/plugin/shared/proto"
+	"golang.org/x/net/publicsuffix"
+)
+
+var (
+	// rebindingProtection enables rejecting answers for public domains
+	// that contain private addresses.
+	rebindingProtection atomic.Bool
+
+	rebindingLock    sync.RWMutex
+	rebindingAllowed map[string]struct{}
+)
+
+// setRebindingAllowlist configures the domains that may resolve to private
+// addresses.
+func setRebindingAllowlist(values []string) {
+	domains := make(map[string]struct{})
+	for _, value := range values {
+		if value = strings.TrimSpace(value); value != "" {
+			domains[dns.CanonicalName(strings.TrimPrefix(value, "*."))] = struct{}{}
+		}
+	}
+
+	rebindingLock.Lock()
+	rebindingAllowed = domains
+	rebindingLock.Unlock()
+}
+
+// rebinding reports whether res is the answer for a public domain that
+// contains a private, loopback or link-local address, as used by DNS
+// rebinding attacks against devices in the local network.
+func rebinding(name string, res *proto.DNSResponse) bool {
+	if !rebindingProtection.Load() || !publicDomain(name) {
+		return false
+	}
+
+	found := false
+	for _, rr := range res.GetRrs() {
+		if t := uint16(rr.GetType()); t != dns.TypeA && t != dns.TypeAAAA {
+			continue
+		}
+
+		ip := net.IP(rr.GetData())
+		if ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() {
+			found = true
+
+			break
+		}
+	}
+
+	if !found {
+		return false
+	}
+
+	rebindingLock.RLock()
+	defer rebindingLock.RUnlock()
+
+	return !matchDomain(rebindingAllowed, dns.CanonicalName(name))
+}
+
+// publicDomain reports whether name belongs to a top-level domain managed
+// by ICANN. Names of local zones like "home.lan" or "fritz.box" are not
+// public.
+func publicDomain(name string) bool {
+	labels := dns.SplitDomainName(name)
+	if len(labels) == 0 {
+		return false
+	}
+
+	_, icann := publicsuffix.PublicSuffix(strings.ToLower(labels[len(labels)-1]))
+
+	return icann
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+// relayStampType is the stamp protocol identifier of anonymized DNSCrypt
+// relays.
+const relayStampType = 0x81
+
+// relay is an anonymized DNSCrypt relay that forwards encrypted queries
+// to the actual server without being able to decrypt them.
+type relay struct {
+	name string
+	addr string
+}
+
+// parseRelayStamp parses a sdns:// stamp of an anonymized DNSCrypt relay.
+func parseRelayStamp(stamp string) (*relay, error) {
+	if !strings.HasPrefix(stamp, "sdns://") {
+		return nil, fmt.Errorf("relay stamps are expected to start with sdns://")
+	}
+
+	bin, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(stamp, "sdns://"))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(bin) < 2 || bin[0] != relayStampType {
+		return nil, fmt.Errorf("not a DNSCrypt relay stamp")
+	}
+
+	length := int(bin[1])
+	if len(bin) != 2+length {
+		return nil, fmt.Errorf("invalid relay stamp length")
+	}
+
+	addr := string(bin[2:])
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(strings.Trim(addr, "[]"), "443")
+	}
+
+	return &relay{
+		name: addr,
+		addr: addr,
+	}, nil
+}
+
+var (
+	routesLock sync.RWMutex
+	routes     map[string][]string
+)
+
+// setRelayRoutes configures the relays to use for each server. Each
+// entry has the format "<server> <relay> [<relay>...]" where server is the
+// name of the server or "*" for all servers without a dedicated route. Relays
+// may be specified by name, stamp or as "ip:port".
+func setRelayRoutes(values []string) {
+	m := make(map[string][]string)
+
+	for _, value := range values {
+		fields := strings.Fields(value)
+		if len(fields) < 2 {
+			hclog.L().Error("ignoring invalid relay route", "route", value)
+
+			continue
+		}
+
+		m[fields[0]] = append(m[fields[0]], fields[1:]...)
+	}
+
+	routesLock.Lock()
+	routes = m
+	routesLock.Unlock()
+
+	reloadServers()
+}
+
+// relaysFor returns the relays that should be used for the server identified
+// by name or by the provider name of its stamp in random order.
+func relaysFor(name, provider string) []*relay {
+	routesLock.RLock()
+	defs, ok := routes[name]
+	if !ok {
+		defs, ok = routes[provider]
+	}
+	if !ok {
+		defs = routes["*"]
+	}
+	routesLock.RUnlock()
+
+	var result []*relay
+	for _, def := range defs {
+		r, err := resolveRelay(def)
+		if err != nil {
+			hclog.L().Warn("ignoring relay", "relay", def, "error", err)
+
+			continue
+		}
+
+		result = append(result, r)
+	}
+
+	rand.Shuffle(len(result), func(i, j int) {
+		result[i], result[j] = result[j], result[i]
+	})
+
+	return result
+}
+
+// resolveRelay resolves a relay definition that is either a stamp, an
+// "ip:port" address or the name of a relay from the resolver lists.
+func resolveRelay(def string) (*relay, error) {
+	if strings.HasPrefix(def, "sdns://") {
+		return parseRelayStamp(def)
+	}
+
+	if host, _, err := net.SplitHostPort(def); err == nil && net.ParseIP(host) != nil {
+		return &relay{
+			name: def,
+			addr: def,
+		}, nil
+	}
+
+	entry, ok := lookupServer(def)
+	if !ok {
+		return nil, fmt.Errorf("relay not found in resolver lists")
+	}
+
+	for _, stamp := range entry.Stamps {
+		r, err := parseRelayStamp(stamp)
+		if err == nil {
+			r.name = entry.Name
+
+			return r, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%s is not a DNSCrypt relay", def)
+}
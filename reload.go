@@ -0,0 +1,26 @@
+package main
+
+import "github.com/spf13/cobra"
+
+// reloadFile is the name of the file in the plugin data directory that
+// requests a reload.
+const reloadFile = "reload"
+
+// reloadCommand returns the command that makes the running plugin download
+// the resolver lists again and re-dial all servers.
+func reloadCommand() *cobra.Command {
+	var flags installFlags
+
+	cmd := &cobra.Command{
+		Use:   "reload",
+		Short: "Reload resolver lists and blocklists and re-dial all servers of the running plugin",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return writeControlRequest(flags.dataDirectory(), reloadFile)
+		},
+	}
+
+	flags.register(cmd)
+
+	return cmd
+}
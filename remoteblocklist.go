@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+const (
+	// defaultBlocklistUpdateInterval is the default number of hours after
+	// which remote blocklists are downloaded again.
+	defaultBlocklistUpdateInterval = 24
+
+	// blocklistCheckInterval defines how often watchBlocklists checks
+	// whether remote blocklists need to be downloaded again.
+	blocklistCheckInterval = time.Hour
+)
+
+// remoteBlocklist is a blocklist that is downloaded from url. If key is
+// set the list is verified using the minisign signature at
+// "<url>.minisig", if hash is set the list must have that SHA-256 hash.
+type remoteBlocklist struct {
+	url  string
+	key  *minisignPublicKey
+	hash []byte
+}
+
+var (
+	// blocklistUpdateInterval holds the time after which remote
+	// blocklists are downloaded again, in nanoseconds.
+	blocklistUpdateInterval atomic.Int64
+
+	// blocklistsChanged is used to trigger an update of the remote
+	// blocklists.
+	blocklistsChanged = make(chan struct{}, 1)
+
+	// blocklistsForced is set to download the remote blocklists on the
+	// next update even if the cached copies are still fresh.
+	blocklistsForced atomic.Bool
+)
+
+func init() {
+	blocklistUpdateInterval.Store(int64(defaultBlocklistUpdateInterval * time.Hour))
+}
+
+// setBlocklistCacheDir configures the directory downloaded blocklists are
+// stored in.
+func setBlocklistCacheDir(dir string) {
+	blocklistLock.Lock()
+	blocklistCacheDir = dir
+	blocklistLock.Unlock()
+}
+
+// parseRemoteBlocklist parses a remote blocklist in the format
+// "<url> [<minisign-key> | sha256:<hash>]". Lists without a key or hash
+// must be downloaded using HTTPS.
+func parseRemoteBlocklist(value string) (remoteBlocklist, error) {
+	fields := strings.Fields(value)
+	if len(fields) == 0 || len(fields) > 2 {
+		return remoteBlocklist{}, fmt.Errorf("invalid blocklist %q: expected \"<url> [<minisign-key> | sha256:<hash>]\"", value)
+	}
+
+	u, err := url.Parse(fields[0])
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return remoteBlocklist{}, fmt.Errorf("invalid blocklist URL %q", fields[0])
+	}
+
+	list := remoteBlocklist{
+		url: fields[0],
+	}
+
+	if len(fields) == 1 {
+		if u.Scheme != "https" {
+			return remoteBlocklist{}, fmt.Errorf("blocklist %q: a minisign key or SHA-256 hash is required for plain HTTP", fields[0])
+		}
+
+		return list, nil
+	}
+
+	if sum, ok := strings.CutPrefix(fields[1], "sha256:"); ok {
+		hash, err := hex.DecodeString(sum)
+		if err != nil || len(hash) != sha256.Size {
+			return remoteBlocklist{}, fmt.Errorf("blocklist %q: invalid SHA-256 hash", fields[0])
+		}
+
+		list.hash = hash
+
+		return list, nil
+	}
+
+	key, err := parseMinisignPublicKey(fields[1])
+	if err != nil {
+		return remoteBlocklist{}, fmt.Errorf("blocklist %q: %w", fields[0], err)
+	}
+
+	list.key = key
+
+	return list, nil
+}
+
+// setRemoteBlocklists configures the remote blocklists, loads the cached
+// copies and triggers downloading the others.
+func setRemoteBlocklists(values []string) {
+	var lists []remoteBlocklist
+	for _, value := range values {
+		list, err := parseRemoteBlocklist(value)
+		if err != nil {
+			hclog.L().Error("ignoring remote blocklist", "error", err)
+
+			continue
+		}
+
+		lists = append(lists, list)
+	}
+
+	blocklistLock.Lock()
+	remoteBlocklists = lists
+	blocklistLock.Unlock()
+
+	loadBlocklists()
+	refreshBlocklists()
+}
+
+// setBlocklistUpdateInterval configures the number of hours after which
+// remote blocklists are downloaded again.
+func setBlocklistUpdateInterval(hours int64) {
+	if hours <= 0 {
+		hours = defaultBlocklistUpdateInterval
+	}
+
+	blocklistUpdateInterval.Store(int64(time.Duration(hours) * time.Hour))
+}
+
+// refreshBlocklists triggers an update of the remote blocklists.
+func refreshBlocklists() {
+	select {
+	case blocklistsChanged <- struct{}{}:
+	default:
+	}
+}
+
+// blocklistCacheFile returns the path the downloaded copy of list is
+// stored at in dir. The signature is stored next to it with the
+// ".minisig" suffix.
+func blocklistCacheFile(dir string, list remoteBlocklist) string {
+	hash := sha256.Sum256([]byte(list.url))
+
+	return filepath.Join(dir, hex.EncodeToString(hash[:8])+".txt")
+}
+
+// verify checks data, and its signature sig, against the key or hash of
+// list.
+func (list remoteBlocklist) verify(data, sig []byte) error {
+	switch {
+	case list.key != nil:
+		return list.key.verify(data, sig)
+
+	case list.hash != nil:
+		if hash := sha256.Sum256(data); !bytes.Equal(hash[:], list.hash) {
+			return fmt.Errorf("SHA-256 hash mismatch, got %s", hex.EncodeToString(hash[:]))
+		}
+	}
+
+	return nil
+}
+
+// readRemoteBlocklist verifies the downloaded copy of list and adds its
+// domains to domains or scheduled.
+func readRemoteBlocklist(dir string, list remoteBlocklist, domains map[string]struct{}, scheduled map[string][]string) (int, error) {
+	file := blocklistCacheFile(dir, list)
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return 0, err
+	}
+
+	var sig []byte
+	if list.key != nil {
+		if sig, err = os.ReadFile(file + ".minisig"); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := list.verify(data, sig); err != nil {
+		return 0, err
+	}
+
+	return parseBlocklist(bytes.NewReader(data), domains, scheduled)
+}
+
+// watchBlocklists downloads the remote blocklists whenever they change
+// and once their downloaded copies are older than the update interval.
+// The blocklists are reloaded after any list has been downloaded.
+func watchBlocklists(ctx context.Context) {
+	ticker := time.NewTicker(blocklistCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-blocklistsChanged:
+		case <-ticker.C:
+		}
+
+		blocklistLock.RLock()
+		dir := blocklistCacheDir
+		lists := slices.Clone(remoteBlocklists)
+		blocklistLock.RUnlock()
+
+		if dir == "" {
+			continue
+		}
+
+		force := blocklistsForced.Swap(false)
+		interval := time.Duration(blocklistUpdateInterval.Load())
+
+		updated := false
+		for _, list := range lists {
+			file := blocklistCacheFile(dir, list)
+			if stat, err := os.Stat(file); err == nil && !force && time.Since(stat.ModTime()) < interval {
+				continue
+			}
+
+			if err := downloadBlocklist(ctx, list, file); err != nil {
+				hclog.L().Error("failed to download blocklist", "url", list.url, "error", err)
+
+				continue
+			}
+
+			updated = true
+		}
+
+		if updated {
+			loadBlocklists()
+		}
+	}
+}
+
+// downloadBlocklist downloads and verifies list and stores it at file.
+// The previous copy is kept if the download or the verification fails.
+func downloadBlocklist(ctx context.Context, list remoteBlocklist, file string) error {
+	data, err := download(ctx, list.url)
+	if err != nil {
+		return err
+	}
+
+	var sig []byte
+	if list.key != nil {
+		if sig, err = download(ctx, list.url+".minisig"); err != nil {
+			return err
+		}
+	}
+
+	if err := list.verify(data, sig); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+
+	if sig != nil {
+		if err := writeFileAtomic(file+".minisig", sig); err != nil {
+			return err
+		}
+	}
+
+	return writeFileAtomic(file, data)
+}
+
+// writeFileAtomic writes data to a temporary file that replaces the file
+// at path once it has been written completely.
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+
+		return err
+	}
+
+	return nil
+}
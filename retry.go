@@ -0,0 +1,35 @@
+package main
+
+import "sync/atomic"
+
+// defaultMaxRetries is the default number of times a failed query is
+// retried in addition to asking each server once.
+const defaultMaxRetries = 0
+
+// retryLimit is the highest number of retries that can be configured.
+const retryLimit = 10
+
+// maxRetries holds the number of times a failed query is retried before it
+// is given up.
+var maxRetries atomic.Int64
+
+func setMaxRetries(retries int64) {
+	maxRetries.Store(min(max(retries, 0), retryLimit))
+}
+
+// attemptOrder returns the servers to send a query to, in order. Each
+// server from ordered is tried once before any server is asked again, and
+// a query is never given up while there are servers left that have not been
+// tried. Further retries start over with the first server.
+func attemptOrder(ordered []*server) []*server {
+	if len(ordered) == 0 {
+		return nil
+	}
+
+	attempts := make([]*server, max(len(ordered), int(maxRetries.Load())+1))
+	for idx := range attempts {
+		attempts[idx] = ordered[idx%len(ordered)]
+	}
+
+	return attempts
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+)
+
+// localReverse enables handing reverse lookups of private addresses to
+// Portmaster instead of sending them upstream.
+var localReverse atomic.Bool
+
+// reverseIP returns the IP address a reverse lookup for name refers to or
+// nil if name is not a complete in-addr.arpa or ip6.arpa name.
+func reverseIP(name string) net.IP {
+	name = strings.ToLower(dns.Fqdn(name))
+
+	switch {
+	case strings.HasSuffix(name, ".in-addr.arpa."):
+		labels := dns.SplitDomainName(strings.TrimSuffix(name, ".in-addr.arpa."))
+		if len(labels) != net.IPv4len {
+			return nil
+		}
+
+		ip := make(net.IP, net.IPv4len)
+		for i, label := range labels {
+			b, err := strconv.ParseUint(label, 10, 8)
+			if err != nil {
+				return nil
+			}
+
+			ip[net.IPv4len-1-i] = byte(b)
+		}
+
+		return ip
+
+	case strings.HasSuffix(name, ".ip6.arpa."):
+		labels := dns.SplitDomainName(strings.TrimSuffix(name, ".ip6.arpa."))
+		if len(labels) != 2*net.IPv6len {
+			return nil
+		}
+
+		ip := make(net.IP, net.IPv6len)
+		for i, label := range labels {
+			nibble, err := strconv.ParseUint(label, 16, 4)
+			if err != nil {
+				return nil
+			}
+
+			pos := len(labels) - 1 - i
+			if pos%2 == 0 {
+				ip[pos/2] |= byte(nibble) << 4
+			} else {
+				ip[pos/2] |= byte(nibble)
+			}
+		}
+
+		return ip
+	}
+
+	return nil
+}
+
+// isPrivateReverse reports whether name is a reverse lookup for a
+// private, loopback or link-local address.
+func isPrivateReverse(name string) bool {
+	ip := reverseIP(name)
+	if ip == nil {
+		return false
+	}
+
+	return ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsUnspecified()
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+// weekdays maps the abbreviated names of the days of the week as used in
+// schedules to time.Weekday.
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// scheduleRange is a time window on some days of the week. from and to
+// are minutes since midnight. If to is not after from the window ends on
+// the next day.
+type scheduleRange struct {
+	days     [7]bool
+	from, to int
+}
+
+var (
+	schedulesLock sync.RWMutex
+	schedules     map[string][]scheduleRange
+)
+
+// parseSchedule parses a schedule in the format "<name> <days> <from>-<to>",
+// e.g. "work mon-fri 09:00-17:00". Days are separated by commas and may
+// be ranges, "*" selects all days.
+func parseSchedule(value string) (string, scheduleRange, error) {
+	fields := strings.Fields(value)
+	if len(fields) != 3 {
+		return "", scheduleRange{}, fmt.Errorf("invalid schedule %q: expected \"<name> <days> <from>-<to>\"", value)
+	}
+
+	days, err := parseWeekdays(fields[1])
+	if err != nil {
+		return "", scheduleRange{}, fmt.Errorf("invalid schedule %q: %w", value, err)
+	}
+
+	from, to, ok := strings.Cut(fields[2], "-")
+	if !ok {
+		return "", scheduleRange{}, fmt.Errorf("invalid schedule %q: expected a time range like 09:00-17:00", value)
+	}
+
+	r := scheduleRange{days: days}
+
+	if r.from, err = parseTimeOfDay(from); err != nil {
+		return "", scheduleRange{}, fmt.Errorf("invalid schedule %q: %w", value, err)
+	}
+
+	if r.to, err = parseTimeOfDay(to); err != nil {
+		return "", scheduleRange{}, fmt.Errorf("invalid schedule %q: %w", value, err)
+	}
+
+	return strings.ToLower(fields[0]), r, nil
+}
+
+// parseWeekdays parses a comma separated list of days or ranges of days,
+// e.g. "mon-fri,sun".
+func parseWeekdays(value string) ([7]bool, error) {
+	var days [7]bool
+
+	for _, part := range strings.Split(strings.ToLower(value), ",") {
+		if part == "*" {
+			for i := range days {
+				days[i] = true
+			}
+
+			continue
+		}
+
+		first, last, isRange := strings.Cut(part, "-")
+		if !isRange {
+			last = first
+		}
+
+		from, ok := weekdays[first]
+		if !ok {
+			return days, fmt.Errorf("unknown day %q", first)
+		}
+
+		to, ok := weekdays[last]
+		if !ok {
+			return days, fmt.Errorf("unknown day %q", last)
+		}
+
+		// ranges like "fri-mon" span the weekend
+		for day := from; ; day = (day + 1) % 7 {
+			days[day] = true
+
+			if day == to {
+				break
+			}
+		}
+	}
+
+	return days, nil
+}
+
+// parseTimeOfDay parses a time in the format "HH:MM" and returns the
+// minutes since midnight. "24:00" is accepted as the end of the day.
+func parseTimeOfDay(value string) (int, error) {
+	hours, minutes, ok := strings.Cut(value, ":")
+	if !ok {
+		return 0, fmt.Errorf("invalid time %q: expected HH:MM", value)
+	}
+
+	h, err := strconv.Atoi(hours)
+	if err != nil || h < 0 || h > 24 {
+		return 0, fmt.Errorf("invalid time %q", value)
+	}
+
+	m, err := strconv.Atoi(minutes)
+	if err != nil || m < 0 || m > 59 || (h == 24 && m != 0) {
+		return 0, fmt.Errorf("invalid time %q", value)
+	}
+
+	return h*60 + m, nil
+}
+
+// setSchedules configures the schedules referenced by blocklist entries.
+// Entries with the same name are combined.
+func setSchedules(values []string) {
+	m := make(map[string][]scheduleRange)
+
+	for _, value := range values {
+		name, r, err := parseSchedule(value)
+		if err != nil {
+			hclog.L().Error("ignoring schedule", "error", err)
+
+			continue
+		}
+
+		m[name] = append(m[name], r)
+	}
+
+	schedulesLock.Lock()
+	schedules = m
+	schedulesLock.Unlock()
+}
+
+// scheduleActive reports whether one of the time windows of the schedule
+// called name includes t. Unknown schedules are never active.
+func scheduleActive(name string, t time.Time) bool {
+	schedulesLock.RLock()
+	defer schedulesLock.RUnlock()
+
+	minute := t.Hour()*60 + t.Minute()
+	day := t.Weekday()
+	yesterday := (day + 6) % 7
+
+	for _, r := range schedules[name] {
+		if r.from < r.to {
+			if r.days[day] && minute >= r.from && minute < r.to {
+				return true
+			}
+
+			continue
+		}
+
+		// the window ends on the next day
+		if (r.days[day] && minute >= r.from) || (r.days[yesterday] && minute < r.to) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ameshkov/dnscrypt/v2"
+	"github.com/ameshkov/dnsstamps"
+	"github.com/spf13/cobra"
+)
+
+// showCertCommand returns the command that prints the current certificate
+// of DNSCrypt servers.
+func showCertCommand() *cobra.Command {
+	var flags installFlags
+
+	cmd := &cobra.Command{
+		Use:               "show-cert [<stamp|name>...]",
+		Short:             "Print the current certificate of DNSCrypt servers",
+		Long:              "Fetch and print the current certificate of the given DNSCrypt stamps or configured servers or, if none are given, of all configured DNSCrypt servers.",
+		ValidArgsFunction: flags.completeServerNames,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+
+			configs, err := flags.selectServers(cmd.Context(), args)
+			if err != nil {
+				return err
+			}
+
+			if len(configs) == 0 {
+				if err := flags.applyConfig(cmd.Context()); err != nil {
+					return err
+				}
+
+				configs = configuredServers()
+			}
+
+			var (
+				found  bool
+				failed bool
+			)
+			for _, cfg := range configs {
+				stamp, err := dnsstamps.NewServerStampFromString(cfg.stamp)
+				if err != nil || stamp.Proto != dnsstamps.StampProtoTypeDNSCrypt {
+					continue
+				}
+
+				if found {
+					fmt.Fprintln(cmd.OutOrStdout())
+				}
+				found = true
+
+				cert, err := currentCert(cmd.Context(), cfg.name, stamp)
+				if err != nil {
+					cmd.PrintErrf("%s: %s\n", cfg.name, err)
+					failed = true
+
+					continue
+				}
+
+				printCert(cmd.OutOrStdout(), cfg.name, stamp, cert)
+			}
+
+			switch {
+			case !found:
+				return errors.New("no DNSCrypt servers configured")
+			case failed:
+				return errors.New("failed to fetch some certificates")
+			}
+
+			return nil
+		},
+	}
+
+	flags.register(cmd)
+
+	return cmd
+}
+
+// currentCert fetches and validates the certificate of the DNSCrypt server
+// name, using the configured network and the first configured relay.
+func currentCert(ctx context.Context, name string, stamp dnsstamps.ServerStamp) (*dnscrypt.Cert, error) {
+	var r *relay
+	if relays := relaysFor(name, stamp.ProviderName); len(relays) > 0 {
+		r = relays[0]
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	info, err := dialStamp(ctx, stamp, r, networkFor(name, stamp.ProviderName))
+	if err != nil {
+		return nil, err
+	}
+
+	return info.ResolverCert, nil
+}
+
+// printCert prints the fields of cert, the current certificate of the
+// server name.
+func printCert(out io.Writer, name string, stamp dnsstamps.ServerStamp, cert *dnscrypt.Cert) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	defer w.Flush()
+
+	notBefore := time.Unix(int64(cert.NotBefore), 0)
+	notAfter := time.Unix(int64(cert.NotAfter), 0)
+
+	fmt.Fprintf(w, "Server:\t%s\n", name)
+	fmt.Fprintf(w, "Provider:\t%s\n", stamp.ProviderName)
+	fmt.Fprintf(w, "Provider Public Key:\t%s\n", hex.EncodeToString(stamp.ServerPk))
+	fmt.Fprintf(w, "Serial:\t%d\n", cert.Serial)
+	fmt.Fprintf(w, "ES Version:\t%s\n", cert.EsVersion)
+	fmt.Fprintf(w, "Valid From:\t%s\n", notBefore.Format(time.RFC3339))
+	fmt.Fprintf(w, "Valid Until:\t%s (in %s)\n", notAfter.Format(time.RFC3339), time.Until(notAfter).Round(time.Minute))
+	fmt.Fprintf(w, "Resolver Public Key:\t%s\n", hex.EncodeToString(cert.ResolverPk[:]))
+	fmt.Fprintf(w, "Client Magic:\t%s\n", hex.EncodeToString(cert.ClientMagic[:]))
+}
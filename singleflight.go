@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/safing/portmaster/plugin/shared/proto"
+	"golang.org/x/sync/singleflight"
+)
+
+// sharedTimeout limits the time a coalesced query may take. It runs
+// independently of the queries waiting for it so a canceled query does
+// not fail the others.
+const sharedTimeout = 10 * time.Second
+
+// inflight coalesces identical questions that are resolved concurrently.
+var inflight singleflight.Group
+
+// resolveShared resolves question using resolveUpstream unless the same
+// question is already being resolved for a query routed the same way, in
+// which case the response of the running query is returned.
+func resolveShared(ctx context.Context, question *proto.DNSQuestion, conn *proto.Connection) (*proto.DNSResponse, queryOutcome, error) {
+	key := newCacheKey(dnsQuestion(question), routingKey(conn))
+	name := key.name + "/" + strconv.Itoa(int(key.qtype)) + "/" + strconv.Itoa(int(key.class)) + key.routing
+
+	type result struct {
+		resp    *proto.DNSResponse
+		outcome queryOutcome
+	}
+
+	ch := inflight.DoChan(name, func() (interface{}, error) {
+		sharedCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), sharedTimeout)
+		defer cancel()
+
+		resp, outcome, err := resolveUpstream(sharedCtx, question, conn)
+
+		return result{resp, outcome}, err
+	})
+
+	select {
+	case <-ctx.Done():
+		return nil, queryOutcome{cache: cacheUseMiss}, ctx.Err()
+	case res := <-ch:
+		r, _ := res.Val.(result)
+
+		return r.resp, r.outcome, res.Err
+	}
+}
+
+// routingKey identifies the routing that depends on the process that
+// initiated conn, i.e. the matching application rule and the sticky
+// server of the process. Queries are only coalesced, and cached responses
+// only returned, if their routing key is the same so each process gets the
+// answer of its own servers.
+func routingKey(conn *proto.Connection) string {
+	var key string
+
+	if idx, ok := matchApplicationRule(conn); ok {
+		key += "/app" + strconv.Itoa(idx)
+	}
+
+	if process, ok := stickyKey(conn); ok {
+		key += "/pid" + strconv.FormatInt(process.pid, 10) + ":" + process.path
+	}
+
+	return key
+}
@@ -0,0 +1,489 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ameshkov/dnsstamps"
+	"github.com/hashicorp/go-hclog"
+)
+
+const (
+	// defaultSource is the public resolver list maintained by the
+	// DNSCrypt project together with the minisign key used to sign it.
+	defaultSource = "https://download.dnscrypt.info/resolvers-list/v3/public-resolvers.md RWQf6LRCGA9i53mlYecO4IzT51TGPpvWucNSCh1CBM0QTaLn73Y7GFO3"
+
+	// defaultRelaySource is the list of anonymized DNSCrypt relays
+	// maintained by the DNSCrypt project.
+	defaultRelaySource = "https://download.dnscrypt.info/resolvers-list/v3/relays.md RWQf6LRCGA9i53mlYecO4IzT51TGPpvWucNSCh1CBM0QTaLn73Y7GFO3"
+
+	// sourceRefreshInterval defines how often resolver lists are
+	// downloaded again.
+	sourceRefreshInterval = 24 * time.Hour
+)
+
+// source is a resolver list that is downloaded from url and signed
+// with key.
+type source struct {
+	url string
+	key *minisignPublicKey
+}
+
+// sourceEntry is a resolver published in a resolver list.
+type sourceEntry struct {
+	Name        string
+	Description string
+	Stamps      []string
+}
+
+var (
+	sourcesLock   sync.RWMutex
+	sourceList    []source
+	sourceEntries map[string]*sourceEntry
+
+	// sourcesChanged is used to trigger a refresh of the resolver lists.
+	sourcesChanged = make(chan struct{}, 1)
+
+	// sourcesForced is set to download the resolver lists on the next
+	// refresh even if the cached copies are still fresh.
+	sourcesForced atomic.Bool
+)
+
+// httpClient is used to download resolver lists and blocklists. Like all
+// other upstream traffic, downloads are sent through the configured proxy.
+var httpClient = &http.Client{
+	Timeout: 30 * time.Second,
+	Transport: &http.Transport{
+		DialContext:         dialUpstream,
+		ForceAttemptHTTP2:   true,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: defaultTimeout,
+	},
+}
+
+// parseSource parses a source definition in the format "<url> <minisign-key>".
+func parseSource(value string) (source, error) {
+	fields := strings.Fields(value)
+	if len(fields) != 2 {
+		return source{}, fmt.Errorf("invalid source %q: expected \"<url> <minisign-key>\"", value)
+	}
+
+	key, err := parseMinisignPublicKey(fields[1])
+	if err != nil {
+		return source{}, fmt.Errorf("invalid source %q: %w", fields[0], err)
+	}
+
+	return source{
+		url: fields[0],
+		key: key,
+	}, nil
+}
+
+func setSources(values []string) {
+	var list []source
+	for _, value := range values {
+		src, err := parseSource(value)
+		if err != nil {
+			hclog.L().Error("ignoring resolver source", "error", err)
+
+			continue
+		}
+
+		list = append(list, src)
+	}
+
+	sourcesLock.Lock()
+	sourceList = list
+	sourcesLock.Unlock()
+
+	refreshSources()
+}
+
+// refreshSources triggers a refresh of the resolver lists.
+func refreshSources() {
+	select {
+	case sourcesChanged <- struct{}{}:
+	default:
+	}
+}
+
+// lookupServer returns the resolver named name from the downloaded
+// resolver lists.
+func lookupServer(name string) (*sourceEntry, bool) {
+	sourcesLock.RLock()
+	defer sourcesLock.RUnlock()
+
+	entry, ok := sourceEntries[name]
+
+	return entry, ok
+}
+
+// watchSources downloads all configured resolver lists whenever the
+// source configuration changes and periodically afterwards. Any change
+// to the downloaded lists causes the servers to be re-dialed.
+func watchSources(ctx context.Context, cacheDir string) {
+	ticker := time.NewTicker(sourceRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sourcesChanged:
+		case <-ticker.C:
+		}
+
+		sourcesLock.RLock()
+		list := sourceList
+		sourcesLock.RUnlock()
+
+		force := sourcesForced.Swap(false)
+
+		entries := make(map[string]*sourceEntry)
+		for _, src := range list {
+			result, err := fetchSource(ctx, src, cacheDir, force)
+			if err != nil {
+				hclog.L().Error("failed to fetch resolver list", "url", src.url, "error", err)
+
+				continue
+			}
+
+			for _, entry := range result {
+				if _, ok := entries[entry.Name]; !ok {
+					entries[entry.Name] = entry
+				}
+			}
+
+			hclog.L().Info("loaded resolver list", "url", src.url, "resolvers", len(result))
+		}
+
+		sourcesLock.Lock()
+		sourceEntries = entries
+		sourcesLock.Unlock()
+
+		reloadServers()
+	}
+}
+
+// fetchSource downloads and verifies the resolver list of src. The list
+// is cached in cacheDir and the cached version is used if it is recent
+// enough, unless force is set, or if the download fails.
+func fetchSource(ctx context.Context, src source, cacheDir string, force bool) ([]*sourceEntry, error) {
+	cacheFile := sourceCacheFile(cacheDir, src)
+
+	if stat, err := os.Stat(cacheFile); err == nil && !force && time.Since(stat.ModTime()) < sourceRefreshInterval {
+		entries, err := loadCachedSource(src, cacheFile)
+		if err == nil {
+			return entries, nil
+		}
+
+		hclog.L().Warn("ignoring cached resolver list", "file", cacheFile, "error", err)
+	}
+
+	data, sig, err := downloadSource(ctx, src)
+	if err != nil {
+		if entries, cacheErr := loadCachedSource(src, cacheFile); cacheErr == nil {
+			hclog.L().Warn("failed to download resolver list, using cached version", "url", src.url, "error", err)
+
+			return entries, nil
+		}
+
+		return nil, err
+	}
+
+	if err := os.MkdirAll(cacheDir, 0755); err != nil {
+		hclog.L().Error("failed to create cache directory", "error", err)
+	} else {
+		if err := os.WriteFile(cacheFile, data, 0644); err != nil {
+			hclog.L().Error("failed to cache resolver list", "error", err)
+		}
+		if err := os.WriteFile(cacheFile+".minisig", sig, 0644); err != nil {
+			hclog.L().Error("failed to cache resolver list signature", "error", err)
+		}
+	}
+
+	return parseResolverList(data)
+}
+
+// sourceCacheFile returns the path src is cached at in cacheDir. The
+// signature is cached next to it with the ".minisig" suffix.
+func sourceCacheFile(cacheDir string, src source) string {
+	hash := sha256.Sum256([]byte(src.url))
+
+	return filepath.Join(cacheDir, hex.EncodeToString(hash[:8])+".md")
+}
+
+func loadCachedSource(src source, cacheFile string) ([]*sourceEntry, error) {
+	data, err := os.ReadFile(cacheFile)
+	if err != nil {
+		return nil, err
+	}
+
+	sig, err := os.ReadFile(cacheFile + ".minisig")
+	if err != nil {
+		return nil, err
+	}
+
+	if err := src.key.verify(data, sig); err != nil {
+		return nil, err
+	}
+
+	return parseResolverList(data)
+}
+
+// downloadSource downloads the resolver list of src and its minisign
+// signature. The signature is verified before downloadSource returns.
+func downloadSource(ctx context.Context, src source) ([]byte, []byte, error) {
+	data, err := download(ctx, src.url)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sig, err := download(ctx, src.url+".minisig")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := src.key.verify(data, sig); err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", src.url, err)
+	}
+
+	return data, sig, nil
+}
+
+func download(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to download %s: unexpected status %s", url, res.Status)
+	}
+
+	return io.ReadAll(io.LimitReader(res.Body, 10<<20))
+}
+
+// parseResolverList parses a resolver list in the markdown format used
+// by the DNSCrypt project. Each resolver starts with a "## name" heading
+// followed by a description and one or more sdns:// stamps.
+func parseResolverList(data []byte) ([]*sourceEntry, error) {
+	var (
+		entries []*sourceEntry
+		current *sourceEntry
+	)
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		switch {
+		case strings.HasPrefix(line, "## "):
+			current = &sourceEntry{
+				Name: strings.TrimSpace(strings.TrimPrefix(line, "## ")),
+			}
+			entries = append(entries, current)
+
+		case current == nil || line == "":
+
+		case strings.HasPrefix(line, "sdns://"):
+			current.Stamps = append(current.Stamps, line)
+
+		default:
+			if current.Description != "" {
+				current.Description += " "
+			}
+			current.Description += line
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	// drop entries without any stamps
+	result := entries[:0]
+	for _, entry := range entries {
+		if len(entry.Stamps) > 0 {
+			result = append(result, entry)
+		}
+	}
+
+	if len(result) == 0 {
+		return nil, fmt.Errorf("resolver list does not contain any resolvers")
+	}
+
+	return result, nil
+}
+
+// serverFilter constrains which of the servers published in resolver
+// lists may be used.
+type serverFilter struct {
+	requireDNSSEC   bool
+	requireNoLog    bool
+	requireNoFilter bool
+	ipv4            bool
+	ipv6            bool
+	prefer          ipPreference
+}
+
+var (
+	filterLock    sync.Mutex
+	currentFilter = serverFilter{
+		ipv4:   true,
+		prefer: preferAny,
+	}
+)
+
+// updateFilter modifies the current server filter using fn and re-dials
+// all servers.
+func updateFilter(fn func(f *serverFilter)) {
+	filterLock.Lock()
+	fn(&currentFilter)
+	filterLock.Unlock()
+
+	reloadServers()
+}
+
+func getFilter() serverFilter {
+	filterLock.Lock()
+	defer filterLock.Unlock()
+
+	return currentFilter
+}
+
+// match returns true if the server identified by stamp satisfies all
+// requirements of f.
+func (f serverFilter) match(stamp dnsstamps.ServerStamp) bool {
+	switch stamp.Proto {
+	case dnsstamps.StampProtoTypeDNSCrypt, dnsstamps.StampProtoTypeDoH, dnsstamps.StampProtoTypeTLS, dnsstamps.StampProtoTypeDoQ:
+	default:
+		return false
+	}
+
+	if f.requireDNSSEC && stamp.Props&dnsstamps.ServerInformalPropertyDNSSEC == 0 {
+		return false
+	}
+
+	if f.requireNoLog && stamp.Props&dnsstamps.ServerInformalPropertyNoLog == 0 {
+		return false
+	}
+
+	if f.requireNoFilter && stamp.Props&dnsstamps.ServerInformalPropertyNoFilter == 0 {
+		return false
+	}
+
+	if isIPv6Stamp(stamp) {
+		// skip IPv6-only servers on networks without IPv6
+		return f.ipv6 && hasIPv6Connectivity()
+	}
+
+	return f.ipv4
+}
+
+// isIPv6Stamp reports whether stamp contains an IPv6 server address.
+func isIPv6Stamp(stamp dnsstamps.ServerStamp) bool {
+	return strings.HasPrefix(stamp.ServerAddrStr, "[")
+}
+
+// allowsIP reports whether f allows connecting to servers at ip.
+func (f serverFilter) allowsIP(ip net.IP) bool {
+	if ip.To4() == nil {
+		return f.ipv6
+	}
+
+	return f.ipv4
+}
+
+// allowsStamp reports whether f allows the address family of the server
+// configured by stamp. Servers addressed by hostname are always allowed,
+// the address of an allowed family is picked when they are dialed.
+func (f serverFilter) allowsStamp(stamp string) bool {
+	var host string
+	if isDoTURL(stamp) || isDoQURL(stamp) {
+		u, err := url.Parse(stamp)
+		if err != nil {
+			return true
+		}
+
+		host = u.Hostname()
+	} else {
+		parsed, err := dnsstamps.NewServerStampFromString(stamp)
+		if err != nil {
+			return true
+		}
+
+		host = strings.Trim(parsed.ServerAddrStr, "[]")
+		if h, _, err := net.SplitHostPort(parsed.ServerAddrStr); err == nil {
+			host = h
+		}
+	}
+
+	ip := net.ParseIP(host)
+
+	return ip == nil || f.allowsIP(ip)
+}
+
+// restrictNetwork returns network limited to the address family allowed by
+// f if only one of them is allowed.
+func (f serverFilter) restrictNetwork(network string) string {
+	if network != "tcp" && network != "udp" {
+		return network
+	}
+
+	switch {
+	case f.ipv4 && !f.ipv6:
+		return network + "4"
+	case f.ipv6 && !f.ipv4:
+		return network + "6"
+	default:
+		return network
+	}
+}
+
+// selectStamp returns the first stamp of entry that matches f. Stamps
+// using the preferred address family are selected first.
+func (f serverFilter) selectStamp(entry *sourceEntry) (string, bool) {
+	var selected string
+	for _, s := range entry.Stamps {
+		stamp, err := dnsstamps.NewServerStampFromString(s)
+		if err != nil {
+			continue
+		}
+
+		if !f.match(stamp) {
+			continue
+		}
+
+		switch {
+		case f.prefer == preferIPv6 && isIPv6Stamp(stamp),
+			f.prefer == preferIPv4 && !isIPv6Stamp(stamp),
+			f.prefer == preferAny:
+			return s, true
+		case selected == "":
+			selected = s
+		}
+	}
+
+	return selected, selected != ""
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/ameshkov/dnsstamps"
+	"github.com/spf13/cobra"
+)
+
+// stampProtocols maps the protocol names accepted by the stamp encode
+// command to stamp protocols.
+var stampProtocols = map[string]dnsstamps.StampProtoType{
+	"plain":    dnsstamps.StampProtoTypePlain,
+	"dnscrypt": dnsstamps.StampProtoTypeDNSCrypt,
+	"doh":      dnsstamps.StampProtoTypeDoH,
+	"dot":      dnsstamps.StampProtoTypeTLS,
+	"doq":      dnsstamps.StampProtoTypeDoQ,
+}
+
+// stampCommand returns the command grouping the stamp decode and encode
+// commands.
+func stampCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "stamp",
+		Short: "Decode and encode server stamps",
+	}
+
+	cmd.AddCommand(
+		stampDecodeCommand(),
+		stampEncodeCommand(),
+	)
+
+	return cmd
+}
+
+func stampDecodeCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "decode <stamp>...",
+		Short: "Print the fields of server stamps",
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+
+			for idx, arg := range args {
+				stamp, err := dnsstamps.NewServerStampFromString(arg)
+				if err != nil {
+					return fmt.Errorf("invalid stamp %q: %w", arg, err)
+				}
+
+				if idx > 0 {
+					fmt.Fprintln(cmd.OutOrStdout())
+				}
+
+				printStamp(cmd.OutOrStdout(), stamp)
+			}
+
+			return nil
+		},
+	}
+}
+
+// printStamp prints all fields of stamp that are set.
+func printStamp(out io.Writer, stamp dnsstamps.ServerStamp) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	defer w.Flush()
+
+	fields := [][2]string{
+		{"Protocol", stamp.Proto.String()},
+		{"Address", stamp.ServerAddrStr},
+		{"Provider", stamp.ProviderName},
+		{"Path", stamp.Path},
+		{"Public Key", hex.EncodeToString(stamp.ServerPk)},
+	}
+	for _, hash := range stamp.Hashes {
+		fields = append(fields, [2]string{"Hash", hex.EncodeToString(hash)})
+	}
+	fields = append(fields, [2]string{"Properties", stampFlags(stamp)})
+
+	for _, field := range fields {
+		if field[1] == "" {
+			continue
+		}
+
+		fmt.Fprintf(w, "%s:\t%s\n", field[0], field[1])
+	}
+}
+
+// stampFields holds the values used to build a server stamp.
+type stampFields struct {
+	protocol  string
+	address   string
+	provider  string
+	path      string
+	publicKey string
+	hashes    []string
+	dnssec    bool
+	noLog     bool
+	noFilter  bool
+}
+
+// registerProperties adds the flags setting the informal properties of
+// the stamp to cmd.
+func (f *stampFields) registerProperties(cmd *cobra.Command) {
+	cmd.Flags().BoolVar(&f.dnssec, "dnssec", false, "The server validates DNSSEC")
+	cmd.Flags().BoolVar(&f.noLog, "no-log", false, "The server does not log queries")
+	cmd.Flags().BoolVar(&f.noFilter, "no-filter", false, "The server does not block domains")
+}
+
+// build returns the stamp described by f.
+func (f *stampFields) build() (dnsstamps.ServerStamp, error) {
+	proto, ok := stampProtocols[strings.ToLower(f.protocol)]
+	if !ok {
+		return dnsstamps.ServerStamp{}, fmt.Errorf("unknown protocol %q, expected one of %s", f.protocol, strings.Join(sortedKeys(stampProtocols), ", "))
+	}
+
+	stamp := dnsstamps.ServerStamp{
+		Proto:         proto,
+		ServerAddrStr: f.address,
+		ProviderName:  f.provider,
+	}
+
+	if f.dnssec {
+		stamp.Props |= dnsstamps.ServerInformalPropertyDNSSEC
+	}
+	if f.noLog {
+		stamp.Props |= dnsstamps.ServerInformalPropertyNoLog
+	}
+	if f.noFilter {
+		stamp.Props |= dnsstamps.ServerInformalPropertyNoFilter
+	}
+
+	for _, value := range f.hashes {
+		hash, err := decodeHex(value)
+		if err != nil {
+			return stamp, fmt.Errorf("invalid hash %q: %w", value, err)
+		}
+
+		stamp.Hashes = append(stamp.Hashes, hash)
+	}
+
+	switch proto {
+	case dnsstamps.StampProtoTypePlain:
+		if f.address == "" {
+			return stamp, errors.New("--address is required")
+		}
+	case dnsstamps.StampProtoTypeDNSCrypt:
+		if f.address == "" || f.provider == "" || f.publicKey == "" {
+			return stamp, errors.New("--address, --provider and --public-key are required for DNSCrypt stamps")
+		}
+
+		pk, err := decodeHex(f.publicKey)
+		if err != nil {
+			return stamp, fmt.Errorf("invalid public key: %w", err)
+		}
+		if len(pk) != 32 {
+			return stamp, fmt.Errorf("invalid public key: expected 32 bytes, got %d", len(pk))
+		}
+
+		stamp.ServerPk = pk
+	case dnsstamps.StampProtoTypeDoH:
+		if f.provider == "" {
+			return stamp, errors.New("--provider is required for DoH stamps")
+		}
+
+		stamp.Path = f.path
+		if stamp.Path == "" {
+			stamp.Path = "/dns-query"
+		}
+	default:
+		if f.provider == "" {
+			return stamp, errors.New("--provider is required for DoT and DoQ stamps")
+		}
+	}
+
+	return stamp, nil
+}
+
+func stampEncodeCommand() *cobra.Command {
+	var fields stampFields
+
+	cmd := &cobra.Command{
+		Use:   "encode",
+		Short: "Build a server stamp",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+
+			stamp, err := fields.build()
+			if err != nil {
+				return err
+			}
+
+			fmt.Fprintln(cmd.OutOrStdout(), stamp.String())
+
+			return nil
+		},
+	}
+
+	fields.registerProperties(cmd)
+	cmd.Flags().StringVar(&fields.address, "address", "", "The IP address of the server with an optional port")
+	cmd.Flags().StringVar(&fields.provider, "provider", "", "The provider name of DNSCrypt servers or the hostname of DoH, DoT and DoQ servers")
+	cmd.Flags().StringVar(&fields.publicKey, "public-key", "", "The hex encoded provider public key of DNSCrypt servers")
+	cmd.Flags().StringVar(&fields.protocol, "protocol", "dnscrypt", "The protocol of the server, one of dnscrypt, doh, dot, doq or plain")
+	cmd.Flags().StringVar(&fields.path, "path", "", "The URL path of DoH servers (default \"/dns-query\")")
+	cmd.Flags().StringArrayVar(&fields.hashes, "hash", nil, "The hex encoded SHA256 digest of a certificate in the chain of DoH, DoT and DoQ servers")
+
+	return cmd
+}
+
+// decodeHex decodes a hex string that may contain colons between bytes
+// or groups of bytes.
+func decodeHex(value string) ([]byte, error) {
+	return hex.DecodeString(strings.ReplaceAll(value, ":", ""))
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/safing/portmaster/plugin/shared/proto"
+	"github.com/spf13/cobra"
+)
+
+const (
+	// statusFile is the name of the file in the plugin data directory that
+	// requests the status of the running plugin.
+	statusFile = "status"
+
+	// statusResponseFile is the name of the file the running plugin writes
+	// its status to.
+	statusResponseFile = "status.json"
+)
+
+// pluginStatus is the status of the running plugin.
+type pluginStatus struct {
+	Time     time.Time      `json:"time"`
+	Enabled  bool           `json:"enabled"`
+	Strategy string         `json:"strategy"`
+	Servers  []serverStatus `json:"servers"`
+	Cache    cacheStatus    `json:"cache"`
+	Queries  queryStatus    `json:"queries"`
+}
+
+// queryStatus holds the number of queries answered since the plugin has
+// been started.
+type queryStatus struct {
+	Served int64 `json:"served"`
+	Failed int64 `json:"failed"`
+}
+
+// errorRate returns the percentage of failed queries.
+func (q queryStatus) errorRate() float64 {
+	if q.Served == 0 {
+		return 0
+	}
+
+	return float64(q.Failed) / float64(q.Served) * 100
+}
+
+func (q queryStatus) String() string {
+	return fmt.Sprintf("%d served, %d failed, %.1f%% error rate", q.Served, q.Failed, q.errorRate())
+}
+
+var (
+	// queriesServed and queriesFailed count the queries answered by the
+	// plugin and those that failed or have been answered with SERVFAIL.
+	queriesServed atomic.Int64
+	queriesFailed atomic.Int64
+)
+
+// countQuery updates the query counters with the result of a query.
+// Queries left to Portmaster are not counted.
+func countQuery(res *proto.DNSResponse, err error) {
+	if res == nil && err == nil {
+		return
+	}
+
+	queriesServed.Add(1)
+
+	if err != nil || res.GetRcode() == dns.RcodeServerFailure {
+		queriesFailed.Add(1)
+	}
+}
+
+// serverStatus is the status of a configured server.
+type serverStatus struct {
+	Name        string        `json:"name"`
+	Protocol    string        `json:"protocol"`
+	Active      bool          `json:"active"`
+	Circuit     string        `json:"circuit"`
+	Latency     time.Duration `json:"latency"`
+	LastSuccess time.Time     `json:"lastSuccess"`
+	Failures    int64         `json:"failures"`
+
+	// Histogram counts the response times of the server in
+	// latencyBuckets.
+	Histogram latencyHistogram `json:"histogram"`
+
+	// CertNotBefore and CertNotAfter are the validity of the certificate
+	// of DNSCrypt servers.
+	CertNotBefore time.Time `json:"certNotBefore"`
+	CertNotAfter  time.Time `json:"certNotAfter"`
+}
+
+// cacheStatus holds the statistics of the cache.
+type cacheStatus struct {
+	Enabled bool  `json:"enabled"`
+	Entries int   `json:"entries"`
+	Size    int64 `json:"size"`
+	Hits    int64 `json:"hits"`
+	Misses  int64 `json:"misses"`
+}
+
+// hitRate returns the percentage of lookups answered from the cache.
+func (c cacheStatus) hitRate() float64 {
+	total := c.Hits + c.Misses
+	if total == 0 {
+		return 0
+	}
+
+	return float64(c.Hits) / float64(total) * 100
+}
+
+// limit describes the maximum number of entries of the cache.
+func (c cacheStatus) limit() string {
+	if c.Size == 0 {
+		return "unlimited"
+	}
+
+	return fmt.Sprintf("at most %d", c.Size)
+}
+
+func (c cacheStatus) String() string {
+	if !c.Enabled {
+		return "disabled"
+	}
+
+	return fmt.Sprintf("%d entries (%s), %d hits, %d misses, %.1f%% hit rate", c.Entries, c.limit(), c.Hits, c.Misses, c.hitRate())
+}
+
+// collectStatus returns the current status of the plugin.
+func collectStatus() pluginStatus {
+	resolverLock.RLock()
+	list, current := servers, active
+	resolverLock.RUnlock()
+
+	status := pluginStatus{
+		Time:     time.Now(),
+		Enabled:  pluginEnabled.Load(),
+		Strategy: string(getStrategy()),
+	}
+
+	for idx, srv := range list {
+		srv.health.lock.Lock()
+		s := serverStatus{
+			Name:        srv.name,
+			Protocol:    protocolName(srv.stamp),
+			Circuit:     srv.health.state.String(),
+			LastSuccess: srv.health.lastSuccess,
+			Failures:    srv.health.failures,
+		}
+		srv.health.lock.Unlock()
+
+		s.Latency = srv.latency()
+		s.Histogram = srv.latencyHistogram()
+		s.Active = s.Circuit == circuitClosed.String() && (getStrategy() != strategyFirstAvailable || idx == current)
+
+		if t, ok := srv.transport.(*dnscryptTransport); ok {
+			cert := t.info.Load().ResolverCert
+			s.CertNotBefore = time.Unix(int64(cert.NotBefore), 0)
+			s.CertNotAfter = time.Unix(int64(cert.NotAfter), 0)
+		}
+
+		status.Servers = append(status.Servers, s)
+	}
+
+	cacheLock.Lock()
+	status.Cache.Entries = len(cacheEntries)
+	cacheLock.Unlock()
+
+	status.Cache.Enabled = cacheEnabled.Load()
+	status.Cache.Size = cacheSize.Load()
+	status.Cache.Hits = cacheHits.Load()
+	status.Cache.Misses = cacheMisses.Load()
+
+	status.Queries.Served = queriesServed.Load()
+	status.Queries.Failed = queriesFailed.Load()
+
+	return status
+}
+
+// statusCommand returns the command that prints the status of the running
+// plugin.
+func statusCommand() *cobra.Command {
+	var (
+		flags     installFlags
+		timeout   time.Duration
+		histogram bool
+	)
+
+	cmd := &cobra.Command{
+		Use:   "status",
+		Short: "Print the status of the running plugin",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+
+			var status pluginStatus
+			if err := requestControlResponse(flags.dataDirectory(), statusFile, statusResponseFile, timeout, &status); err != nil {
+				return err
+			}
+
+			if histogram {
+				printLatencyHistograms(cmd.OutOrStdout(), status.Servers)
+
+				return nil
+			}
+
+			printStatus(cmd.OutOrStdout(), status)
+
+			return nil
+		},
+	}
+
+	flags.register(cmd)
+	cmd.Flags().DurationVar(&timeout, "timeout", 3*controlInterval, "Time to wait for the running plugin to answer")
+	cmd.Flags().BoolVar(&histogram, "histogram", false, "Print the distribution of the response times of each server instead")
+
+	return cmd
+}
+
+// printStatus prints status in a human readable form.
+func printStatus(out io.Writer, status pluginStatus) {
+	since := func(t time.Time) string {
+		if t.IsZero() {
+			return "never"
+		}
+
+		return time.Since(t).Round(time.Second).String() + " ago"
+	}
+
+	enabled := "enabled"
+	if !status.Enabled {
+		enabled = "disabled"
+	}
+
+	fmt.Fprintf(out, "Plugin:    %s, %s load balancing\n", enabled, status.Strategy)
+
+	fmt.Fprintf(out, "Queries:   %s\n", status.Queries)
+	fmt.Fprintf(out, "Cache:     %s\n\n", status.Cache)
+
+	if len(status.Servers) == 0 {
+		fmt.Fprintln(out, "No servers in use.")
+
+		return
+	}
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	defer w.Flush()
+
+	fmt.Fprintln(w, "SERVER\tPROTOCOL\tACTIVE\tCIRCUIT\tLATENCY\tLAST SUCCESS\tFAILURES\tCERTIFICATE")
+	for _, s := range status.Servers {
+		active := "no"
+		if s.Active {
+			active = "yes"
+		}
+
+		latency := "-"
+		if s.Latency > 0 {
+			latency = s.Latency.Round(time.Millisecond).String()
+		}
+
+		cert := "-"
+		if !s.CertNotAfter.IsZero() {
+			cert = fmt.Sprintf("%s - %s", s.CertNotBefore.Format(time.DateOnly), s.CertNotAfter.Format(time.DateOnly))
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%d\t%s\n", s.Name, s.Protocol, active, s.Circuit, latency, since(s.LastSuccess), s.Failures, cert)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/safing/portmaster/plugin/shared/proto"
+)
+
+// stickyIdleTimeout is the time after which the server of a process that
+// did not send any queries is forgotten. Portmaster does not tell plugins
+// when a process exits so entries of terminated processes expire instead.
+const stickyIdleTimeout = 30 * time.Minute
+
+// processKey identifies a process. The binary path is included so a
+// reused process ID does not inherit the server of a previous process.
+type processKey struct {
+	pid  int64
+	path string
+}
+
+// stickyEntry is the server a process is pinned to.
+type stickyEntry struct {
+	server   string
+	lastUsed time.Time
+}
+
+var (
+	stickyEnabled atomic.Bool
+
+	stickyLock    sync.Mutex
+	stickyServers = make(map[processKey]*stickyEntry)
+	stickyCleaned time.Time
+)
+
+// setStickyProcesses enables or disables pinning processes to a server.
+func setStickyProcesses(enabled bool) {
+	stickyEnabled.Store(enabled)
+
+	if !enabled {
+		stickyLock.Lock()
+		stickyServers = make(map[processKey]*stickyEntry)
+		stickyLock.Unlock()
+	}
+}
+
+// stickyKey returns the key of the process that initiated conn. The
+// second return value is false if sticky servers are disabled or conn
+// has no process information.
+func stickyKey(conn *proto.Connection) (processKey, bool) {
+	if !stickyEnabled.Load() {
+		return processKey{}, false
+	}
+
+	process := conn.GetProcess()
+	if process.GetProcessId() <= 0 {
+		return processKey{}, false
+	}
+
+	return processKey{
+		pid:  process.GetProcessId(),
+		path: process.GetBinaryPath(),
+	}, true
+}
+
+// preferSticky moves the server the process identified by key is pinned
+// to to the front of ordered, as long as it's in rotation.
+func preferSticky(key processKey, ordered []*server) {
+	stickyLock.Lock()
+	entry, ok := stickyServers[key]
+	stickyLock.Unlock()
+
+	if !ok {
+		return
+	}
+
+	for idx, srv := range ordered {
+		if srv.name == entry.server && srv.healthy() {
+			copy(ordered[1:idx+1], ordered[:idx])
+			ordered[0] = srv
+
+			return
+		}
+	}
+}
+
+// pinSticky pins the process identified by key to srv.
+func pinSticky(key processKey, srv *server) {
+	stickyLock.Lock()
+	defer stickyLock.Unlock()
+
+	now := time.Now()
+
+	if now.Sub(stickyCleaned) > time.Minute {
+		for k, entry := range stickyServers {
+			if now.Sub(entry.lastUsed) > stickyIdleTimeout {
+				delete(stickyServers, k)
+			}
+		}
+
+		stickyCleaned = now
+	}
+
+	stickyServers[key] = &stickyEntry{
+		server:   srv.name,
+		lastUsed: now,
+	}
+}
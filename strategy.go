@@ -0,0 +1,192 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+// lbStrategy defines which of the configured servers is asked first
+// when resolving a query.
+type lbStrategy string
+
+const (
+	// strategyFirstAvailable always uses the first server that answered
+	// successfully and only moves on to the next one if it fails.
+	strategyFirstAvailable = lbStrategy("first-available")
+
+	// strategyRandom picks a random server for each query.
+	strategyRandom = lbStrategy("random")
+
+	// strategyPowerOfTwo picks the faster of two randomly chosen servers.
+	strategyPowerOfTwo = lbStrategy("power-of-two")
+
+	// strategyFastest always picks the server with the lowest average
+	// response time.
+	strategyFastest = lbStrategy("fastest")
+
+	// strategyWeighted picks a random server with a probability
+	// proportional to its configured weight.
+	strategyWeighted = lbStrategy("weighted")
+)
+
+var currentStrategy atomic.Value
+
+func setStrategy(value string) {
+	strategy := lbStrategy(value)
+
+	switch strategy {
+	case strategyFirstAvailable, strategyRandom, strategyPowerOfTwo, strategyFastest, strategyWeighted:
+	case "":
+		strategy = strategyFirstAvailable
+	default:
+		hclog.L().Error("unknown load balancing strategy, using first-available", "strategy", value)
+
+		strategy = strategyFirstAvailable
+	}
+
+	currentStrategy.Store(strategy)
+}
+
+func getStrategy() lbStrategy {
+	if s, ok := currentStrategy.Load().(lbStrategy); ok {
+		return s
+	}
+
+	return strategyFirstAvailable
+}
+
+// orderServers returns the order in which the servers in list should
+// be tried for the next query. The first server is selected using
+// the configured load balancing strategy while the rest is used
+// for failover. Quarantined servers are only tried as a last resort.
+func orderServers(list []*server, start int) []*server {
+	var ordered, quarantined []*server
+	for i := range list {
+		srv := list[(start+i)%len(list)]
+		if srv.healthy() {
+			ordered = append(ordered, srv)
+		} else {
+			quarantined = append(quarantined, srv)
+		}
+	}
+
+	return append(balance(ordered), quarantined...)
+}
+
+// balance reorders ordered according to the configured load balancing
+// strategy.
+func balance(ordered []*server) []*server {
+	if len(ordered) < 2 {
+		return ordered
+	}
+
+	switch getStrategy() {
+	case strategyRandom:
+		rand.Shuffle(len(ordered), func(i, j int) {
+			ordered[i], ordered[j] = ordered[j], ordered[i]
+		})
+
+	case strategyPowerOfTwo:
+		i := rand.Intn(len(ordered))
+		j := rand.Intn(len(ordered) - 1)
+		if j >= i {
+			j++
+		}
+
+		if ordered[j].latency() < ordered[i].latency() {
+			i = j
+		}
+
+		ordered[0], ordered[i] = ordered[i], ordered[0]
+
+	case strategyFastest:
+		sort.SliceStable(ordered, func(i, j int) bool {
+			return ordered[i].latency() < ordered[j].latency()
+		})
+
+	case strategyWeighted:
+		weightedShuffle(ordered)
+	}
+
+	return ordered
+}
+
+// defaultWeight is the weight of servers without a configured weight.
+const defaultWeight = 1
+
+var (
+	weightsLock sync.RWMutex
+	weights     map[string]float64
+)
+
+// setServerWeights configures the weights used by strategyWeighted. Each
+// entry has the format "<server> <weight>".
+func setServerWeights(values []string) {
+	m := make(map[string]float64)
+
+	for _, value := range values {
+		fields := strings.Fields(value)
+		if len(fields) != 2 {
+			hclog.L().Error("ignoring invalid server weight", "weight", value)
+
+			continue
+		}
+
+		weight, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil || weight < 0 || math.IsInf(weight, 0) {
+			hclog.L().Error("ignoring invalid server weight", "weight", value)
+
+			continue
+		}
+
+		m[fields[0]] = weight
+	}
+
+	weightsLock.Lock()
+	weights = m
+	weightsLock.Unlock()
+}
+
+// weightOf returns the configured weight of srv. A weight configured for
+// the name of srv takes precedence over one for its provider name.
+func weightOf(srv *server) float64 {
+	weightsLock.RLock()
+	defer weightsLock.RUnlock()
+
+	if weight, ok := weights[srv.name]; ok {
+		return weight
+	}
+
+	for name, weight := range weights {
+		if srv.hasName(name) {
+			return weight
+		}
+	}
+
+	return defaultWeight
+}
+
+// weightedShuffle randomly reorders list so that each server is picked
+// first with a probability proportional to its weight. Servers with a
+// weight of zero are only used for failover.
+func weightedShuffle(list []*server) {
+	keys := make(map[*server]float64, len(list))
+	for _, srv := range list {
+		if weight := weightOf(srv); weight > 0 {
+			keys[srv] = math.Pow(rand.Float64(), 1/weight)
+		} else {
+			keys[srv] = -1
+		}
+	}
+
+	sort.SliceStable(list, func(i, j int) bool {
+		return keys[list[i]] > keys[list[j]]
+	})
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/miekg/dns"
+	"github.com/safing/portmaster/plugin/shared/proto"
+	"golang.org/x/net/publicsuffix"
+)
+
+const (
+	// summaryPeriod is the time covered by a usage summary.
+	summaryPeriod = 7 * 24 * time.Hour
+
+	// summaryTopDomains is the number of domains listed in a summary.
+	summaryTopDomains = 5
+
+	// maxSummaryDomains limits the number of distinct domains counted
+	// for a summary. Queries for further domains are only counted in the
+	// total.
+	maxSummaryDomains = 10000
+)
+
+// serverUsage counts the exchanges with a server during a summary period.
+type serverUsage struct {
+	Answered int64 `json:"answered"`
+	Failed   int64 `json:"failed"`
+}
+
+// availability returns the fraction of successful exchanges in percent.
+func (u serverUsage) availability() float64 {
+	total := u.Answered + u.Failed
+	if total == 0 {
+		return 0
+	}
+
+	return float64(u.Answered) / float64(total) * 100
+}
+
+// usageSummary holds the statistics of the current summary period.
+type usageSummary struct {
+	Start     time.Time               `json:"start"`
+	Queries   int64                   `json:"queries"`
+	Failed    int64                   `json:"failed"`
+	CacheHits int64                   `json:"cacheHits"`
+	Domains   map[string]int64        `json:"domains"`
+	Servers   map[string]*serverUsage `json:"servers"`
+}
+
+func newUsageSummary(start time.Time) *usageSummary {
+	return &usageSummary{
+		Start:   start,
+		Domains: make(map[string]int64),
+		Servers: make(map[string]*serverUsage),
+	}
+}
+
+var (
+	// weeklySummary enables collecting usage statistics and sending a
+	// summary notification at the end of every summary period.
+	weeklySummary        atomic.Bool
+	weeklySummaryChanged = make(chan struct{}, 1)
+
+	summaryLock sync.Mutex
+	summary     = newUsageSummary(time.Now())
+)
+
+// setWeeklySummary enables or disables the summary notification. A new
+// summary period is started when it's enabled.
+func setWeeklySummary(enabled bool) {
+	if weeklySummary.Swap(enabled) == enabled {
+		return
+	}
+
+	if enabled {
+		summaryLock.Lock()
+		summary = newUsageSummary(time.Now())
+		summaryLock.Unlock()
+	}
+
+	select {
+	case weeklySummaryChanged <- struct{}{}:
+	default:
+	}
+}
+
+// recordUsage adds the result of a query to the usage summary. Queries
+// left to Portmaster are not counted.
+func recordUsage(question *proto.DNSQuestion, res *proto.DNSResponse, err error, outcome queryOutcome) {
+	if !weeklySummary.Load() || (res == nil && err == nil) {
+		return
+	}
+
+	domain := summaryDomain(question.GetName())
+
+	summaryLock.Lock()
+	defer summaryLock.Unlock()
+
+	summary.Queries++
+
+	if err != nil || res.GetRcode() == dns.RcodeServerFailure {
+		summary.Failed++
+	}
+
+	if outcome.cache == cacheUseHit || outcome.cache == cacheUseStale {
+		summary.CacheHits++
+	}
+
+	if domain == "" {
+		return
+	}
+
+	if _, ok := summary.Domains[domain]; ok || len(summary.Domains) < maxSummaryDomains {
+		summary.Domains[domain]++
+	}
+}
+
+// recordServerUsage adds the result of an exchange with the server name to
+// the usage summary.
+func recordServerUsage(name string, ok bool) {
+	if !weeklySummary.Load() {
+		return
+	}
+
+	summaryLock.Lock()
+	defer summaryLock.Unlock()
+
+	usage := summary.Servers[name]
+	if usage == nil {
+		usage = new(serverUsage)
+		summary.Servers[name] = usage
+	}
+
+	if ok {
+		usage.Answered++
+	} else {
+		usage.Failed++
+	}
+}
+
+// summaryDomain returns the registrable domain of name, so queries for the
+// subdomains of a site are counted together. Reverse lookups are not
+// counted.
+func summaryDomain(name string) string {
+	name = strings.TrimSuffix(dns.CanonicalName(name), ".")
+	if name == "" || name == "arpa" || strings.HasSuffix(name, ".arpa") {
+		return ""
+	}
+
+	if domain, err := publicsuffix.EffectiveTLDPlusOne(name); err == nil {
+		return domain
+	}
+
+	return name
+}
+
+// sendSummaries sends a summary notification at the end of every summary
+// period while the weekly summary is enabled.
+func sendSummaries(ctx context.Context) {
+	for {
+		var due <-chan time.Time
+		if weeklySummary.Load() {
+			summaryLock.Lock()
+			end := summary.Start.Add(summaryPeriod)
+			summaryLock.Unlock()
+
+			due = time.After(time.Until(end))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-weeklySummaryChanged:
+		case <-due:
+			sendSummary()
+		}
+	}
+}
+
+// sendSummary notifies the user about the usage during the summary period
+// that just ended and starts a new one.
+func sendSummary() {
+	now := time.Now()
+
+	summaryLock.Lock()
+	ended := summary
+	summary = newUsageSummary(now)
+	summaryLock.Unlock()
+
+	if ended.Queries == 0 {
+		hclog.L().Debug("no queries answered, skipping weekly summary")
+
+		return
+	}
+
+	notify(&proto.Notification{
+		EventId: "dnscrypt-weekly-summary-" + now.Format("2006-01-02"),
+		Title:   "DNSCrypt: Weekly summary",
+		Message: ended.message(now),
+	})
+}
+
+// message describes the usage from the start of the summary until end.
+func (s *usageSummary) message(end time.Time) string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "Between %s and %s, %d queries have been answered. %.1f%% of them failed and %.1f%% were answered from the cache.",
+		s.Start.Format("Jan 2"),
+		end.Format("Jan 2"),
+		s.Queries,
+		percentOf(s.Failed, s.Queries),
+		percentOf(s.CacheHits, s.Queries),
+	)
+
+	if top := s.topDomains(summaryTopDomains); len(top) > 0 {
+		b.WriteString("\n\nTop domains: ")
+
+		for idx, domain := range top {
+			if idx > 0 {
+				b.WriteString(", ")
+			}
+
+			fmt.Fprintf(&b, "%s (%d)", domain, s.Domains[domain])
+		}
+	}
+
+	if len(s.Servers) > 0 {
+		names := make([]string, 0, len(s.Servers))
+		for name := range s.Servers {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		b.WriteString("\n\nServer availability: ")
+
+		for idx, name := range names {
+			if idx > 0 {
+				b.WriteString(", ")
+			}
+
+			usage := s.Servers[name]
+			fmt.Fprintf(&b, "%s %.1f%%", name, usage.availability())
+		}
+	}
+
+	return b.String()
+}
+
+// topDomains returns the n most queried domains.
+func (s *usageSummary) topDomains(n int) []string {
+	domains := make([]string, 0, len(s.Domains))
+	for domain := range s.Domains {
+		domains = append(domains, domain)
+	}
+
+	sort.Slice(domains, func(i, j int) bool {
+		if s.Domains[domains[i]] != s.Domains[domains[j]] {
+			return s.Domains[domains[i]] > s.Domains[domains[j]]
+		}
+
+		return domains[i] < domains[j]
+	})
+
+	if len(domains) > n {
+		domains = domains[:n]
+	}
+
+	return domains
+}
+
+func percentOf(part, total int64) float64 {
+	if total == 0 {
+		return 0
+	}
+
+	return float64(part) / float64(total) * 100
+}
+
+// saveSummary writes the statistics of the current summary period to path
+// so they survive restarts.
+func saveSummary(path string) error {
+	if !weeklySummary.Load() {
+		return nil
+	}
+
+	summaryLock.Lock()
+	blob, err := json.Marshal(summary)
+	summaryLock.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, blob, 0600)
+}
+
+// loadSummary restores the statistics of the summary period written by
+// saveSummary. If the period ended while the plugin was not running, the
+// summary is sent by sendSummaries right away.
+func loadSummary(path string) {
+	if !weeklySummary.Load() {
+		return
+	}
+
+	blob, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			hclog.L().Warn("failed to read summary file", "error", err)
+		}
+
+		return
+	}
+
+	loaded := newUsageSummary(time.Time{})
+	if err := json.Unmarshal(blob, loaded); err != nil {
+		hclog.L().Warn("failed to parse summary file", "error", err)
+
+		return
+	}
+
+	if loaded.Start.IsZero() || loaded.Start.After(time.Now()) {
+		return
+	}
+
+	if loaded.Domains == nil {
+		loaded.Domains = make(map[string]int64)
+	}
+	if loaded.Servers == nil {
+		loaded.Servers = make(map[string]*serverUsage)
+	}
+
+	summaryLock.Lock()
+	summary = loaded
+	summaryLock.Unlock()
+
+	select {
+	case weeklySummaryChanged <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/spf13/cobra"
+)
+
+// errTestFailed is returned by the test command if any check failed.
+var errTestFailed = errors.New("server test failed")
+
+// testReport prints the results of the checks run by the test command.
+type testReport struct {
+	out    io.Writer
+	failed bool
+}
+
+func (r *testReport) pass(check, format string, args ...any) {
+	fmt.Fprintf(r.out, "%-12s PASS  %s\n", check, fmt.Sprintf(format, args...))
+}
+
+func (r *testReport) fail(check string, err error) {
+	r.failed = true
+
+	fmt.Fprintf(r.out, "%-12s FAIL  %s\n", check, err)
+}
+
+func (r *testReport) skip(check, reason string) {
+	fmt.Fprintf(r.out, "%-12s SKIP  %s\n", check, reason)
+}
+
+// testCommand returns the command that checks a server stamp end-to-end
+// without the Portmaster.
+func testCommand() *cobra.Command {
+	var (
+		domain string
+		useTCP bool
+	)
+
+	cmd := &cobra.Command{
+		Use:   "test <stamp>",
+		Short: "Decode a server stamp, dial the server and resolve a test query",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			cmd.SilenceErrors = true
+
+			report := &testReport{out: cmd.OutOrStdout()}
+			runServerTest(cmd.Context(), report, args[0], dns.Fqdn(domain), useTCP)
+
+			if report.failed {
+				return errTestFailed
+			}
+
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&domain, "domain", "example.com", "The domain to resolve")
+	cmd.Flags().BoolVar(&useTCP, "tcp", false, "Query DNSCrypt servers over TCP")
+
+	return cmd
+}
+
+// runServerTest decodes stamp, dials the server, validates its
+// certificate and resolves domain, adding the result of each step to
+// report. Later steps are skipped if a step fails.
+func runServerTest(ctx context.Context, report *testReport, stamp, domain string, useTCP bool) {
+	if err := validateStamp(stamp); err != nil {
+		report.fail("Decode", err)
+
+		return
+	}
+
+	report.pass("Decode", "%s", strings.ReplaceAll(strings.TrimPrefix(describeStamp(stamp), "\n"), "\n", ", "))
+
+	cfg := serverConfig{
+		name:  stampName(stamp),
+		stamp: stamp,
+	}
+
+	if useTCP {
+		setServerNetworks([]string{cfg.name + " tcp"})
+	}
+
+	started := time.Now()
+	srv, err := dialServer(cfg)
+	switch {
+	case errors.Is(err, errCertificate):
+		report.pass("Dial", "server reachable")
+		report.fail("Certificate", err)
+
+		return
+	case err != nil:
+		report.fail("Dial", err)
+
+		return
+	}
+
+	dnscryptCert := false
+	if t, ok := srv.transport.(*dnscryptTransport); ok {
+		report.pass("Dial", "%s", time.Since(started).Round(time.Millisecond))
+
+		cert := t.info.Load().ResolverCert
+		report.pass("Certificate", "serial %d, valid until %s", cert.Serial, time.Unix(int64(cert.NotAfter), 0).Format(time.RFC3339))
+
+		dnscryptCert = true
+	} else {
+		report.pass("Dial", "connecting with the first query")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	req := new(dns.Msg)
+	req.SetQuestion(domain, dns.TypeA)
+	req.SetEdns0(dns.DefaultMsgSize, false)
+
+	started = time.Now()
+	res, err := srv.exchange(ctx, req)
+	rtt := time.Since(started).Round(time.Millisecond)
+
+	if !dnscryptCert {
+		switch {
+		case isCertificateError(err):
+			report.fail("Certificate", err)
+
+			report.skip("Resolve", "no trusted connection")
+
+			return
+		case err != nil:
+			report.skip("Certificate", "no connection to the server")
+		default:
+			report.pass("Certificate", "verified during the TLS handshake")
+		}
+	}
+
+	switch {
+	case err != nil:
+		report.fail("Resolve", err)
+	case res.Rcode != dns.RcodeSuccess:
+		report.fail("Resolve", fmt.Errorf("%s returned %s", domain, dns.RcodeToString[res.Rcode]))
+	case len(res.Answer) == 0:
+		report.fail("Resolve", fmt.Errorf("%s returned no answers", domain))
+	default:
+		var answers []string
+		for _, rr := range res.Answer {
+			if a, ok := rr.(*dns.A); ok {
+				answers = append(answers, a.A.String())
+			}
+		}
+
+		report.pass("Resolve", "%s -> %s in %s", domain, strings.Join(answers, ", "), rtt)
+	}
+}
+
+// isCertificateError returns true if err has been caused by an invalid or
+// untrusted TLS certificate.
+func isCertificateError(err error) bool {
+	var (
+		verifyErr    *tls.CertificateVerificationError
+		authorityErr x509.UnknownAuthorityError
+		hostnameErr  x509.HostnameError
+		invalidErr   x509.CertificateInvalidError
+	)
+
+	return errors.Is(err, errPinMismatch) ||
+		errors.As(err, &verifyErr) ||
+		errors.As(err, &authorityErr) ||
+		errors.As(err, &hostnameErr) ||
+		errors.As(err, &invalidErr)
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+const (
+	// tracerName is the name of the tracer and the service traces are
+	// exported for.
+	tracerName = "portmaster-plugin-dnscrypt"
+
+	// defaultTracePath is the path traces are sent to if the endpoint
+	// does not contain one.
+	defaultTracePath = "/v1/traces"
+
+	// traceShutdownTimeout limits the time to flush pending spans when
+	// the trace endpoint changes or the plugin shuts down.
+	traceShutdownTimeout = 5 * time.Second
+)
+
+var (
+	tracingLock   sync.Mutex
+	traceEndpoint string
+
+	// traceProvider exports the spans, traceExporting is the endpoint it
+	// has been created for.
+	traceProvider  *sdktrace.TracerProvider
+	traceExporting string
+
+	// tracingActive is set by setupTracing. Until then, changes to the
+	// trace endpoint are only recorded so commands that apply the
+	// configuration never export traces.
+	tracingActive bool
+)
+
+// setupTracing starts exporting traces to the configured endpoint.
+func setupTracing() {
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		hclog.L().Warn("failed to export traces", "error", err)
+	}))
+
+	tracingLock.Lock()
+	defer tracingLock.Unlock()
+
+	tracingActive = true
+	configureTracerLocked()
+}
+
+// shutdownTracing flushes pending spans and stops exporting traces.
+func shutdownTracing(ctx context.Context) {
+	tracingLock.Lock()
+	defer tracingLock.Unlock()
+
+	provider := traceProvider
+
+	tracingActive = false
+	traceProvider, traceExporting = nil, ""
+	otel.SetTracerProvider(noop.NewTracerProvider())
+
+	if provider == nil {
+		return
+	}
+
+	if err := provider.Shutdown(ctx); err != nil {
+		hclog.L().Warn("failed to flush traces", "error", err)
+	}
+}
+
+func setTraceEndpoint(value string) {
+	endpoint, err := parseTraceEndpoint(value)
+	if err != nil {
+		hclog.L().Error("invalid trace endpoint, disabling tracing", "endpoint", value, "error", err)
+
+		endpoint = ""
+	}
+
+	tracingLock.Lock()
+	defer tracingLock.Unlock()
+
+	traceEndpoint = endpoint
+	configureTracerLocked()
+}
+
+// parseTraceEndpoint parses the URL of an OTLP/HTTP collector. The
+// default path for traces is used if value does not contain one. It
+// returns an empty string if value is empty.
+func parseTraceEndpoint(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return "", nil
+	}
+
+	u, err := url.Parse(value)
+	if err != nil {
+		return "", err
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", fmt.Errorf("unsupported trace endpoint scheme %q", u.Scheme)
+	}
+
+	if u.Host == "" {
+		return "", fmt.Errorf("missing host in trace endpoint %q", value)
+	}
+
+	if u.Path == "" || u.Path == "/" {
+		u.Path = defaultTracePath
+	}
+
+	return u.String(), nil
+}
+
+// configureTracerLocked replaces the global tracer provider with one that
+// exports to the configured endpoint, or with a no-op provider if tracing
+// is disabled. It must be called with tracingLock held.
+func configureTracerLocked() {
+	endpoint := traceEndpoint
+	if !tracingActive {
+		endpoint = ""
+	}
+
+	if endpoint == traceExporting {
+		return
+	}
+
+	previous := traceProvider
+	traceProvider, traceExporting = nil, ""
+
+	if endpoint != "" {
+		exporter, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(endpoint))
+		if err != nil {
+			hclog.L().Error("failed to create trace exporter", "endpoint", endpoint, "error", err)
+		} else {
+			traceProvider = sdktrace.NewTracerProvider(
+				sdktrace.WithBatcher(exporter),
+				sdktrace.WithResource(resource.NewSchemaless(
+					attribute.String("service.name", tracerName),
+					attribute.String("service.version", getBuildMetadata().Version),
+				)),
+			)
+			traceExporting = endpoint
+		}
+	}
+
+	if traceProvider != nil {
+		otel.SetTracerProvider(traceProvider)
+	} else {
+		otel.SetTracerProvider(noop.NewTracerProvider())
+	}
+
+	// flush the spans of the previous endpoint without blocking queries
+	if previous != nil {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), traceShutdownTimeout)
+			defer cancel()
+
+			if err := previous.Shutdown(ctx); err != nil {
+				hclog.L().Warn("failed to flush traces", "error", err)
+			}
+		}()
+	}
+}
+
+// startSpan starts a span of the resolve pipeline. It's a no-op unless
+// tracing is enabled.
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan records err, if any, and ends span.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	span.End()
+}
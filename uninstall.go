@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/safing/portmaster/plugin/shared"
+	"github.com/spf13/cobra"
+)
+
+// uninstallCommand returns the command that reverts the install command.
+func uninstallCommand() *cobra.Command {
+	var (
+		flags       installFlags
+		purgeData   bool
+		purgeConfig bool
+	)
+
+	cmd := &cobra.Command{
+		Use:   "uninstall",
+		Short: "Remove the plugin from the Portmaster installation",
+		Long:  "Remove the plugin from plugins.json and delete the installed executable. The cached data and the settings of the plugin are kept unless --purge or --purge-config is given. Restart the Portmaster afterwards.",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+
+			if err := removePluginConfig(filepath.Join(flags.installDir, "plugins.json"), flags.pluginName); err != nil {
+				return err
+			}
+
+			if err := os.Remove(filepath.Join(flags.installDir, "plugins", flags.pluginName)); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("failed to remove plugin executable: %w", err)
+			}
+
+			if purgeData {
+				if err := os.RemoveAll(flags.dataDirectory()); err != nil {
+					return fmt.Errorf("failed to remove plugin data: %w", err)
+				}
+			}
+
+			if purgeConfig {
+				if err := removePluginSettings(flags.configFile(), flags.pluginName); err != nil {
+					return err
+				}
+			}
+
+			fmt.Fprintf(cmd.OutOrStdout(), "%s successfully uninstalled. Please restart the Portmaster\n", flags.pluginName)
+
+			return nil
+		},
+	}
+
+	flags.register(cmd)
+	cmd.Flags().BoolVar(&purgeData, "purge", false, "Also remove the cached data of the plugin, like downloaded resolver lists, certificates and the DNS cache")
+	cmd.Flags().BoolVar(&purgeConfig, "purge-config", false, "Also remove the settings of the plugin from the Portmaster configuration")
+
+	return cmd
+}
+
+// readPluginConfigs reads the plugins.json file at path. It returns no
+// plugins if the file does not exist.
+func readPluginConfigs(path string) ([]shared.PluginConfig, error) {
+	blob, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read plugins.json: %w", err)
+	}
+
+	var cfgs []shared.PluginConfig
+	if err := json.Unmarshal(blob, &cfgs); err != nil {
+		return nil, fmt.Errorf("failed to parse plugins.json: %w", err)
+	}
+
+	return cfgs, nil
+}
+
+// removePluginConfig removes the plugin named pluginName from the
+// plugins.json file at path.
+func removePluginConfig(path, pluginName string) error {
+	cfgs, err := readPluginConfigs(path)
+	if err != nil || cfgs == nil {
+		return err
+	}
+
+	for idx, cfg := range cfgs {
+		if cfg.Name == pluginName {
+			cfgs = append(cfgs[:idx], cfgs[idx+1:]...)
+
+			break
+		}
+	}
+
+	blob, err := json.MarshalIndent(cfgs, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, blob, 0644)
+}
+
+// removePluginSettings removes the settings of the plugin named pluginName
+// from the Portmaster configuration file at path.
+func removePluginSettings(path, pluginName string) error {
+	config, err := readPortmasterConfig(path)
+	if err != nil {
+		return err
+	}
+
+	plugins, ok := config["plugins"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+
+	if _, ok := plugins[pluginName]; !ok {
+		return nil
+	}
+	delete(plugins, pluginName)
+
+	blob, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, blob, 0600)
+}
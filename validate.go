@@ -0,0 +1,310 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/ameshkov/dnsstamps"
+	"github.com/hashicorp/go-hclog"
+	"github.com/miekg/dns"
+	"github.com/safing/portmaster/plugin/shared/proto"
+)
+
+// validateEach returns a validation function for string array options
+// that checks every entry using check. Empty entries are ignored.
+func validateEach(check func(string) error) func(*proto.Value) error {
+	return func(v *proto.Value) error {
+		for _, value := range v.StringArray {
+			if strings.TrimSpace(value) == "" {
+				continue
+			}
+
+			if err := check(value); err != nil {
+				return fmt.Errorf("invalid entry %q: %w", value, err)
+			}
+		}
+
+		return nil
+	}
+}
+
+// validateOneOf returns a validation function for string options that
+// only accepts one of values. An empty value selects the default and is
+// always accepted.
+func validateOneOf[T ~string](values ...T) func(*proto.Value) error {
+	return func(v *proto.Value) error {
+		if v.String_ == "" || slices.Contains(values, T(v.String_)) {
+			return nil
+		}
+
+		names := make([]string, len(values))
+		for idx, value := range values {
+			names[idx] = fmt.Sprintf("%q", value)
+		}
+
+		return fmt.Errorf("unknown value %q, expected one of %s", v.String_, strings.Join(names, ", "))
+	}
+}
+
+// validateRange returns a validation function for int options that only
+// accepts values between low and high, inclusive. Zero is additionally
+// accepted if zero is set, as it disables most features.
+func validateRange(low, high int64, zero bool) func(*proto.Value) error {
+	return func(v *proto.Value) error {
+		if (zero && v.Int == 0) || (v.Int >= low && v.Int <= high) {
+			return nil
+		}
+
+		if zero {
+			return fmt.Errorf("%d is out of range, expected 0 or a value between %d and %d", v.Int, low, high)
+		}
+
+		return fmt.Errorf("%d is out of range, expected a value between %d and %d", v.Int, low, high)
+	}
+}
+
+// validateMinFields returns a check for rules consisting of at least n
+// whitespace separated fields, described by format.
+func validateMinFields(n int, format string) func(string) error {
+	return func(value string) error {
+		if len(strings.Fields(value)) < n {
+			return fmt.Errorf("expected %q", format)
+		}
+
+		return nil
+	}
+}
+
+// validateStampEntry checks a "[<name>] <stamp>" entry of the serverStamps
+// option.
+func validateStampEntry(value string) error {
+	cfg, ok := parseStampEntry(value)
+	if !ok {
+		return errors.New("expected \"[<name>] <stamp>\"")
+	}
+
+	return validateStamp(cfg.stamp)
+}
+
+// validateStamp checks the syntax of a server stamp or DNS-over-TLS and
+// DNS-over-QUIC URL without dialing the server.
+func validateStamp(value string) error {
+	switch {
+	case isDoTURL(value):
+		_, err := parseDoTURL(value)
+
+		return err
+	case isDoQURL(value):
+		_, err := parseDoQURL(value)
+
+		return err
+	}
+
+	stamp, err := dnsstamps.NewServerStampFromString(value)
+	if err != nil {
+		return err
+	}
+
+	switch stamp.Proto {
+	case dnsstamps.StampProtoTypeDNSCrypt, dnsstamps.StampProtoTypeDoH, dnsstamps.StampProtoTypeTLS, dnsstamps.StampProtoTypeDoQ:
+		return nil
+	default:
+		return fmt.Errorf("unsupported stamp protocol %s", stamp.Proto.String())
+	}
+}
+
+// validateSource checks a "<url> <minisign-key>" entry of the sources
+// option.
+func validateSource(value string) error {
+	_, err := parseSource(value)
+
+	return err
+}
+
+// validateSchedule checks an entry of the schedules option.
+func validateSchedule(value string) error {
+	_, _, err := parseSchedule(value)
+
+	return err
+}
+
+// validateRemoteBlocklist checks an entry of the blocklistURLs option.
+func validateRemoteBlocklist(value string) error {
+	_, err := parseRemoteBlocklist(value)
+
+	return err
+}
+
+// validateBootstrapResolver checks that value is an IP address with an
+// optional port.
+func validateBootstrapResolver(value string) error {
+	host := value
+	if h, _, err := net.SplitHostPort(value); err == nil {
+		host = h
+	}
+
+	if net.ParseIP(host) == nil {
+		return errors.New("an IP address is required")
+	}
+
+	return nil
+}
+
+// validateServerWeight checks a "<server> <weight>" entry of the
+// serverWeights option.
+func validateServerWeight(value string) error {
+	fields := strings.Fields(value)
+	if len(fields) != 2 {
+		return errors.New("expected \"<server> <weight>\"")
+	}
+
+	weight, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil || weight < 0 || math.IsInf(weight, 0) {
+		return errors.New("the weight must be a non-negative number")
+	}
+
+	return nil
+}
+
+// validateServerNetwork checks a "<server> <udp|tcp>" entry of the
+// serverProtocols option.
+func validateServerNetwork(value string) error {
+	fields := strings.Fields(value)
+	if len(fields) != 2 || (fields[1] != "udp" && fields[1] != "tcp") {
+		return errors.New("expected \"<server> <udp|tcp>\"")
+	}
+
+	return nil
+}
+
+// validateNetworkRule checks a "<network> <server>..." entry of the
+// networkRules option.
+func validateNetworkRule(value string) error {
+	fields := strings.Fields(value)
+	if len(fields) < 2 {
+		return errors.New("expected \"<network> <server> [<server>...]\"")
+	}
+
+	_, err := netip.ParsePrefix(fields[0])
+
+	return err
+}
+
+// validateForwardingRule checks a "<domain> <server>..." entry of the
+// forwardingRules option.
+func validateForwardingRule(value string) error {
+	fields := strings.Fields(value)
+	if len(fields) < 2 {
+		return errors.New("expected \"<domain> <server> [<server>...]\"")
+	}
+
+	if _, ok := dns.IsDomainName(fields[0]); !ok {
+		return fmt.Errorf("invalid domain %q", fields[0])
+	}
+
+	return nil
+}
+
+// validateCloakingRule checks an entry of the cloakingRules option.
+func validateCloakingRule(value string) error {
+	_, _, err := parseCloakingRule(value)
+
+	return err
+}
+
+// validateQueryType checks an entry of the blockedQueryTypes option.
+func validateQueryType(value string) error {
+	_, err := parseQueryType(value)
+
+	return err
+}
+
+// validateIPRange checks an entry of the blockedIPs option.
+func validateIPRange(value string) error {
+	_, err := parseIPRange(value)
+
+	return err
+}
+
+// validateDNS64Prefix checks an entry of the dns64Prefixes option.
+func validateDNS64Prefix(value string) error {
+	_, err := parseDNS64Prefix(value)
+
+	return err
+}
+
+// validateDomain checks an entry of the cacheBypass, allowlist or
+// rebindingAllowlist option.
+func validateDomain(value string) error {
+	if _, ok := dns.IsDomainName(value); !ok {
+		return errors.New("invalid domain")
+	}
+
+	return nil
+}
+
+// validateProxy checks the proxy option.
+func validateProxy(v *proto.Value) error {
+	_, _, err := parseProxy(v.String_)
+
+	return err
+}
+
+// validateTraceEndpoint checks the traceEndpoint option.
+func validateTraceEndpoint(v *proto.Value) error {
+	_, err := parseTraceEndpoint(v.String_)
+
+	return err
+}
+
+// validateCaptivePortalProbe checks the captivePortalProbe option.
+func validateCaptivePortalProbe(v *proto.Value) error {
+	_, err := parseCaptivePortalProbe(v.String_)
+
+	return err
+}
+
+// validateClientSubnet checks the clientSubnet option.
+func validateClientSubnet(v *proto.Value) error {
+	if v.String_ == "" {
+		return nil
+	}
+
+	_, _, err := net.ParseCIDR(v.String_)
+
+	return err
+}
+
+// rejectedValues holds the last rejected value of each option so the user
+// is only notified once, even though the Portmaster sends the values of all
+// options whenever one of them changes. It is guarded by valuesLock.
+var rejectedValues = make(map[string]*proto.Value)
+
+// validateValue checks value using the validation function of opt. Invalid
+// values are reported to the user.
+func validateValue(opt configOption, value *proto.Value) error {
+	if opt.validate == nil {
+		return nil
+	}
+
+	err := opt.validate(value)
+	if err == nil {
+		return nil
+	}
+
+	hclog.L().Error("invalid configuration value", "key", opt.Key, "error", err)
+
+	notify(&proto.Notification{
+		EventId: "dnscrypt-invalid-option-" + opt.Key,
+		Title:   "DNSCrypt: Invalid setting " + opt.Name,
+		Message: fmt.Sprintf("The value of %q is invalid: %s", opt.Name, err),
+	})
+
+	return err
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+)
+
+// verifySourcesCommand returns the command that verifies the signatures of
+// the resolver lists downloaded by the running plugin without downloading
+// them again.
+func verifySourcesCommand() *cobra.Command {
+	var (
+		flags   installFlags
+		sources []string
+	)
+
+	cmd := &cobra.Command{
+		Use:   "verify-sources",
+		Short: "Verify the signatures of the downloaded resolver lists",
+		Long:  "Verify the minisign signatures of the resolver and relay lists cached in the plugin data directory against the configured public keys. Nothing is downloaded, use fetch-sources to check the download.",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			cmd.SilenceErrors = true
+
+			if len(sources) == 0 {
+				config, err := readPortmasterConfig(flags.configFile())
+				if err != nil {
+					return err
+				}
+
+				sources = effectiveValues(pluginSection(config, flags.pluginName, false))["sources"].StringArray
+			}
+
+			report := &testReport{out: cmd.OutOrStdout()}
+			cacheDir := filepath.Join(flags.dataDirectory(), "sources")
+
+			for idx, value := range sources {
+				if idx > 0 {
+					fmt.Fprintln(cmd.OutOrStdout())
+				}
+
+				verifyCachedSource(report, value, cacheDir)
+			}
+
+			if report.failed {
+				return errors.New("failed to verify some resolver lists")
+			}
+
+			return nil
+		},
+	}
+
+	flags.register(cmd)
+	cmd.Flags().StringArrayVar(&sources, "source", nil, "Resolver list to verify instead of the configured ones, in the format \"<url> <minisign-key>\"")
+
+	return cmd
+}
+
+// verifyCachedSource verifies the cached copy of the resolver list value
+// in cacheDir, adding the result of each step to report.
+func verifyCachedSource(report *testReport, value, cacheDir string) {
+	src, err := parseSource(value)
+	if err != nil {
+		report.fail("Source", err)
+
+		return
+	}
+	report.pass("Source", "%s", src.url)
+	report.pass("Key", "%s", src.key.ID())
+
+	file := sourceCacheFile(cacheDir, src)
+
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		report.fail("List", fmt.Errorf("%s has not been downloaded yet", file))
+		report.skip("Signature", "list not downloaded")
+
+		return
+	}
+	if err != nil {
+		report.fail("List", err)
+		report.skip("Signature", "list not readable")
+
+		return
+	}
+	report.pass("List", "%s, %d bytes", file, len(data))
+
+	sig, err := os.ReadFile(file + ".minisig")
+	if err != nil {
+		report.fail("Signature", err)
+
+		return
+	}
+
+	if err := src.key.verify(data, sig); err != nil {
+		report.fail("Signature", fmt.Errorf("%s: %w", file+".minisig", err))
+
+		return
+	}
+	report.pass("Signature", "%s, valid", file+".minisig")
+}
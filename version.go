@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"runtime"
+	"runtime/debug"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+)
+
+// version, commit and date are set at build time using -ldflags, e.g. by
+// goreleaser.
+var (
+	version = "dev"
+	commit  = "unknown"
+	date    = "unknown"
+)
+
+// keyDependencies are the modules whose versions are reported by the
+// version command.
+var keyDependencies = []struct {
+	name string
+	path string
+}{
+	{"dnscrypt", "github.com/ameshkov/dnscrypt/v2"},
+	{"dnsstamps", "github.com/ameshkov/dnsstamps"},
+	{"miekg/dns", "github.com/miekg/dns"},
+	{"portmaster", "github.com/safing/portmaster"},
+}
+
+// buildMetadata describes the build of the plugin.
+type buildMetadata struct {
+	Version      string            `json:"version"`
+	Commit       string            `json:"commit"`
+	Date         string            `json:"date"`
+	GoVersion    string            `json:"goVersion"`
+	Dependencies map[string]string `json:"dependencies,omitempty"`
+}
+
+// getBuildMetadata returns the metadata set at build time. Values not set
+// using -ldflags are taken from the build information embedded by the Go
+// toolchain, if available.
+func getBuildMetadata() buildMetadata {
+	meta := buildMetadata{
+		Version:      version,
+		Commit:       commit,
+		Date:         date,
+		GoVersion:    runtime.Version(),
+		Dependencies: make(map[string]string),
+	}
+
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return meta
+	}
+
+	if meta.Version == "dev" && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		meta.Version = info.Main.Version
+	}
+
+	for _, setting := range info.Settings {
+		switch {
+		case setting.Key == "vcs.revision" && meta.Commit == "unknown":
+			meta.Commit = setting.Value
+		case setting.Key == "vcs.time" && meta.Date == "unknown":
+			meta.Date = setting.Value
+		}
+	}
+
+	for _, dep := range info.Deps {
+		if dep.Replace != nil {
+			dep = dep.Replace
+		}
+
+		for _, key := range keyDependencies {
+			if dep.Path == key.path {
+				meta.Dependencies[key.name] = dep.Version
+			}
+		}
+	}
+
+	return meta
+}
+
+// registrationConfig returns the static configuration stored in
+// plugins.json by the install command so the installed build can be
+// identified.
+func registrationConfig() json.RawMessage {
+	blob, err := json.Marshal(getBuildMetadata())
+	if err != nil {
+		return nil
+	}
+
+	return blob
+}
+
+// versionCommand returns the command that prints the build metadata of the
+// plugin.
+func versionCommand() *cobra.Command {
+	var asJSON bool
+
+	cmd := &cobra.Command{
+		Use:   "version",
+		Short: "Print the version of the plugin and its key dependencies",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			meta := getBuildMetadata()
+
+			if asJSON {
+				enc := json.NewEncoder(cmd.OutOrStdout())
+				enc.SetIndent("", "  ")
+
+				return enc.Encode(meta)
+			}
+
+			printBuildMetadata(cmd.OutOrStdout(), meta)
+
+			return nil
+		},
+	}
+
+	cmd.Flags().BoolVar(&asJSON, "json", false, "Print the build metadata as JSON")
+
+	return cmd
+}
+
+// printBuildMetadata prints meta in a human readable form.
+func printBuildMetadata(out io.Writer, meta buildMetadata) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	defer w.Flush()
+
+	fmt.Fprintf(w, "Version:\t%s\n", meta.Version)
+	fmt.Fprintf(w, "Commit:\t%s\n", meta.Commit)
+	fmt.Fprintf(w, "Built:\t%s\n", meta.Date)
+	fmt.Fprintf(w, "Go:\t%s\n", meta.GoVersion)
+
+	for _, dep := range keyDependencies {
+		if v, ok := meta.Dependencies[dep.name]; ok {
+			fmt.Fprintf(w, "%s:\t%s\n", dep.name, v)
+		}
+	}
+}